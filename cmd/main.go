@@ -1,10 +1,25 @@
 package main
 
 import (
+	"github.com/volodimyr/publisher/pkg/api/deadletter"
+	"github.com/volodimyr/publisher/pkg/api/event"
 	"github.com/volodimyr/publisher/pkg/api/listener"
+	"github.com/volodimyr/publisher/pkg/api/message"
 	"github.com/volodimyr/publisher/pkg/api/publisher"
+	"github.com/volodimyr/publisher/pkg/archive"
+	"github.com/volodimyr/publisher/pkg/auth"
+	"github.com/volodimyr/publisher/pkg/breaker"
+	"github.com/volodimyr/publisher/pkg/client"
+	"github.com/volodimyr/publisher/pkg/config"
+	dlq "github.com/volodimyr/publisher/pkg/deadletter"
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/egress"
+	"github.com/volodimyr/publisher/pkg/idempotency"
 	"github.com/volodimyr/publisher/pkg/persistence"
 	"github.com/volodimyr/publisher/pkg/server"
+	"github.com/volodimyr/publisher/pkg/suspension"
+	"github.com/volodimyr/publisher/pkg/tracker"
+	"github.com/volodimyr/publisher/pkg/verification"
 	"log"
 	"net/http"
 	"os"
@@ -12,14 +27,73 @@ import (
 
 func main() {
 	logger := log.New(os.Stdout, "server: ", log.LstdFlags|log.Lshortfile)
+	cfg, err := config.Parse(os.Args[1:])
+	if err != nil {
+		logger.Fatalf("server: invalid configuration [%v]\n", err)
+	}
 	mux := http.NewServeMux()
 
-	storage := persistence.New(logger)
-	listener.NewHandlers(logger, storage).SetupRoutes(mux)
-	publisher.NewHandlers(logger, storage).SetupRoutes(mux)
+	policy, err := egress.New(cfg.EgressAllowCIDRs, cfg.EgressDenyCIDRs, cfg.EgressAllowHosts, cfg.EgressDenyHosts)
+	if err != nil {
+		logger.Fatalf("server: invalid egress policy [%v]\n", err)
+	}
+	client.Guard(policy)
+
+	dead := dlq.New(logger, cfg.DeadLetterCapacity)
+	track := tracker.New(logger, cfg.MessageCapacity, cfg.MessageRetention)
+	var breakers *breaker.Breakers
+	if cfg.BreakerThreshold > 0 {
+		breakers = breaker.New(breaker.Config{Threshold: cfg.BreakerThreshold, Cooldown: cfg.BreakerCooldown, Probes: cfg.BreakerProbes})
+	}
+	var storage *persistence.Storage
+	if cfg.Storage == config.StorageFile {
+		if storage, err = persistence.Open(logger, cfg.DataDir, cfg.SnapshotInterval); err != nil {
+			logger.Fatalf("server: couldn't open storage at [%s] [%v]\n", cfg.DataDir, err)
+		}
+	} else {
+		storage = persistence.New(logger)
+	}
+	var observer dispatcher.Observer = track
+	var monitor *suspension.Monitor
+	if cfg.SuspendAfterFailures > 0 || cfg.SuspendAfter > 0 {
+		monitor = suspension.New(logger, storage, suspension.Config{MaxFailures: cfg.SuspendAfterFailures, MaxFailing: cfg.SuspendAfter, Webhook: cfg.SuspendWebhook})
+		observer = dispatcher.Observers{track, monitor}
+	}
+	d := dispatcher.New(logger, dispatcher.Config{Workers: cfg.Workers, QueueSize: cfg.QueueSize, Retry: cfg.Retry, DeadLetters: dead, Passthrough: cfg.PassthroughHeaders,
+		Observer: observer, Breakers: breakers})
+	var verifier *verification.Verifier
+	if cfg.VerifyListeners {
+		verifier = verification.New(logger, storage, verification.Config{Expiry: cfg.VerificationExpiry, Interval: cfg.VerificationInterval})
+	}
+	var retained *archive.Archive
+	var replay *archive.Replayer
+	if cfg.ReplayWindow > 0 {
+		retained = archive.New(cfg.ReplayWindow, cfg.ReplayMaxBytes)
+		replay = archive.NewReplayer(retained, storage, d, track)
+	}
+	listener.NewHandlers(logger, storage, listener.Config{Egress: policy, Verifier: verifier, Tracker: track, Replay: replay, Breakers: breakers, Monitor: monitor}).SetupRoutes(mux)
+	var idem *idempotency.Store
+	if cfg.IdempotencyWindow > 0 {
+		idem = idempotency.New(cfg.IdempotencyWindow)
+	}
+	publisher.NewHandlers(logger, storage, d, publisher.Config{Idempotency: idem, Tracker: track, Archive: retained}).SetupRoutes(mux)
+	message.NewHandlers(logger, track).SetupRoutes(mux)
+	event.NewHandlers(logger, storage, verifier).SetupRoutes(mux)
+	deadletter.NewHandlers(logger, dead, d).SetupRoutes(mux)
+
+	var handler http.Handler = mux
+	if cfg.AuthEnabled() {
+		a, err := auth.New(logger, auth.Config{APIKeys: cfg.APIKeysFile, JWKS: cfg.JWKSFile, Issuer: cfg.JWTIssuer, Audience: cfg.JWTAudience})
+		if err != nil {
+			logger.Fatalf("server: couldn't load credentials [%v]\n", err)
+		}
+		handler = a.Middleware(mux, auth.RouteScope)
+	} else {
+		logger.Println("server: authentication is disabled, anyone who reaches the api can use it")
+	}
 
-	ser := server.New(mux, ":8080")
-	logger.Printf("Starting server at [%v] \n", ":8080")
+	ser := server.New(handler, cfg.Addr)
+	logger.Printf("Starting server at [%v] \n", cfg.Addr)
 	if err := ser.ListenAndServe(); err != nil {
 		logger.Fatalf("server: failed to start [%v]\n", err)
 	}
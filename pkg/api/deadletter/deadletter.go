@@ -0,0 +1,122 @@
+package deadletter
+
+import (
+	"github.com/volodimyr/publisher/pkg/deadletter"
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/response"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	redriven = "Redriven"
+	removed  = "Removed"
+
+	getOnly        = "GET method only"
+	getDeleteOnly  = "GET or DELETE method only"
+	postOnly       = "POST method only"
+	errorNotFound  = "Dead letter not found"
+	errorNotQueued = "Couldn't queue message, try again later"
+)
+
+//Handlers handles /deadletters endpoints
+//It also holds essential dependencies to be using
+type Handlers struct {
+	logger *log.Logger
+	store  *deadletter.Store
+	d      *dispatcher.Dispatcher
+}
+
+//SetupRoutes setups all initial endpoints for dead letter handlers
+func (h *Handlers) SetupRoutes(sm *http.ServeMux) {
+	sm.HandleFunc("/deadletters", h.Logger(h.list))
+	sm.HandleFunc("/deadletters/", h.Logger(h.letter))
+}
+
+func (h *Handlers) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		resp.JSON(w, http.StatusOK, h.store.List())
+		return
+	}
+	h.logger.Printf("server: method [%s] not available for dead letters endpoint\n", r.Method)
+	http.Error(w, getOnly, http.StatusMethodNotAllowed)
+}
+
+//letter dispatches /deadletters/{id} and /deadletters/{id}/redrive
+func (h *Handlers) letter(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/deadletters/"), "/")
+	id := parts[0]
+	if id == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "redrive") {
+		h.logger.Printf("server: unknown dead letter path [%s]\n", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 2 {
+		h.redrive(w, r, id)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		rec, ok := h.store.Get(id)
+		if !ok {
+			http.Error(w, errorNotFound, http.StatusNotFound)
+			return
+		}
+		resp.JSON(w, http.StatusOK, rec)
+	case http.MethodDelete:
+		if !h.store.Remove(id) {
+			http.Error(w, errorNotFound, http.StatusNotFound)
+			return
+		}
+		h.logger.Printf("server: Dead letter [%s] removed\n", id)
+		resp.OK(w, removed)
+	default:
+		h.logger.Printf("server: method [%s] not available for dead letter endpoint\n", r.Method)
+		http.Error(w, getDeleteOnly, http.StatusMethodNotAllowed)
+	}
+}
+
+//redrive queues dead letter for delivery again with a fresh attempt history
+//Record is taken out of the store first, so concurrent redrives of it don't deliver it twice
+func (h *Handlers) redrive(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		h.logger.Printf("server: method [%s] not available for redrive endpoint\n", r.Method)
+		http.Error(w, postOnly, http.StatusMethodNotAllowed)
+		return
+	}
+	rec, ok := h.store.Take(id)
+	if !ok {
+		http.Error(w, errorNotFound, http.StatusNotFound)
+		return
+	}
+	if err := h.d.Enqueue(rec.Redelivery()); err != nil {
+		h.store.Restore(rec)
+		h.logger.Printf("server: Couldn't redrive dead letter [%s] [%v]\n", id, err)
+		http.Error(w, errorNotQueued, http.StatusServiceUnavailable)
+		return
+	}
+	h.logger.Printf("server: Dead letter [%s] redriven to the listener [%s]\n", id, rec.Name)
+	resp.OK(w, redriven)
+}
+
+//Logger is a middleware for the dead letter handlers
+func (h *Handlers) Logger(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer h.logger.Printf("request processed in [%s]\n", time.Now().Sub(start))
+		next(w, r)
+	}
+}
+
+//NewHandlers create Dead letter Handlers and establishes all dependencies
+//Important SetupRoutes needs to be called before it can be used
+//if logger == nil, default will be taken
+func NewHandlers(logger *log.Logger, store *deadletter.Store, d *dispatcher.Dispatcher) *Handlers {
+	if logger == nil {
+		logger = log.New(os.Stdout, "server: ", log.LstdFlags|log.Lshortfile)
+	}
+	return &Handlers{logger: logger, store: store, d: d}
+}
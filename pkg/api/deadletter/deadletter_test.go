@@ -0,0 +1,190 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/volodimyr/publisher/pkg/deadletter"
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/models"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	logger = log.New(os.Stdout, "test: ", log.LstdFlags|log.Lshortfile)
+	body   = `{"data":"default"}`
+)
+
+func setupStore(address string) (*deadletter.Store, string) {
+	store := deadletter.New(logger, 0)
+	store.Put(dispatcher.Delivery{Listener: models.Listener{Name: "listener", Address: address, Method: http.MethodPut}, Event: "event", Body: []byte(body),
+		Attempts: []dispatcher.Attempt{{Time: time.Now(), Status: 500, Error: "unexpected status code [500]"}}})
+	return store, store.List()[0].ID
+}
+
+func TestDeadLetters(t *testing.T) {
+	store, id := setupStore("http://localhost:8090/test")
+	d := dispatcher.New(logger, dispatcher.Config{Workers: 1})
+	defer d.Stop()
+	h := NewHandlers(logger, store, d)
+	tests := []struct {
+		name           string
+		in             *http.Request
+		out            *httptest.ResponseRecorder
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "POST_LIST", in: httptest.NewRequest("POST", "/deadletters", nil),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusMethodNotAllowed, expectedBody: getOnly + "\n"},
+		{name: "GET_UNKNOWN", in: httptest.NewRequest("GET", "/deadletters/unknown", nil),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusNotFound, expectedBody: errorNotFound + "\n"},
+		{name: "GET_REDRIVE", in: httptest.NewRequest("GET", fmt.Sprintf("/deadletters/%s/redrive", id), nil),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusMethodNotAllowed, expectedBody: postOnly + "\n"},
+		{name: "PUT", in: httptest.NewRequest("PUT", fmt.Sprintf("/deadletters/%s", id), nil),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusMethodNotAllowed, expectedBody: getDeleteOnly + "\n"},
+		{name: "POST_UNKNOWN_ACTION", in: httptest.NewRequest("POST", fmt.Sprintf("/deadletters/%s/replay", id), nil),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusNotFound, expectedBody: "404 page not found\n"},
+		{name: "REDRIVE_UNKNOWN", in: httptest.NewRequest("POST", "/deadletters/unknown/redrive", nil),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusNotFound, expectedBody: errorNotFound + "\n"},
+		{name: "DELETE", in: httptest.NewRequest("DELETE", fmt.Sprintf("/deadletters/%s", id), nil),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusOK, expectedBody: removed},
+		{name: "DELETE_AGAIN", in: httptest.NewRequest("DELETE", fmt.Sprintf("/deadletters/%s", id), nil),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusNotFound, expectedBody: errorNotFound + "\n"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			h.SetupRoutes(mux)
+			mux.ServeHTTP(test.out, test.in)
+			if test.out.Code != test.expectedStatus {
+				t.Logf("Expected [%d], but got [%d]", test.expectedStatus, test.out.Code)
+				t.Fail()
+			}
+
+			body := test.out.Body.String()
+			if body != test.expectedBody {
+				t.Logf("Expected [%s], but got [%s]", test.expectedBody, body)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	store, id := setupStore("http://localhost:8090/test")
+	h := NewHandlers(logger, store, nil)
+	w := httptest.NewRecorder()
+
+	h.list(w, httptest.NewRequest("GET", "/deadletters", nil))
+
+	var list []struct {
+		ID        string          `json:"id"`
+		Listener  string          `json:"listener"`
+		Body      json.RawMessage `json:"body"`
+		LastError string          `json:"last_error"`
+		Attempts  []interface{}   `json:"attempts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Expected json list, but got [%s] [%v]", w.Body.String(), err)
+	}
+	if len(list) != 1 || list[0].ID != id || list[0].Listener != "listener" || string(list[0].Body) != body ||
+		list[0].LastError == "" || len(list[0].Attempts) != 1 {
+		t.Logf("Unexpected dead letters [%s]", w.Body.String())
+		t.Fail()
+	}
+}
+
+func TestRedrive(t *testing.T) {
+	received := make(chan string, 1)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		bs, _ := ioutil.ReadAll(r.Body)
+		received <- r.Method + " " + string(bs)
+	}))
+	defer fake.Close()
+	store, id := setupStore(fake.URL)
+	d := dispatcher.New(logger, dispatcher.Config{Workers: 1})
+	defer d.Stop()
+	h := NewHandlers(logger, store, d)
+	w := httptest.NewRecorder()
+
+	h.letter(w, httptest.NewRequest("POST", fmt.Sprintf("/deadletters/%s/redrive", id), nil))
+
+	if w.Code != http.StatusOK {
+		t.Logf("Expected [%d], but got [%d]", http.StatusOK, w.Code)
+		t.Fail()
+	}
+	if _, ok := store.Get(id); ok {
+		t.Log("Expected redriven dead letter to be removed")
+		t.Fail()
+	}
+	select {
+	case actual := <-received:
+		//redriven delivery keeps options of the listener
+		if expected := http.MethodPut + " " + body; actual != expected {
+			t.Logf("Expected [%s], but got [%s]", expected, actual)
+			t.Fail()
+		}
+	case <-time.After(time.Second * 5):
+		t.Log("Listener hasn't received redriven message")
+		t.Fail()
+	}
+}
+
+//TestConcurrentRedrive is meant to be run with -race, the dead letter is redriven once only
+func TestConcurrentRedrive(t *testing.T) {
+	store, id := setupStore("http://localhost:8090/test")
+	d := dispatcher.New(logger, dispatcher.Config{Workers: 1})
+	defer d.Stop()
+	h := NewHandlers(logger, store, d)
+	const redrives = 10
+	codes := make(chan int, redrives)
+	var wg sync.WaitGroup
+	for i := 0; i < redrives; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h.letter(w, httptest.NewRequest("POST", fmt.Sprintf("/deadletters/%s/redrive", id), nil))
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	redriven := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			redriven++
+		}
+	}
+	if redriven != 1 {
+		t.Logf("Expected dead letter to be redriven once, but got [%d]", redriven)
+		t.Fail()
+	}
+}
+
+func TestRedriveNotQueued(t *testing.T) {
+	store, id := setupStore("http://localhost:8090/test")
+	d := dispatcher.New(logger, dispatcher.Config{Workers: 1})
+	d.Stop()
+	h := NewHandlers(logger, store, d)
+	w := httptest.NewRecorder()
+
+	h.letter(w, httptest.NewRequest("POST", fmt.Sprintf("/deadletters/%s/redrive", id), nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Logf("Expected [%d], but got [%d]", http.StatusServiceUnavailable, w.Code)
+		t.Fail()
+	}
+	if _, ok := store.Get(id); !ok {
+		t.Log("Expected dead letter which couldn't be queued to be kept")
+		t.Fail()
+	}
+}
@@ -0,0 +1,146 @@
+package event
+
+import (
+	"github.com/volodimyr/publisher/pkg/models"
+	"github.com/volodimyr/publisher/pkg/persistence"
+	"github.com/volodimyr/publisher/pkg/response"
+	"github.com/volodimyr/publisher/pkg/verification"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	unregistered = "Removed"
+
+	getOnly    = "GET method only"
+	deleteOnly = "DELETE method only"
+
+	errorNotRegistered         = "Event wasn't registered"
+	errorListenerNotRegistered = "Listener isn't subscribed to the event"
+	errorRegistry              = "Couldn't read registry"
+	errorRegistryUpdate        = "Couldn't update registry"
+)
+
+//Handlers handles /events endpoints
+//It also holds essential dependencies to be using
+type Handlers struct {
+	logger *log.Logger
+	r      persistence.Registry
+	v      *verification.Verifier
+}
+
+//SetupRoutes setups all initial endpoints for event handlers
+func (h *Handlers) SetupRoutes(sm *http.ServeMux) {
+	sm.HandleFunc("/events", h.Logger(h.list))
+	sm.HandleFunc("/events/", h.Logger(h.event))
+}
+
+//list responds with every registered event and the amount of its listeners
+func (h *Handlers) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.logger.Printf("server: method [%s] not available for events endpoint\n", r.Method)
+		http.Error(w, getOnly, http.StatusMethodNotAllowed)
+		return
+	}
+	events, err := h.r.List()
+	if err != nil {
+		h.logger.Printf("server: Couldn't list events [%v]\n", err)
+		http.Error(w, errorRegistry, http.StatusInternalServerError)
+		return
+	}
+	infos := make([]models.EventInfo, 0, len(events))
+	for name, listeners := range events {
+		infos = append(infos, models.EventInfo{Name: name, Listeners: len(listeners)})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	resp.JSON(w, http.StatusOK, infos)
+}
+
+//event dispatches /events/{event}/listeners and /events/{event}/listeners/{name}
+//Event name itself may contain slashes, so the path is split at the last "/listeners" segment
+func (h *Handlers) event(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/events/")
+	if strings.HasSuffix(path, "/listeners") && path != "/listeners" {
+		h.listeners(w, r, strings.TrimSuffix(path, "/listeners"))
+		return
+	}
+	if i := strings.LastIndex(path, "/listeners/"); i > 0 && i+len("/listeners/") < len(path) {
+		h.unsubscribe(w, r, path[:i], path[i+len("/listeners/"):])
+		return
+	}
+	h.logger.Printf("server: unknown events path [%s]\n", r.URL.Path)
+	http.NotFound(w, r)
+}
+
+//unsubscribe removes the listener from a single event, pending verification of the subscription is cancelled as well
+func (h *Handlers) unsubscribe(w http.ResponseWriter, r *http.Request, event, name string) {
+	if r.Method != http.MethodDelete {
+		h.logger.Printf("server: method [%s] not available for event listener endpoint\n", r.Method)
+		http.Error(w, deleteOnly, http.StatusMethodNotAllowed)
+		return
+	}
+	cancelled := h.v != nil && h.v.Cancel(name, event)
+	err := h.r.Unregister(name, event)
+	if err == persistence.ErrNotFound && cancelled {
+		resp.OK(w, unregistered)
+		return
+	}
+	if err == persistence.ErrNotFound {
+		http.Error(w, errorListenerNotRegistered, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("server: Couldn't unregister listener [%s] from [%s] [%v]\n", name, event, err)
+		http.Error(w, errorRegistryUpdate, http.StatusInternalServerError)
+		return
+	}
+	resp.OK(w, unregistered)
+}
+
+//listeners responds with listeners of the event
+func (h *Handlers) listeners(w http.ResponseWriter, r *http.Request, event string) {
+	if r.Method != http.MethodGet {
+		h.logger.Printf("server: method [%s] not available for event listeners endpoint\n", r.Method)
+		http.Error(w, getOnly, http.StatusMethodNotAllowed)
+		return
+	}
+	listeners, err := h.r.Lookup(event)
+	if err == persistence.ErrNotFound {
+		http.Error(w, errorNotRegistered, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("server: Couldn't lookup event [%s] [%v]\n", event, err)
+		http.Error(w, errorRegistry, http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].Name < listeners[j].Name })
+	for i := range listeners {
+		listeners[i] = listeners[i].Redacted()
+	}
+	resp.JSON(w, http.StatusOK, listeners)
+}
+
+//Logger is a middleware for the event handlers
+func (h *Handlers) Logger(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer h.logger.Printf("request processed in [%s]\n", time.Now().Sub(start))
+		next(w, r)
+	}
+}
+
+//NewHandlers create Event Handlers and establishes all dependencies
+//Important SetupRoutes needs to be called before it can be used
+//if logger == nil, default will be taken
+//if verifier == nil, there are no pending subscriptions to cancel
+func NewHandlers(logger *log.Logger, registry persistence.Registry, verifier *verification.Verifier) *Handlers {
+	if logger == nil {
+		logger = log.New(os.Stdout, "server: ", log.LstdFlags|log.Lshortfile)
+	}
+	return &Handlers{logger: logger, r: registry, v: verifier}
+}
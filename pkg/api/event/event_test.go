@@ -0,0 +1,131 @@
+package event
+
+import (
+	"github.com/volodimyr/publisher/pkg/models"
+	"github.com/volodimyr/publisher/pkg/persistence"
+	"github.com/volodimyr/publisher/pkg/verification"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+var logger = log.New(os.Stdout, "test: ", log.LstdFlags|log.Lshortfile)
+
+func setupStorage(t *testing.T) *persistence.Storage {
+	storage := persistence.New(logger)
+	for _, l := range []models.Listener{
+		{Event: "orders", Name: "billing", Address: "http://localhost:8090/billing"},
+		{Event: "orders", Name: "audit", Address: "http://localhost:8090/audit"},
+		{Event: "users", Name: "audit", Address: "http://localhost:8090/audit", Secrets: []string{"secret"}},
+	} {
+		if err := storage.Register(l); err != nil {
+			t.Fatalf("Couldn't register listener [%v]", err)
+		}
+	}
+	return storage
+}
+
+func TestEvents(t *testing.T) {
+	storage := setupStorage(t)
+	defer storage.Close()
+	h := NewHandlers(logger, storage, nil)
+	tests := []struct {
+		name           string
+		in             *http.Request
+		out            *httptest.ResponseRecorder
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "GET", in: httptest.NewRequest("GET", "/events", nil), out: httptest.NewRecorder(),
+			expectedStatus: http.StatusOK, expectedBody: `[{"name":"orders","listeners":2},{"name":"users","listeners":1}]`},
+		{name: "POST", in: httptest.NewRequest("POST", "/events", nil), out: httptest.NewRecorder(),
+			expectedStatus: http.StatusMethodNotAllowed, expectedBody: getOnly + "\n"},
+		{name: "GET_LISTENERS", in: httptest.NewRequest("GET", "/events/users/listeners", nil), out: httptest.NewRecorder(),
+			expectedStatus: http.StatusOK, expectedBody: `[{"event":"users","name":"audit","address":"http://localhost:8090/audit"}]`},
+		{name: "GET_LISTENERS_UNKNOWN", in: httptest.NewRequest("GET", "/events/unknown/listeners", nil), out: httptest.NewRecorder(),
+			expectedStatus: http.StatusNotFound, expectedBody: errorNotRegistered + "\n"},
+		{name: "DELETE_LISTENERS", in: httptest.NewRequest("DELETE", "/events/users/listeners", nil), out: httptest.NewRecorder(),
+			expectedStatus: http.StatusMethodNotAllowed, expectedBody: getOnly + "\n"},
+		{name: "GET_UNKNOWN_PATH", in: httptest.NewRequest("GET", "/events/users", nil), out: httptest.NewRecorder(),
+			expectedStatus: http.StatusNotFound, expectedBody: "404 page not found\n"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			h.SetupRoutes(mux)
+			mux.ServeHTTP(test.out, test.in)
+			if test.out.Code != test.expectedStatus {
+				t.Logf("Expected [%d], but got [%d]", test.expectedStatus, test.out.Code)
+				t.Fail()
+			}
+
+			body := test.out.Body.String()
+			if body != test.expectedBody {
+				t.Logf("Expected [%s], but got [%s]", test.expectedBody, body)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	storage := setupStorage(t)
+	defer storage.Close()
+	h := NewHandlers(logger, storage, nil)
+	tests := []struct {
+		name           string
+		in             *http.Request
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "GET", in: httptest.NewRequest("GET", "/events/orders/listeners/audit", nil),
+			expectedStatus: http.StatusMethodNotAllowed, expectedBody: deleteOnly + "\n"},
+		{name: "DELETE", in: httptest.NewRequest("DELETE", "/events/orders/listeners/audit", nil),
+			expectedStatus: http.StatusOK, expectedBody: unregistered},
+		{name: "DELETE_AGAIN", in: httptest.NewRequest("DELETE", "/events/orders/listeners/audit", nil),
+			expectedStatus: http.StatusNotFound, expectedBody: errorListenerNotRegistered + "\n"},
+		{name: "GET_LISTENERS", in: httptest.NewRequest("GET", "/events/users/listeners", nil),
+			expectedStatus: http.StatusOK, expectedBody: `[{"event":"users","name":"audit","address":"http://localhost:8090/audit"}]`},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.event(w, test.in)
+		if w.Code != test.expectedStatus {
+			t.Logf("[%s] Expected [%d], but got [%d]", test.name, test.expectedStatus, w.Code)
+			t.Fail()
+		}
+		if body := w.Body.String(); body != test.expectedBody {
+			t.Logf("[%s] Expected [%s], but got [%s]", test.name, test.expectedBody, body)
+			t.Fail()
+		}
+	}
+}
+
+func TestUnsubscribePending(t *testing.T) {
+	silent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer silent.Close()
+	storage := setupStorage(t)
+	defer storage.Close()
+	v := verification.New(logger, storage, verification.Config{Expiry: time.Minute, Interval: time.Minute})
+	defer v.Stop()
+	if _, err := v.Submit(models.Listener{Event: "orders", Name: "silent", Address: silent.URL}); err != nil {
+		t.Fatalf("Couldn't submit listener [%v]", err)
+	}
+	h := NewHandlers(logger, storage, v)
+	w := httptest.NewRecorder()
+
+	h.event(w, httptest.NewRequest("DELETE", "/events/orders/listeners/silent", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != unregistered {
+		t.Logf("Expected [%d] [%s], but got [%d] [%s]", http.StatusOK, unregistered, w.Code, w.Body.String())
+		t.Fail()
+	}
+	if pending := v.Pending("silent"); len(pending) != 0 {
+		t.Logf("Expected pending subscription to be cancelled, but got [%v]", pending)
+		t.Fail()
+	}
+}
@@ -2,12 +2,21 @@ package listener
 
 import (
 	"encoding/json"
+	"github.com/volodimyr/publisher/pkg/archive"
+	"github.com/volodimyr/publisher/pkg/breaker"
+	"github.com/volodimyr/publisher/pkg/egress"
+	"github.com/volodimyr/publisher/pkg/filter"
 	"github.com/volodimyr/publisher/pkg/models"
 	"github.com/volodimyr/publisher/pkg/persistence"
 	"github.com/volodimyr/publisher/pkg/response"
+	"github.com/volodimyr/publisher/pkg/suspension"
+	"github.com/volodimyr/publisher/pkg/topic"
+	"github.com/volodimyr/publisher/pkg/tracker"
+	"github.com/volodimyr/publisher/pkg/verification"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,24 +24,303 @@ import (
 var (
 	registered   = "Registered"
 	unregistered = "Removed"
+	pending      = "Pending verification"
+
+	putPatchOnly = "PUT or PATCH method only"
+	getOnly      = "GET method only"
+	postOnly     = "POST method only"
 
 	deleteOnly = "DELETE method only"
-	postOnly   = "POST method only"
 
-	invalidBody = "Body contains invalid values"
+	invalidBody       = "Body contains invalid values"
+	invalidLimit      = "Limit must be a positive number"
+	addressNotAllowed = "Listener address isn't allowed"
+
+	errorRegistry      = "Couldn't update registry"
+	errorRegistryRead  = "Couldn't read registry"
+	errorNotRegistered = "Listener wasn't registered"
+	errorNotRetained   = "Message isn't retained"
+	errorNotQueued     = "Couldn't queue message, try again later"
+	errorSuspended     = "Listener is suspended, resume it first"
 )
 
 //Handlers handles /listener endpoints
 //It also holds essential dependencies to be using
 type Handlers struct {
 	logger *log.Logger
-	s      *persistence.Storage
+	r      persistence.Registry
+	egress *egress.Policy
+	v      *verification.Verifier
+	t      *tracker.Tracker
+	replay *archive.Replayer
+	cb     *breaker.Breakers
+	m      *suspension.Monitor
 }
 
 //SetupRoutes setups all initial endpoints for listener handlers
 func (h *Handlers) SetupRoutes(sm *http.ServeMux) {
 	sm.HandleFunc("/listener", h.Logger(h.register))
-	sm.HandleFunc("/listener/", h.Logger(h.unregister))
+	sm.HandleFunc("/listener/", h.Logger(h.listener))
+}
+
+//listener dispatches /listener/{name} by method, /listener/{name}/deliveries, /listener/{name}/replay
+//and /listener/{name}/resume
+//Action is taken from the segment after the name only, so listener can be named e.g. "deliveries"
+func (h *Handlers) listener(w http.ResponseWriter, r *http.Request) {
+	if segs := strings.Split(strings.TrimPrefix(r.URL.Path, "/listener/"), "/"); len(segs) == 2 {
+		switch segs[1] {
+		case "deliveries":
+			h.deliveries(w, r)
+			return
+		case "replay":
+			h.replayed(w, r)
+			return
+		case "resume":
+			h.resume(w, r)
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet:
+		h.inspect(w, r)
+	case http.MethodPut, http.MethodPatch:
+		h.update(w, r)
+	default:
+		h.unregister(w, r)
+	}
+}
+
+//update changes address, events and delivery options of the listener at once
+//PUT replaces all of them, PATCH changes only the fields present in the body
+func (h *Handlers) update(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		h.logger.Printf("server: method [%s] not available for update endpoint\n", r.Method)
+		http.Error(w, putPatchOnly, http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	name := strings.TrimPrefix(r.URL.Path, "/listener/")
+	if name == "" {
+		h.logger.Println("server: Listener name has been empty")
+		http.Error(w, "Listener name must be specified", http.StatusBadRequest)
+		return
+	}
+	u := models.ListenerUpdate{}
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		h.logger.Println("server: Invalid body")
+		http.Error(w, invalidBody, http.StatusBadRequest)
+		return
+	}
+	u.Replace = r.Method == http.MethodPut
+	if err := u.Validate(); err != nil {
+		h.logger.Printf("server: Invalid listener update [%v]\n", err)
+		http.Error(w, invalidBody, http.StatusBadRequest)
+		return
+	}
+	if u.Address != nil && !h.allowed(w, *u.Address) {
+		return
+	}
+	current, err := h.subscriptions(name)
+	if err != nil {
+		h.logger.Printf("server: Couldn't list events [%v]\n", err)
+		http.Error(w, errorRegistryRead, http.StatusInternalServerError)
+		return
+	}
+	if len(current) == 0 {
+		http.Error(w, errorNotRegistered, http.StatusNotFound)
+		return
+	}
+	if err := u.ValidateFor(current); err != nil {
+		h.logger.Printf("server: Invalid update of the listener [%s] [%v]\n", name, err)
+		http.Error(w, invalidBody, http.StatusBadRequest)
+		return
+	}
+	unconfirmed := h.unconfirmed(name, u, current)
+	for _, l := range unconfirmed {
+		u.Pending = append(u.Pending, l.Event)
+	}
+	listeners, err := h.r.Update(name, u)
+	if err == persistence.ErrNotFound {
+		http.Error(w, errorNotRegistered, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("server: Couldn't update listener [%s] [%v]\n", name, err)
+		http.Error(w, errorRegistry, http.StatusInternalServerError)
+		return
+	}
+	for _, l := range unconfirmed {
+		if _, err := h.v.Submit(l); err != nil {
+			h.logger.Printf("server: Couldn't verify subscription of the listener [%s] to [%s] [%v]\n", name, l.Event, err)
+			http.Error(w, errorRegistry, http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(unconfirmed) > 0 {
+		resp.JSON(w, http.StatusAccepted, models.NewListenerInfo(name, listeners, unconfirmed))
+		return
+	}
+	resp.JSON(w, http.StatusOK, models.NewListenerInfo(name, listeners, nil))
+}
+
+//subscriptions returns every subscription of the listener with the name
+func (h *Handlers) subscriptions(name string) ([]models.Listener, error) {
+	events, err := h.r.List()
+	if err != nil {
+		return nil, err
+	}
+	var subscribed []models.Listener
+	for _, listeners := range events {
+		if l, ok := listeners[name]; ok {
+			subscribed = append(subscribed, l)
+		}
+	}
+	return subscribed, nil
+}
+
+//unconfirmed returns every subscription the update creates or moves to another address, they're verified in background
+//There are none when verification is disabled
+func (h *Handlers) unconfirmed(name string, u models.ListenerUpdate, current []models.Listener) []models.Listener {
+	if h.v == nil || (u.Address == nil && u.Events == nil) {
+		return nil
+	}
+	byEvent := make(map[string]models.Listener, len(current))
+	for _, l := range current {
+		byEvent[l.Event] = l
+	}
+	var unconfirmed []models.Listener
+	for _, l := range u.Apply(name, current) {
+		if old, ok := byEvent[l.Event]; ok && old.Address == l.Address {
+			continue
+		}
+		unconfirmed = append(unconfirmed, l)
+	}
+	return unconfirmed
+}
+
+//inspect responds with every event the listener is subscribed to
+func (h *Handlers) inspect(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/listener/")
+	if name == "" {
+		h.logger.Println("server: Listener name has been empty")
+		http.Error(w, "Listener name must be specified", http.StatusBadRequest)
+		return
+	}
+	subscribed, err := h.subscriptions(name)
+	if err != nil {
+		h.logger.Printf("server: Couldn't list events [%v]\n", err)
+		http.Error(w, errorRegistryRead, http.StatusInternalServerError)
+		return
+	}
+	var unconfirmed []models.Listener
+	if h.v != nil {
+		for _, p := range h.v.Pending(name) {
+			unconfirmed = append(unconfirmed, p.Listener)
+		}
+	}
+	if len(subscribed) == 0 && len(unconfirmed) == 0 {
+		http.Error(w, errorNotRegistered, http.StatusNotFound)
+		return
+	}
+	info := models.NewListenerInfo(name, subscribed, unconfirmed)
+	if h.cb != nil {
+		for i := range info.Subscriptions {
+			info.Subscriptions[i].Breaker = h.cb.State(info.Subscriptions[i].Address)
+		}
+	}
+	resp.JSON(w, http.StatusOK, info)
+}
+
+//deliveries responds with the delivery log of the listener, the latest first
+//?event=x limits it to a single event, ?limit=n to n deliveries
+func (h *Handlers) deliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.logger.Printf("server: method [%s] not available for deliveries endpoint\n", r.Method)
+		http.Error(w, getOnly, http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/listener/"), "/deliveries")
+	if name == "" || strings.Contains(name, "/") || h.t == nil {
+		h.logger.Printf("server: unknown listener path [%s]\n", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			h.logger.Printf("server: Invalid limit [%s]\n", v)
+			http.Error(w, invalidLimit, http.StatusBadRequest)
+			return
+		}
+	}
+	resp.JSON(w, http.StatusOK, h.t.Deliveries(name, r.URL.Query().Get("event"), limit))
+}
+
+//replayed queues retained messages to the listener again
+//?from= is RFC3339 or unix time, or id of the message the replay starts after
+func (h *Handlers) replayed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.logger.Printf("server: method [%s] not available for replay endpoint\n", r.Method)
+		http.Error(w, postOnly, http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/listener/"), "/replay")
+	if name == "" || strings.Contains(name, "/") || h.replay == nil {
+		h.logger.Printf("server: unknown listener path [%s]\n", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	res, err := h.replay.Replay(name, r.URL.Query().Get("from"))
+	switch err {
+	case nil:
+	case persistence.ErrNotFound:
+		http.Error(w, errorNotRegistered, http.StatusNotFound)
+		return
+	case archive.ErrUnknownMessage:
+		http.Error(w, errorNotRetained, http.StatusNotFound)
+		return
+	case archive.ErrSuspended:
+		http.Error(w, errorSuspended, http.StatusConflict)
+		return
+	default:
+		h.logger.Printf("server: Couldn't replay messages to the listener [%s] after [%d] of them [%v]\n", name, res.Replayed, err)
+		http.Error(w, errorNotQueued, http.StatusServiceUnavailable)
+		return
+	}
+	h.logger.Printf("server: Replaying [%d] messages to the listener [%s]\n", res.Replayed, name)
+	resp.JSON(w, http.StatusAccepted, res)
+}
+
+//resume delivers messages to the suspended listener again, messages published while it was suspended aren't delivered
+func (h *Handlers) resume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.logger.Printf("server: method [%s] not available for resume endpoint\n", r.Method)
+		http.Error(w, postOnly, http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/listener/"), "/resume")
+	if name == "" || strings.Contains(name, "/") {
+		h.logger.Printf("server: unknown listener path [%s]\n", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	suspended := false
+	listeners, err := h.r.Update(name, models.ListenerUpdate{Suspended: &suspended})
+	if err == persistence.ErrNotFound {
+		http.Error(w, errorNotRegistered, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("server: Couldn't resume listener [%s] [%v]\n", name, err)
+		http.Error(w, errorRegistry, http.StatusInternalServerError)
+		return
+	}
+	if h.m != nil {
+		h.m.Reset(name)
+	}
+	h.logger.Printf("server: Resumed listener [%s]\n", name)
+	resp.JSON(w, http.StatusOK, models.NewListenerInfo(name, listeners, nil))
 }
 
 func (h *Handlers) register(w http.ResponseWriter, r *http.Request) {
@@ -46,14 +334,75 @@ func (h *Handlers) register(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, invalidBody, http.StatusBadRequest)
 			return
 		}
+		//only the service suspends listeners, suspended is responded with but never taken from the body
+		l.Suspended = false
 		if err := l.IsEmpty(); err != nil {
-			h.logger.Printf("server: Listener should containe valid non-empty fields [%v]\n", l)
+			h.logger.Printf("server: Listener should containe valid non-empty fields [%v]\n", l.Redacted())
+			http.Error(w, invalidBody, http.StatusBadRequest)
+			return
+		}
+		//name is a single segment of /listener/{name}/{action}
+		if strings.Contains(l.Name, "/") {
+			h.logger.Printf("server: Listener name [%s] contains '/'\n", l.Name)
+			http.Error(w, invalidBody, http.StatusBadRequest)
+			return
+		}
+		if !h.allowed(w, l.Address) {
+			return
+		}
+		if err := topic.Validate(l.Event); err != nil {
+			h.logger.Printf("server: Listener has invalid event pattern [%v]\n", err)
+			http.Error(w, invalidBody, http.StatusBadRequest)
+			return
+		}
+		if l.Retry != nil {
+			if err := l.Retry.Validate(); err != nil {
+				h.logger.Printf("server: Listener has invalid retry policy [%v]\n", err)
+				http.Error(w, invalidBody, http.StatusBadRequest)
+				return
+			}
+		}
+		if l.Filter != "" {
+			if _, err := filter.Compile(l.Filter); err != nil {
+				h.logger.Printf("server: Listener has invalid filter [%v]\n", err)
+				http.Error(w, invalidBody, http.StatusBadRequest)
+				return
+			}
+		}
+		if err := models.ValidateSecrets(l.Secrets); err != nil {
+			h.logger.Printf("server: Listener has invalid secrets [%v]\n", err)
+			http.Error(w, invalidBody, http.StatusBadRequest)
+			return
+		}
+		if err := models.ValidateConcurrency(l.MaxConcurrency); err != nil {
+			h.logger.Printf("server: Listener has invalid concurrency limit [%v]\n", err)
+			http.Error(w, invalidBody, http.StatusBadRequest)
+			return
+		}
+		if err := models.ValidateRequest(l.Timeout, l.Method, l.SuccessCodes); err != nil {
+			h.logger.Printf("server: Listener has invalid delivery request [%v]\n", err)
+			http.Error(w, invalidBody, http.StatusBadRequest)
+			return
+		}
+		if err := models.ValidateOrdering(l.Ordered, l.PartitionKey); err != nil {
+			h.logger.Printf("server: Listener has invalid ordering [%v]\n", err)
 			http.Error(w, invalidBody, http.StatusBadRequest)
 			return
 		}
-		done := make(chan struct{})
-		h.s.New <- persistence.Add{Listener: l, Done: done}
-		<-done
+		if h.v != nil {
+			if _, err := h.v.Submit(l); err != nil {
+				h.logger.Printf("server: Couldn't submit listener [%v] for verification [%v]\n", l.Redacted(), err)
+				http.Error(w, errorRegistry, http.StatusInternalServerError)
+				return
+			}
+			resp.Accepted(w, pending)
+			return
+		}
+		if err := h.r.Register(l); err != nil {
+			h.logger.Printf("server: Couldn't register listener [%v] [%v]\n", l.Redacted(), err)
+			http.Error(w, errorRegistry, http.StatusInternalServerError)
+			return
+		}
 		resp.Created(w, registered)
 		return
 	}
@@ -67,10 +416,25 @@ func (h *Handlers) unregister(w http.ResponseWriter, r *http.Request) {
 			defer r.Body.Close()
 		}
 		lNames := strings.Split(r.URL.Path, "/listener/")
-		if len(lNames) < 2 || lNames[1] != "" {
-			done := make(chan struct{})
-			h.s.Discard <- persistence.Discard{Name: lNames[1], Done: done}
-			<-done
+		if len(lNames) == 2 && lNames[1] != "" {
+			//?event=x limits removal to a single event
+			event := r.URL.Query().Get("event")
+			cancelled := h.v != nil && h.v.Cancel(lNames[1], event)
+			err := h.r.Unregister(lNames[1], event)
+			if err == persistence.ErrNotFound && cancelled {
+				resp.OK(w, unregistered)
+				return
+			}
+			if err == persistence.ErrNotFound {
+				h.logger.Printf("server: Listener [%s] isn't subscribed to [%s]\n", lNames[1], event)
+				http.Error(w, errorNotRegistered, http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				h.logger.Printf("server: Couldn't unregister listener [%s] [%v]\n", lNames[1], err)
+				http.Error(w, errorRegistry, http.StatusInternalServerError)
+				return
+			}
 			resp.OK(w, unregistered)
 			return
 		}
@@ -82,6 +446,24 @@ func (h *Handlers) unregister(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, deleteOnly, http.StatusMethodNotAllowed)
 }
 
+//allowed checks listener address against the egress policy and responds with error if it isn't allowed
+func (h *Handlers) allowed(w http.ResponseWriter, address string) bool {
+	if h.egress == nil {
+		return true
+	}
+	err := h.egress.ValidateURL(address)
+	if err == nil {
+		return true
+	}
+	h.logger.Printf("server: Listener address [%s] isn't valid [%v]\n", address, err)
+	if err == egress.ErrDenied {
+		http.Error(w, addressNotAllowed, http.StatusBadRequest)
+	} else {
+		http.Error(w, invalidBody, http.StatusBadRequest)
+	}
+	return false
+}
+
 //Logger is a middleware for the listener handlers
 func (h *Handlers) Logger(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -91,12 +473,28 @@ func (h *Handlers) Logger(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+//Config holds optional dependencies of the listener Handlers, nil one disables the feature
+//if Egress == nil, listener addresses aren't checked
+//if Verifier == nil, listeners are registered without verification
+//if Tracker == nil, delivery log isn't available
+//if Replay == nil, messages can't be replayed
+//if Breakers == nil, state of circuit breakers isn't reported
+//if Monitor == nil, failures counted before the listener is resumed aren't forgotten
+type Config struct {
+	Egress   *egress.Policy
+	Verifier *verification.Verifier
+	Tracker  *tracker.Tracker
+	Replay   *archive.Replayer
+	Breakers *breaker.Breakers
+	Monitor  *suspension.Monitor
+}
+
 //NewHandlers create Listener Handlers and establishes all dependencies
 //Important SetupRoutes needs to be called before it can be used
 //if logger == nil, default will be taken
-func NewHandlers(logger *log.Logger, storage *persistence.Storage) *Handlers {
+func NewHandlers(logger *log.Logger, registry persistence.Registry, cfg Config) *Handlers {
 	if logger == nil {
 		logger = log.New(os.Stdout, "server: ", log.LstdFlags|log.Lshortfile)
 	}
-	return &Handlers{logger: logger, s: storage}
+	return &Handlers{logger: logger, r: registry, egress: cfg.Egress, v: cfg.Verifier, t: cfg.Tracker, replay: cfg.Replay, cb: cfg.Breakers, m: cfg.Monitor}
 }
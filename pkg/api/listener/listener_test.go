@@ -1,8 +1,17 @@
 package listener
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/volodimyr/publisher/pkg/archive"
+	"github.com/volodimyr/publisher/pkg/breaker"
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/egress"
+	"github.com/volodimyr/publisher/pkg/models"
 	"github.com/volodimyr/publisher/pkg/persistence"
+	"github.com/volodimyr/publisher/pkg/suspension"
+	"github.com/volodimyr/publisher/pkg/tracker"
+	"github.com/volodimyr/publisher/pkg/verification"
 	"log"
 	"math/rand"
 	"net/http"
@@ -10,7 +19,9 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -32,7 +43,7 @@ func setup() {
 
 func shutdown() {
 	if storage != nil {
-		storage.Stop <- struct{}{}
+		storage.Close()
 	}
 }
 
@@ -45,7 +56,7 @@ func TestMain(m *testing.M) {
 
 func TestRegister(t *testing.T) {
 	var body = strings.NewReader(fmt.Sprintf(`{"event":"event_001","name":"%s","address":"%s"}`, lName, lAddr))
-	l := NewHandlers(nil, storage)
+	l := NewHandlers(nil, storage, Config{})
 	tests := []struct {
 		name           string
 		in             *http.Request
@@ -75,6 +86,40 @@ func TestRegister(t *testing.T) {
 			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
 		{name: "POST_NIL_NAME", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","addr":"localhost:8080"}`)),
 			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "POST_WILDCARD", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"orders.*.paid","name":"test_1","address":"http://localhost:8090/test"}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusCreated, expectedBody: registered},
+		{name: "POST_NAME_WITH_SLASH", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test/deliveries","address":"http://localhost:8090/test"}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "POST_INVALID_WILDCARD", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"orders.pa*","name":"test_1","address":"http://localhost:8090/test"}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "POST_WITH_RETRY", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","retry":{"max_attempts":3,"initial_interval":"500ms"}}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusCreated, expectedBody: registered},
+		{name: "POST_WITH_FILTER", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","filter":"body.region == \"eu\""}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusCreated, expectedBody: registered},
+		{name: "POST_INVALID_FILTER", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","filter":"body.region ="}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "POST_WITH_SECRETS", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","secrets":["new","old"]}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusCreated, expectedBody: registered},
+		{name: "POST_TOO_MANY_SECRETS", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","secrets":["a","b","c"]}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "POST_NEGATIVE_CONCURRENCY", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","max_concurrency":-1}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "POST_ORDERED", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","ordered":true,"partition_key":"body.customer"}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusCreated, expectedBody: registered},
+		{name: "POST_PARTITION_NOT_ORDERED", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","partition_key":"body.customer"}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "POST_INVALID_PARTITION", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","ordered":true,"partition_key":"customer"}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "POST_REQUEST", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","timeout":"10s","method":"PUT","success_codes":["2xx"]}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusCreated, expectedBody: registered},
+		{name: "POST_INVALID_METHOD", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","method":"GET"}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "POST_INVALID_SUCCESS_CODES", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","success_codes":["ok"]}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "POST_INVALID_RETRY", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","retry":{"jitter":2}}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "POST_INVALID_RETRY_INTERVAL", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","retry":{"max_interval":"forever"}}`)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
 	}
 	for _, test := range tests {
 		test := test
@@ -94,8 +139,8 @@ func TestRegister(t *testing.T) {
 	}
 }
 
-func setupEvents(t *testing.T) map[string]map[string]string {
-	events := make(map[string]map[string]string)
+func setupEvents(t *testing.T) models.Events {
+	events := make(models.Events)
 	const max = 15
 	random := func(len int) string {
 		bytes := make([]byte, len)
@@ -107,11 +152,11 @@ func setupEvents(t *testing.T) map[string]map[string]string {
 
 	for i := 0; i < 10; i++ {
 		eName := random(max)
-		events[eName] = map[string]string{lName: lAddr}
+		events[eName] = map[string]models.Listener{lName: {Event: eName, Name: lName, Address: lAddr}}
 	}
 
 	w := httptest.NewRecorder()
-	l := NewHandlers(logger, storage)
+	l := NewHandlers(logger, storage, Config{})
 
 	for k, _ := range events {
 		body := strings.NewReader(fmt.Sprintf(`{"event":"%s","name":"%s","address":"%s"}`, k, lName, lAddr))
@@ -128,39 +173,64 @@ func setupEvents(t *testing.T) map[string]map[string]string {
 
 func TestRegisterAndCheckStorage(t *testing.T) {
 	setupEvents := setupEvents(t)
+	events, err := storage.List()
+	if err != nil {
+		t.Fatalf("Couldn't list events [%v]", err)
+	}
 
 	for k, v := range setupEvents {
-		if _, ok := storage.Events[k]; !ok {
+		if _, ok := events[k]; !ok {
 			t.Logf("Expected key [%s], but actual hasn't got it", k)
 			t.Fail()
 		}
-		if !reflect.DeepEqual(v, storage.Events[k]) {
+		if !reflect.DeepEqual(v, events[k]) {
 			t.Logf("Expected key [%s], but actual hasn't got it", k)
 			t.Fail()
 		}
 	}
 }
 
+func TestRegisterNotSuspended(t *testing.T) {
+	s := persistence.New(logger)
+	defer s.Close()
+	l := NewHandlers(logger, s, Config{})
+	w := httptest.NewRecorder()
+
+	l.register(w, httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test","suspended":true}`)))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected [%d], but got [%d] [%s]", http.StatusCreated, w.Code, w.Body.String())
+	}
+	listeners, err := s.Lookup("event")
+	if err != nil || len(listeners) != 1 || listeners[0].Suspended {
+		t.Logf("Expected listener which isn't suspended, but got [%v] [%v]", listeners, err)
+		t.Fail()
+	}
+}
+
 func TestUnregisterAndCheckStorage(t *testing.T) {
 	setupEvents(t)
 
 	w := httptest.NewRecorder()
-	l := NewHandlers(logger, storage)
-	s := persistence.New(logger)
+	l := NewHandlers(logger, storage, Config{})
 	r := httptest.NewRequest("DELETE", fmt.Sprintf("/listener/%s", lName), nil)
 
 	l.unregister(w, r)
 
-	for _, value := range s.Events {
-		if len(value) != 0 {
-			t.Logf("Expected len to be [0], but got [%d]", len(value))
+	events, err := storage.List()
+	if err != nil {
+		t.Fatalf("Couldn't list events [%v]", err)
+	}
+	for event, value := range events {
+		if _, ok := value[lName]; ok {
+			t.Logf("Expected listener [%s] to be removed from event [%s]", lName, event)
 			t.Fail()
 		}
 	}
 }
 
 func TestNewHandlers(t *testing.T) {
-	l := NewHandlers(logger, storage)
+	l := NewHandlers(logger, storage, Config{})
 
 	if l.logger == nil {
 		t.Log("Logger cannot be nil")
@@ -187,15 +257,24 @@ func TestUnregister(t *testing.T) {
 			expectedStatus: http.StatusMethodNotAllowed, expectedBody: deleteOnly + "\n"},
 		{name: "PUT_NIL_BODY", in: httptest.NewRequest("PUT", "/listener/event_1", nil), out: httptest.NewRecorder(),
 			expectedStatus: http.StatusMethodNotAllowed, expectedBody: deleteOnly + "\n"},
+		{name: "DELETE_SCOPED", in: httptest.NewRequest("DELETE", "/listener/event_1?event=event_002", nil), out: httptest.NewRecorder(),
+			expectedStatus: http.StatusOK, expectedBody: unregistered},
+		{name: "DELETE_SCOPED_AGAIN", in: httptest.NewRequest("DELETE", "/listener/event_1?event=event_002", nil), out: httptest.NewRecorder(),
+			expectedStatus: http.StatusNotFound, expectedBody: errorNotRegistered + "\n"},
 		{name: "DELETE", in: httptest.NewRequest("DELETE", "/listener/event_1", nil), out: httptest.NewRecorder(),
 			expectedStatus: http.StatusOK, expectedBody: unregistered},
 		{name: "DELETE_WITH_ BODY", in: httptest.NewRequest("DELETE", "/listener/event_1", body), out: httptest.NewRecorder(),
-			expectedStatus: http.StatusOK, expectedBody: unregistered},
+			expectedStatus: http.StatusNotFound, expectedBody: errorNotRegistered + "\n"},
+	}
+	for _, event := range []string{"event_001", "event_002"} {
+		if err := storage.Register(models.Listener{Event: event, Name: "event_1", Address: lAddr}); err != nil {
+			t.Fatalf("Couldn't register listener [%v]", err)
+		}
 	}
 	for _, test := range tests {
 		test := test
 		t.Run(test.name, func(t *testing.T) {
-			l := NewHandlers(logger, storage)
+			l := NewHandlers(logger, storage, Config{})
 			l.unregister(test.out, test.in)
 			if test.out.Code != test.expectedStatus {
 				t.Logf("Expected [%d], but got [%d]", test.expectedStatus, test.out.Code)
@@ -210,3 +289,507 @@ func TestUnregister(t *testing.T) {
 		})
 	}
 }
+
+//failingRegistry is a Registry whose every call fails
+type failingRegistry struct {
+	persistence.Registry
+}
+
+func (failingRegistry) Register(models.Listener) error { return persistence.ErrClosed }
+
+func (failingRegistry) Unregister(string, string) error { return persistence.ErrClosed }
+
+func TestRegistryFailure(t *testing.T) {
+	l := NewHandlers(logger, failingRegistry{}, Config{})
+	tests := []struct {
+		name    string
+		in      *http.Request
+		handler http.HandlerFunc
+	}{
+		{name: "POST", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"event","name":"test_1","address":"http://localhost:8090/test"}`)),
+			handler: l.register},
+		{name: "DELETE", in: httptest.NewRequest("DELETE", "/listener/test_1", nil), handler: l.unregister},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			test.handler(w, test.in)
+			if w.Code != http.StatusInternalServerError {
+				t.Logf("Expected [%d], but got [%d]", http.StatusInternalServerError, w.Code)
+				t.Fail()
+			}
+			if body := w.Body.String(); body != errorRegistry+"\n" {
+				t.Logf("Expected [%s], but got [%s]", errorRegistry+"\n", body)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestEgressPolicy(t *testing.T) {
+	policy, err := egress.New(nil, nil, nil, []string{"*.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := persistence.New(logger)
+	defer s.Close()
+	if err := s.Register(models.Listener{Event: "orders", Name: "audit", Address: "http://93.184.216.34/audit"}); err != nil {
+		t.Fatalf("Couldn't register listener [%v]", err)
+	}
+	l := NewHandlers(logger, s, Config{Egress: policy})
+	tests := []struct {
+		name           string
+		in             *http.Request
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "POST_PUBLIC", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"users","name":"hooks","address":"https://hooks.example.com/users"}`)),
+			expectedStatus: http.StatusCreated, expectedBody: registered},
+		{name: "POST_METADATA", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"users","name":"hooks","address":"http://169.254.169.254/latest"}`)),
+			expectedStatus: http.StatusBadRequest, expectedBody: addressNotAllowed + "\n"},
+		{name: "POST_DENIED_HOST", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"users","name":"hooks","address":"http://admin.internal:9000/"}`)),
+			expectedStatus: http.StatusBadRequest, expectedBody: addressNotAllowed + "\n"},
+		{name: "POST_NOT_URL", in: httptest.NewRequest("POST", "/listener", strings.NewReader(`{"event":"users","name":"hooks","address":"localhost:8090"}`)),
+			expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "PATCH_LOOPBACK", in: httptest.NewRequest("PATCH", "/listener/audit", strings.NewReader(`{"address":"http://127.0.0.1:8080/admin"}`)),
+			expectedStatus: http.StatusBadRequest, expectedBody: addressNotAllowed + "\n"},
+	}
+	sm := http.NewServeMux()
+	l.SetupRoutes(sm)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sm.ServeHTTP(w, test.in)
+			if w.Code != test.expectedStatus {
+				t.Logf("Expected [%d], but got [%d]", test.expectedStatus, w.Code)
+				t.Fail()
+			}
+			if body := w.Body.String(); body != test.expectedBody {
+				t.Logf("Expected [%s], but got [%s]", test.expectedBody, body)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestVerification(t *testing.T) {
+	confirming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+	}))
+	defer confirming.Close()
+	silent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer silent.Close()
+	s := persistence.New(logger)
+	defer s.Close()
+	v := verification.New(logger, s, verification.Config{Expiry: time.Minute, Interval: time.Minute})
+	defer v.Stop()
+	sm := http.NewServeMux()
+	NewHandlers(logger, s, Config{Verifier: v}).SetupRoutes(sm)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		sm.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	w := do("POST", "/listener", fmt.Sprintf(`{"event":"orders","name":"silent","address":"%s"}`, silent.URL))
+	if w.Code != http.StatusAccepted || w.Body.String() != pending {
+		t.Logf("Expected [%d] [%s], but got [%d] [%s]", http.StatusAccepted, pending, w.Code, w.Body.String())
+		t.Fail()
+	}
+	expected := fmt.Sprintf(`{"name":"silent","subscriptions":[{"event":"orders","address":"%s","state":"pending"}]}`, silent.URL)
+	if w := do("GET", "/listener/silent", ""); w.Body.String() != expected {
+		t.Logf("Expected [%s], but got [%s]", expected, w.Body.String())
+		t.Fail()
+	}
+	if w := do("DELETE", "/listener/silent", ""); w.Code != http.StatusOK {
+		t.Logf("Expected pending registration to be removed, but got [%d]", w.Code)
+		t.Fail()
+	}
+	if w := do("GET", "/listener/silent", ""); w.Code != http.StatusNotFound {
+		t.Logf("Expected [%d], but got [%d]", http.StatusNotFound, w.Code)
+		t.Fail()
+	}
+
+	do("POST", "/listener", fmt.Sprintf(`{"event":"orders","name":"audit","address":"%s"}`, confirming.URL))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := s.Lookup("orders"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Confirmed listener wasn't registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	//address change is pending, messages keep going to the confirmed address meanwhile
+	expected = fmt.Sprintf(`{"name":"audit","subscriptions":[{"event":"orders","address":"%s"},{"event":"orders","address":"%s","state":"pending"}]}`,
+		confirming.URL, silent.URL)
+	if w := do("PATCH", "/listener/audit", fmt.Sprintf(`{"address":"%s"}`, silent.URL)); w.Code != http.StatusAccepted || w.Body.String() != expected {
+		t.Logf("Expected [%d] [%s], but got [%d] [%s]", http.StatusAccepted, expected, w.Code, w.Body.String())
+		t.Fail()
+	}
+	if listeners, err := s.Lookup("orders"); err != nil || len(listeners) != 1 || listeners[0].Address != confirming.URL {
+		t.Logf("Expected listener to stay at the confirmed address, but got [%v] [%v]", listeners, err)
+		t.Fail()
+	}
+
+	if w := do("PATCH", "/listener/audit", `{"events":["orders","users"]}`); w.Code != http.StatusAccepted {
+		t.Logf("Expected new subscription to be pending, but got [%d] [%s]", w.Code, w.Body.String())
+		t.Fail()
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		if _, err := s.Lookup("users"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Confirmed subscription wasn't added")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//TestConcurrentRegisterUnregister is meant to be run with -race
+func TestConcurrentRegisterUnregister(t *testing.T) {
+	l := NewHandlers(logger, storage, Config{})
+	const workers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(3)
+		name := fmt.Sprintf("concurrent_%d", i)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			l.register(w, httptest.NewRequest("POST", "/listener", strings.NewReader(fmt.Sprintf(`{"event":"concurrent","name":"%s","address":"%s"}`, name, lAddr))))
+			if w.Code != http.StatusCreated {
+				t.Errorf("Expected [%d], but got [%d]", http.StatusCreated, w.Code)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			l.unregister(w, httptest.NewRequest("DELETE", "/listener/"+name+"_other", nil))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected [%d], but got [%d]", http.StatusNotFound, w.Code)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := storage.List(); err != nil {
+				t.Errorf("Couldn't list events [%v]", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	listeners, err := storage.Lookup("concurrent")
+	if err != nil || len(listeners) != workers {
+		t.Logf("Expected [%d] listeners, but got [%d] [%v]", workers, len(listeners), err)
+		t.Fail()
+	}
+}
+
+func TestInspect(t *testing.T) {
+	s := persistence.New(logger)
+	defer s.Close()
+	for _, event := range []string{"users", "orders"} {
+		l := models.Listener{Event: event, Name: "audit", Address: "http://localhost:8090/" + event}
+		if event == "orders" {
+			l.Secrets = []string{"secret"}
+		}
+		if err := s.Register(l); err != nil {
+			t.Fatalf("Couldn't register listener [%v]", err)
+		}
+	}
+	l := NewHandlers(logger, s, Config{})
+	cb := breaker.New(breaker.Config{Threshold: 1, Cooldown: time.Hour})
+	cb.Done("http://localhost:8090/orders", false)
+	withBreakers := NewHandlers(logger, s, Config{Breakers: cb})
+	tests := []struct {
+		name           string
+		h              *Handlers
+		in             *http.Request
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "GET", in: httptest.NewRequest("GET", "/listener/audit", nil), expectedStatus: http.StatusOK,
+			expectedBody: `{"name":"audit","subscriptions":[{"event":"orders","address":"http://localhost:8090/orders","signed":true},{"event":"users","address":"http://localhost:8090/users"}]}`},
+		{name: "GET_BREAKER", h: withBreakers, in: httptest.NewRequest("GET", "/listener/audit", nil), expectedStatus: http.StatusOK,
+			expectedBody: `{"name":"audit","subscriptions":[{"event":"orders","address":"http://localhost:8090/orders","signed":true,"breaker":"open"},` +
+				`{"event":"users","address":"http://localhost:8090/users","breaker":"closed"}]}`},
+		{name: "GET_UNKNOWN", in: httptest.NewRequest("GET", "/listener/unknown", nil), expectedStatus: http.StatusNotFound,
+			expectedBody: errorNotRegistered + "\n"},
+		{name: "GET_EMPTY", in: httptest.NewRequest("GET", "/listener/", nil), expectedStatus: http.StatusBadRequest,
+			expectedBody: "Listener name must be specified\n"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			h := l
+			if test.h != nil {
+				h = test.h
+			}
+			w := httptest.NewRecorder()
+			h.listener(w, test.in)
+			if w.Code != test.expectedStatus {
+				t.Logf("Expected [%d], but got [%d]", test.expectedStatus, w.Code)
+				t.Fail()
+			}
+			if body := w.Body.String(); body != test.expectedBody {
+				t.Logf("Expected [%s], but got [%s]", test.expectedBody, body)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	s := persistence.New(logger)
+	defer s.Close()
+	for _, event := range []string{"users", "orders"} {
+		if err := s.Register(models.Listener{Event: event, Name: "audit", Address: "http://localhost:8090/audit"}); err != nil {
+			t.Fatalf("Couldn't register listener [%v]", err)
+		}
+	}
+	l := NewHandlers(logger, s, Config{})
+	tests := []struct {
+		name           string
+		in             *http.Request
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "PATCH_ADDRESS", in: httptest.NewRequest("PATCH", "/listener/audit", strings.NewReader(`{"address":"http://localhost:8091/audit"}`)),
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"audit","subscriptions":[{"event":"orders","address":"http://localhost:8091/audit"},{"event":"users","address":"http://localhost:8091/audit"}]}`},
+		{name: "PATCH_EVENTS", in: httptest.NewRequest("PATCH", "/listener/audit", strings.NewReader(`{"events":["users","payments"],"retry":{"max_attempts":2}}`)),
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"audit","subscriptions":[{"event":"payments","address":"http://localhost:8091/audit","retry":{"max_attempts":2}},{"event":"users","address":"http://localhost:8091/audit","retry":{"max_attempts":2}}]}`},
+		{name: "PUT", in: httptest.NewRequest("PUT", "/listener/audit", strings.NewReader(`{"address":"http://localhost:8092/audit","events":["orders"]}`)),
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"audit","subscriptions":[{"event":"orders","address":"http://localhost:8092/audit"}]}`},
+		{name: "PUT_WITHOUT_EVENTS", in: httptest.NewRequest("PUT", "/listener/audit", strings.NewReader(`{"address":"http://localhost:8092/audit"}`)),
+			expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "PATCH_EMPTY_EVENTS", in: httptest.NewRequest("PATCH", "/listener/audit", strings.NewReader(`{"events":[]}`)),
+			expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "PATCH_INVALID_FILTER", in: httptest.NewRequest("PATCH", "/listener/audit", strings.NewReader(`{"filter":"has(body"}`)),
+			expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "PATCH_INVALID_BODY", in: httptest.NewRequest("PATCH", "/listener/audit", strings.NewReader(`{absolutely epic}`)),
+			expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "PATCH_PARTITION_NOT_ORDERED", in: httptest.NewRequest("PATCH", "/listener/audit", strings.NewReader(`{"partition_key":"body.customer"}`)),
+			expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "PUT_PARTITION_NOT_ORDERED", in: httptest.NewRequest("PUT", "/listener/audit", strings.NewReader(`{"address":"http://localhost:8092/audit","events":["orders"],"partition_key":"body.customer"}`)),
+			expectedStatus: http.StatusBadRequest, expectedBody: invalidBody + "\n"},
+		{name: "PATCH_ORDERED", in: httptest.NewRequest("PATCH", "/listener/audit", strings.NewReader(`{"ordered":true}`)),
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"audit","subscriptions":[{"event":"orders","address":"http://localhost:8092/audit","ordered":true}]}`},
+		{name: "PATCH_PARTITION_ORDERED", in: httptest.NewRequest("PATCH", "/listener/audit", strings.NewReader(`{"partition_key":"body.customer"}`)),
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"name":"audit","subscriptions":[{"event":"orders","address":"http://localhost:8092/audit","ordered":true,"partition_key":"body.customer"}]}`},
+		{name: "PATCH_UNKNOWN", in: httptest.NewRequest("PATCH", "/listener/unknown", strings.NewReader(`{"address":"http://localhost:8091/audit"}`)),
+			expectedStatus: http.StatusNotFound, expectedBody: errorNotRegistered + "\n"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		l.listener(w, test.in)
+		if w.Code != test.expectedStatus {
+			t.Logf("[%s] Expected [%d], but got [%d]", test.name, test.expectedStatus, w.Code)
+			t.Fail()
+		}
+		if body := w.Body.String(); body != test.expectedBody {
+			t.Logf("[%s] Expected [%s], but got [%s]", test.name, test.expectedBody, body)
+			t.Fail()
+		}
+	}
+}
+
+//TestActionNames checks that listeners named after the actions of /listener/{name}/{action} are reachable
+func TestActionNames(t *testing.T) {
+	s := persistence.New(logger)
+	defer s.Close()
+	sm := http.NewServeMux()
+	NewHandlers(logger, s, Config{Tracker: tracker.New(logger, 0, 0)}).SetupRoutes(sm)
+	for _, name := range []string{"deliveries", "replay", "resume"} {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"event":"users","name":"%s","address":"http://localhost:8090/%s"}`, name, name)
+		sm.ServeHTTP(w, httptest.NewRequest("POST", "/listener", strings.NewReader(body)))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("[%s] Expected [%d], but got [%d]", name, http.StatusCreated, w.Code)
+		}
+		w = httptest.NewRecorder()
+		sm.ServeHTTP(w, httptest.NewRequest("GET", "/listener/"+name, nil))
+		expected := fmt.Sprintf(`{"name":"%s","subscriptions":[{"event":"users","address":"http://localhost:8090/%s"}]}`, name, name)
+		if w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Logf("[%s] Expected [%d] [%s], but got [%d] [%s]", name, http.StatusOK, expected, w.Code, w.Body.String())
+			t.Fail()
+		}
+		w = httptest.NewRecorder()
+		sm.ServeHTTP(w, httptest.NewRequest("DELETE", "/listener/"+name, nil))
+		if w.Code != http.StatusOK {
+			t.Logf("[%s] Expected [%d], but got [%d]", name, http.StatusOK, w.Code)
+			t.Fail()
+		}
+	}
+}
+
+func TestDeliveries(t *testing.T) {
+	tr := tracker.New(logger, 0, 0)
+	tr.Track("1", "orders", []models.Listener{{Event: "orders", Name: "billing", Address: lAddr}})
+	tr.Track("2", "users", []models.Listener{{Event: "users", Name: "billing", Address: lAddr}})
+	tr.Attempted(dispatcher.Delivery{Listener: models.Listener{Name: "billing"}, MessageID: "1", Attempts: []dispatcher.Attempt{{Status: http.StatusOK}}}, true)
+	sm := http.NewServeMux()
+	NewHandlers(logger, storage, Config{Tracker: tr}).SetupRoutes(sm)
+	tests := []struct {
+		name           string
+		in             *http.Request
+		expectedStatus int
+		expectedIDs    []string
+	}{
+		{name: "GET", in: httptest.NewRequest("GET", "/listener/billing/deliveries", nil), expectedStatus: http.StatusOK, expectedIDs: []string{"2", "1"}},
+		{name: "GET_EVENT", in: httptest.NewRequest("GET", "/listener/billing/deliveries?event=orders", nil), expectedStatus: http.StatusOK, expectedIDs: []string{"1"}},
+		{name: "GET_LIMIT", in: httptest.NewRequest("GET", "/listener/billing/deliveries?limit=1", nil), expectedStatus: http.StatusOK, expectedIDs: []string{"2"}},
+		{name: "GET_UNKNOWN", in: httptest.NewRequest("GET", "/listener/unknown/deliveries", nil), expectedStatus: http.StatusOK, expectedIDs: []string{}},
+		{name: "GET_INVALID_LIMIT", in: httptest.NewRequest("GET", "/listener/billing/deliveries?limit=-1", nil), expectedStatus: http.StatusBadRequest},
+		{name: "DELETE", in: httptest.NewRequest("DELETE", "/listener/billing/deliveries", nil), expectedStatus: http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sm.ServeHTTP(w, test.in)
+			if w.Code != test.expectedStatus {
+				t.Logf("Expected [%d], but got [%d]", test.expectedStatus, w.Code)
+				t.Fail()
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var deliveries []tracker.Delivery
+			if err := json.Unmarshal(w.Body.Bytes(), &deliveries); err != nil {
+				t.Fatalf("Couldn't decode deliveries [%v]", err)
+			}
+			ids := []string{}
+			for _, d := range deliveries {
+				ids = append(ids, d.MessageID)
+			}
+			if !reflect.DeepEqual(ids, test.expectedIDs) {
+				t.Logf("Expected [%v], but got [%v]", test.expectedIDs, ids)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fake.Close()
+	s := persistence.New(logger)
+	defer s.Close()
+	if err := s.Register(models.Listener{Event: "orders", Name: "billing", Address: fake.URL}); err != nil {
+		t.Fatalf("Couldn't register listener [%v]", err)
+	}
+	if err := s.Register(models.Listener{Event: "orders", Name: "suspended", Address: fake.URL, Suspended: true}); err != nil {
+		t.Fatalf("Couldn't register listener [%v]", err)
+	}
+	d := dispatcher.New(logger, dispatcher.Config{Workers: 1})
+	defer d.Stop()
+	a := archive.New(time.Hour, 0)
+	a.Put(archive.Message{ID: "first", Event: "orders", Body: []byte("{}")})
+	a.Put(archive.Message{ID: "second", Event: "orders", Body: []byte("{}")})
+	sm := http.NewServeMux()
+	NewHandlers(logger, s, Config{Replay: archive.NewReplayer(a, s, d, nil)}).SetupRoutes(sm)
+	tests := []struct {
+		name           string
+		in             *http.Request
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "POST", in: httptest.NewRequest("POST", "/listener/billing/replay", nil),
+			expectedStatus: http.StatusAccepted, expectedBody: `{"listener":"billing","replayed":2,"filtered":0}`},
+		{name: "POST_FROM_ID", in: httptest.NewRequest("POST", "/listener/billing/replay?from=first", nil),
+			expectedStatus: http.StatusAccepted, expectedBody: `{"listener":"billing","replayed":1,"filtered":0}`},
+		{name: "POST_UNKNOWN_MESSAGE", in: httptest.NewRequest("POST", "/listener/billing/replay?from=unknown", nil),
+			expectedStatus: http.StatusNotFound, expectedBody: errorNotRetained + "\n"},
+		{name: "POST_UNKNOWN_LISTENER", in: httptest.NewRequest("POST", "/listener/unknown/replay", nil),
+			expectedStatus: http.StatusNotFound, expectedBody: errorNotRegistered + "\n"},
+		{name: "POST_SUSPENDED", in: httptest.NewRequest("POST", "/listener/suspended/replay", nil),
+			expectedStatus: http.StatusConflict, expectedBody: errorSuspended + "\n"},
+		{name: "GET", in: httptest.NewRequest("GET", "/listener/billing/replay", nil),
+			expectedStatus: http.StatusMethodNotAllowed, expectedBody: postOnly + "\n"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sm.ServeHTTP(w, test.in)
+			if w.Code != test.expectedStatus || w.Body.String() != test.expectedBody {
+				t.Logf("Expected [%d] [%s], but got [%d] [%s]", test.expectedStatus, test.expectedBody, w.Code, w.Body.String())
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestResume(t *testing.T) {
+	s := persistence.New(logger)
+	defer s.Close()
+	for _, event := range []string{"users", "orders"} {
+		if err := s.Register(models.Listener{Event: event, Name: "audit", Address: "http://localhost:8090/audit", Suspended: true}); err != nil {
+			t.Fatalf("Couldn't register listener [%v]", err)
+		}
+	}
+	sm := http.NewServeMux()
+	NewHandlers(logger, s, Config{}).SetupRoutes(sm)
+	tests := []struct {
+		name           string
+		in             *http.Request
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "GET_SUSPENDED", in: httptest.NewRequest("GET", "/listener/audit", nil), expectedStatus: http.StatusOK,
+			expectedBody: `{"name":"audit","subscriptions":[{"event":"orders","address":"http://localhost:8090/audit","state":"suspended"},` +
+				`{"event":"users","address":"http://localhost:8090/audit","state":"suspended"}]}`},
+		{name: "GET", in: httptest.NewRequest("GET", "/listener/audit/resume", nil), expectedStatus: http.StatusMethodNotAllowed, expectedBody: postOnly + "\n"},
+		{name: "POST_UNKNOWN", in: httptest.NewRequest("POST", "/listener/unknown/resume", nil), expectedStatus: http.StatusNotFound, expectedBody: errorNotRegistered + "\n"},
+		{name: "POST", in: httptest.NewRequest("POST", "/listener/audit/resume", nil), expectedStatus: http.StatusOK,
+			expectedBody: `{"name":"audit","subscriptions":[{"event":"orders","address":"http://localhost:8090/audit"},{"event":"users","address":"http://localhost:8090/audit"}]}`},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		sm.ServeHTTP(w, test.in)
+		if w.Code != test.expectedStatus || w.Body.String() != test.expectedBody {
+			t.Logf("%s: expected [%d] [%s], but got [%d] [%s]", test.name, test.expectedStatus, test.expectedBody, w.Code, w.Body.String())
+			t.Fail()
+		}
+	}
+}
+
+func TestResumeResetsMonitor(t *testing.T) {
+	s := persistence.New(logger)
+	defer s.Close()
+	if err := s.Register(models.Listener{Event: "users", Name: "audit", Address: "http://localhost:8090/audit", Suspended: true}); err != nil {
+		t.Fatalf("Couldn't register listener [%v]", err)
+	}
+	m := suspension.New(logger, s, suspension.Config{MaxFailures: 2})
+	sm := http.NewServeMux()
+	NewHandlers(logger, s, Config{Monitor: m}).SetupRoutes(sm)
+	failed := dispatcher.Delivery{Listener: models.Listener{Name: "audit"}, Attempts: []dispatcher.Attempt{{Error: "unexpected status code [503]"}}}
+
+	m.Attempted(failed, false)
+	w := httptest.NewRecorder()
+	sm.ServeHTTP(w, httptest.NewRequest("POST", "/listener/audit/resume", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected [%d], but got [%d]", http.StatusOK, w.Code)
+	}
+	//failure before resume isn't counted anymore
+	m.Attempted(failed, false)
+	time.Sleep(time.Millisecond * 100)
+	listeners, err := s.Lookup("users")
+	if err != nil {
+		t.Fatalf("Couldn't lookup listener [%v]", err)
+	}
+	if listeners[0].Suspended {
+		t.Log("Expected resumed listener not to be suspended by a single failure")
+		t.Fail()
+	}
+}
@@ -0,0 +1,68 @@
+package message
+
+import (
+	"github.com/volodimyr/publisher/pkg/response"
+	"github.com/volodimyr/publisher/pkg/tracker"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	getOnly       = "GET method only"
+	errorNotFound = "Message not found"
+)
+
+//Handlers handles /messages endpoints
+//It also holds essential dependencies to be using
+type Handlers struct {
+	logger *log.Logger
+	t      *tracker.Tracker
+}
+
+//SetupRoutes setups all initial endpoints for message handlers
+func (h *Handlers) SetupRoutes(sm *http.ServeMux) {
+	sm.HandleFunc("/messages/", h.Logger(h.message))
+}
+
+//message responds with the delivery report of /messages/{id}
+func (h *Handlers) message(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.logger.Printf("server: method [%s] not available for message endpoint\n", r.Method)
+		http.Error(w, getOnly, http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/messages/")
+	if id == "" || strings.Contains(id, "/") {
+		h.logger.Printf("server: unknown message path [%s]\n", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	m, ok := h.t.Get(id)
+	if !ok {
+		http.Error(w, errorNotFound, http.StatusNotFound)
+		return
+	}
+	resp.JSON(w, http.StatusOK, m)
+}
+
+//Logger is a middleware for the message handlers
+func (h *Handlers) Logger(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer h.logger.Printf("request processed in [%s]\n", time.Now().Sub(start))
+		next(w, r)
+	}
+}
+
+//NewHandlers create Message Handlers and establishes all dependencies
+//Important SetupRoutes needs to be called before it can be used
+//if logger == nil, default will be taken
+func NewHandlers(logger *log.Logger, t *tracker.Tracker) *Handlers {
+	if logger == nil {
+		logger = log.New(os.Stdout, "server: ", log.LstdFlags|log.Lshortfile)
+	}
+	return &Handlers{logger: logger, t: t}
+}
@@ -0,0 +1,52 @@
+package message
+
+import (
+	"encoding/json"
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/models"
+	"github.com/volodimyr/publisher/pkg/tracker"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+var logger = log.New(os.Stdout, "test: ", log.LstdFlags|log.Lshortfile)
+
+func TestMessage(t *testing.T) {
+	tr := tracker.New(logger, 0, 0)
+	tr.Track("id", "event", []models.Listener{{Event: "event", Name: "listener", Address: "http://listener"}})
+	tr.Attempted(dispatcher.Delivery{Listener: models.Listener{Name: "listener"}, MessageID: "id", Attempts: []dispatcher.Attempt{{Status: http.StatusOK}}}, true)
+	sm := http.NewServeMux()
+	NewHandlers(logger, tr).SetupRoutes(sm)
+	tests := []struct {
+		name           string
+		in             *http.Request
+		expectedStatus int
+	}{
+		{name: "GET", in: httptest.NewRequest("GET", "/messages/id", nil), expectedStatus: http.StatusOK},
+		{name: "GET_UNKNOWN", in: httptest.NewRequest("GET", "/messages/unknown", nil), expectedStatus: http.StatusNotFound},
+		{name: "GET_EMPTY", in: httptest.NewRequest("GET", "/messages/", nil), expectedStatus: http.StatusNotFound},
+		{name: "DELETE", in: httptest.NewRequest("DELETE", "/messages/id", nil), expectedStatus: http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sm.ServeHTTP(w, test.in)
+			if w.Code != test.expectedStatus {
+				t.Logf("Expected [%d], but got [%d]", test.expectedStatus, w.Code)
+				t.Fail()
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			m := tracker.Message{}
+			if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil || m.ID != "id" || len(m.Listeners) != 1 || m.Listeners[0].State != tracker.StateDelivered {
+				t.Logf("Unexpected report [%s] [%v]", w.Body.String(), err)
+				t.Fail()
+			}
+		})
+	}
+}
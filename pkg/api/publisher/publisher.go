@@ -1,9 +1,15 @@
 package publisher
 
 import (
+	"github.com/volodimyr/publisher/pkg/archive"
+	"github.com/volodimyr/publisher/pkg/auth"
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/idempotency"
 	"github.com/volodimyr/publisher/pkg/models"
 	"github.com/volodimyr/publisher/pkg/persistence"
 	"github.com/volodimyr/publisher/pkg/response"
+	"github.com/volodimyr/publisher/pkg/topic"
+	"github.com/volodimyr/publisher/pkg/tracker"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -12,18 +18,32 @@ import (
 	"time"
 )
 
+const (
+	//DefaultWait is how long ?wait=true waits for the listeners
+	DefaultWait = 10 * time.Second
+	//MaxWait is the upper limit of ?wait={duration}, it must stay below server.WriteTimeout
+	MaxWait = time.Minute
+)
+
 var (
-	published = "Published"
-	postOnly  = "POST method only"
+	postOnly    = "POST method only"
+	invalidWait = "Wait must be either true, false or a positive duration, e.g. 5s"
 
 	errorNotRegistered = "Event wasn't registered"
+	errorNotQueued     = "Couldn't queue message, try again later"
+	errorRegistry      = "Couldn't read registry"
+	errorInProgress    = "Message with the same Idempotency-Key is being published"
 )
 
 //Handlers handles /publish endpoints
 //It also holds essential dependencies to be using
 type Handlers struct {
 	logger *log.Logger
-	s      *persistence.Storage
+	r      persistence.Registry
+	d      *dispatcher.Dispatcher
+	idem   *idempotency.Store
+	t      *tracker.Tracker
+	a      *archive.Archive
 }
 
 //SetupRoutes setups all initial endpoints for listener handlers
@@ -40,28 +60,162 @@ func (h *Handlers) publish(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Event name must be specified", http.StatusBadRequest)
 			return
 		}
-		//s := persistence.New(h.logger)
-		if _, ok := h.s.Events[eventNames[1]]; !ok {
+		if topic.IsPattern(eventNames[1]) {
+			h.logger.Printf("server: Couldn't publish to wildcard event [%s]\n", eventNames[1])
+			http.Error(w, "Event name must not contain wildcards", http.StatusBadRequest)
+			return
+		}
+		wait, ok := waitFor(r.URL.Query().Get("wait"))
+		if !ok {
+			h.logger.Printf("server: Invalid wait [%s]\n", r.URL.Query().Get("wait"))
+			http.Error(w, invalidWait, http.StatusBadRequest)
+			return
+		}
+		listeners, err := h.r.Lookup(eventNames[1])
+		if err == persistence.ErrNotFound {
 			h.logger.Println("server: Couldn't publish to non-existing event")
 			http.Error(w, errorNotRegistered, http.StatusNotFound)
 			return
 		}
+		if err != nil {
+			h.logger.Printf("server: Couldn't lookup event [%s] [%v]\n", eventNames[1], err)
+			http.Error(w, errorRegistry, http.StatusInternalServerError)
+			return
+		}
 		bs, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			h.logger.Println("server: Invalid body")
 			http.Error(w, "Cannot read body", http.StatusBadRequest)
 			return
 		}
-		done := make(chan struct{})
-		h.s.Broadcast <- persistence.Publish{Done: done, PublishMessage: models.PublishMessage{Event: eventNames[1], Body: bs}}
-		<-done
-		resp.OK(w, published)
+		msg := models.PublishMessage{ID: models.NewMessageID(), Event: eventNames[1], Body: bs}
+		key := r.Header.Get(idempotency.Header)
+		if key != "" && h.idem != nil {
+			key = idempotencyKey(r, msg.Event, key)
+			id, err := h.idem.Begin(key, msg.ID)
+			msg.ID = id
+			if err == idempotency.ErrDuplicate {
+				h.logger.Printf("server: Message [%s] has already been published, duplicate ignored\n", id)
+				h.locate(w, id)
+				resp.JSON(w, http.StatusOK, models.PublishResult{ID: id, Event: msg.Event, Duplicate: true})
+				return
+			}
+			if err == idempotency.ErrInProgress {
+				http.Error(w, errorInProgress, http.StatusConflict)
+				return
+			}
+		}
+		if h.t != nil {
+			h.t.Track(msg.ID, msg.Event, listeners)
+		}
+		header := forwarded(r.Header)
+		var queueErr error
+		//listeners queued by the failed attempt with the same key aren't queued again
+		var queued []string
+		for _, l := range listeners {
+			if key != "" && h.idem != nil && h.idem.Queued(key, l.Name) {
+				h.logger.Printf("server: Message [%s] has already been queued for the listener [%s]\n", msg.ID, l.Name)
+				continue
+			}
+			if l.Suspended {
+				h.skip(msg.ID, l.Name, tracker.StateSuspended, "")
+				continue
+			}
+			err := h.d.Enqueue(dispatcher.NewDelivery(msg.ID, msg.Event, l, msg.Body, header))
+			if err == dispatcher.ErrFiltered {
+				h.logger.Printf("server: Message for the event [%s] filtered out for the listener [%s]\n", msg.Event, l.Name)
+				h.skip(msg.ID, l.Name, tracker.StateFiltered, "")
+				continue
+			}
+			if err != nil {
+				h.logger.Printf("server: Couldn't queue event for the listener [%s] [%v]\n", l.Name, err)
+				h.skip(msg.ID, l.Name, tracker.StateFailed, err.Error())
+				queueErr = err
+				continue
+			}
+			queued = append(queued, l.Name)
+		}
+		if queueErr != nil {
+			if key != "" && h.idem != nil {
+				h.idem.Fail(key, queued)
+			}
+			http.Error(w, errorNotQueued, http.StatusServiceUnavailable)
+			return
+		}
+		if key != "" && h.idem != nil {
+			h.idem.Done(key)
+		}
+		if h.a != nil {
+			h.a.Put(archive.Message{ID: msg.ID, Event: msg.Event, Body: msg.Body, Header: header})
+		}
+		h.logger.Printf("server: Queued message [%s] for the event [%s]\n", msg.ID, msg.Event)
+		h.locate(w, msg.ID)
+		if wait > 0 && h.t != nil {
+			report, _ := h.t.Wait(msg.ID, wait)
+			resp.JSON(w, http.StatusOK, report)
+			return
+		}
+		resp.JSON(w, http.StatusAccepted, models.PublishResult{ID: msg.ID, Event: msg.Event})
 		return
 	}
 	h.logger.Printf("server: method [%s] not available for publish endpoint\n", r.Method)
 	http.Error(w, postOnly, http.StatusMethodNotAllowed)
 }
 
+//waitFor parses ?wait, "true" means DefaultWait and duration is limited by MaxWait
+//0 means the response isn't waiting for the listeners
+func waitFor(value string) (time.Duration, bool) {
+	switch value {
+	case "", "false":
+		return 0, true
+	case "true":
+		return DefaultWait, true
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	if d > MaxWait {
+		d = MaxWait
+	}
+	return d, true
+}
+
+//locate points to the delivery report of the message when messages are tracked
+func (h *Handlers) locate(w http.ResponseWriter, id string) {
+	if h.t != nil {
+		w.Header().Set("Location", "/messages/"+id)
+	}
+}
+
+func (h *Handlers) skip(id, listener, state, reason string) {
+	if h.t != nil {
+		h.t.Skip(id, listener, state, reason)
+	}
+}
+
+//idempotencyKey scopes the key to the caller and the event, so different publishers can't collide
+func idempotencyKey(r *http.Request, event, key string) string {
+	subject := ""
+	if p := auth.FromContext(r.Context()); p != nil {
+		subject = p.Subject
+	}
+	return subject + "\x00" + event + "\x00" + key
+}
+
+//forwarded copies publish request header without credentials of the publisher
+//It's kept along with deliveries for filters, passthrough and redrive
+func forwarded(header http.Header) http.Header {
+	h := make(http.Header, len(header))
+	for k, v := range header {
+		h[k] = v
+	}
+	h.Del("Authorization")
+	h.Del("Cookie")
+	h.Del(auth.KeyHeader)
+	return h
+}
+
 //Logger is a middleware for the publish handlers
 func (h *Handlers) Logger(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -71,12 +225,22 @@ func (h *Handlers) Logger(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+//Config holds optional dependencies of the publish Handlers, nil one disables the feature
+//if Idempotency == nil, Idempotency-Key is ignored
+//if Tracker == nil, deliveries aren't tracked and ?wait is ignored
+//if Archive == nil, messages aren't retained for replay
+type Config struct {
+	Idempotency *idempotency.Store
+	Tracker     *tracker.Tracker
+	Archive     *archive.Archive
+}
+
 //NewHandlers create Publish Handlers and establishes all dependencies
 //Important SetupRoutes needs to be called before it can be used
 //if logger == nil, default will be taken
-func NewHandlers(logger *log.Logger, storage *persistence.Storage) *Handlers {
+func NewHandlers(logger *log.Logger, registry persistence.Registry, d *dispatcher.Dispatcher, cfg Config) *Handlers {
 	if logger == nil {
 		logger = log.New(os.Stdout, "server: ", log.LstdFlags|log.Lshortfile)
 	}
-	return &Handlers{logger: logger, s: storage}
+	return &Handlers{logger: logger, r: registry, d: d, idem: cfg.Idempotency, t: cfg.Tracker, a: cfg.Archive}
 }
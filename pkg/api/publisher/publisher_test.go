@@ -1,16 +1,24 @@
 package publisher
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/volodimyr/publisher/pkg/archive"
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/idempotency"
 	"github.com/volodimyr/publisher/pkg/models"
 	"github.com/volodimyr/publisher/pkg/persistence"
+	"github.com/volodimyr/publisher/pkg/server"
+	"github.com/volodimyr/publisher/pkg/tracker"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -19,20 +27,23 @@ const (
 )
 
 var (
-	storage *persistence.Storage
-	logger  *log.Logger
+	storage  *persistence.Storage
+	dispatch *dispatcher.Dispatcher
+	logger   *log.Logger
 )
 
 func setup() {
 	logger = log.New(os.Stdout, "test: ", log.LstdFlags|log.Lshortfile)
 	if storage == nil {
+		dispatch = dispatcher.New(logger, dispatcher.Config{})
 		storage = persistence.New(logger)
 	}
 }
 
 func shutdown() {
 	if storage != nil {
-		storage.Stop <- struct{}{}
+		storage.Close()
+		dispatch.Stop()
 	}
 }
 
@@ -54,6 +65,9 @@ func TestPublish(t *testing.T) {
 		{name: "POST", in: httptest.NewRequest("POST", "/publish/event",
 			strings.NewReader(publishedMsg)),
 			out: httptest.NewRecorder(), expectedStatus: http.StatusNotFound, expectedBody: errorNotRegistered + "\n"},
+		{name: "POST_WILDCARD", in: httptest.NewRequest("POST", "/publish/orders.*",
+			strings.NewReader(publishedMsg)),
+			out: httptest.NewRecorder(), expectedStatus: http.StatusBadRequest, expectedBody: "Event name must not contain wildcards\n"},
 		{name: "GET", in: httptest.NewRequest("GET", "/publish/event", nil),
 			out: httptest.NewRecorder(), expectedStatus: http.StatusMethodNotAllowed, expectedBody: postOnly + "\n"},
 		{name: "PUT", in: httptest.NewRequest("PUT", "/publish/event", strings.NewReader(`{"data":"random"}`)),
@@ -68,7 +82,7 @@ func TestPublish(t *testing.T) {
 	for _, test := range tests {
 		test := test
 		t.Run(test.name, func(t *testing.T) {
-			l := NewHandlers(logger, storage)
+			l := NewHandlers(logger, storage, dispatch, Config{})
 			l.publish(test.out, test.in)
 			if test.out.Code != test.expectedStatus {
 				t.Logf("Expected [%d], but got [%d]", test.expectedStatus, test.out.Code)
@@ -84,48 +98,402 @@ func TestPublish(t *testing.T) {
 	}
 }
 
-func fakeServer(t *testing.T) *httptest.Server {
+func fakeServer(t *testing.T, received chan<- string) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 		bs, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			t.Fatalf("Test work incorrect [%v] \n", err)
-		}
-		actual := string(bs)
-		if actual != publishedMsg {
-			t.Logf("Expected published event [%s], but got [%s]\n", event, actual)
-			t.Fail()
+			t.Errorf("Test work incorrect [%v] \n", err)
 		}
+		received <- string(bs)
 	}))
 }
 
-func setupFakeServer(t *testing.T) {
-	fake := fakeServer(t)
-	done := make(chan struct{})
-	storage.New <- persistence.Add{Done: done, Listener: models.Listener{Event: event, Name: fake.URL, Address: fake.URL}}
-	<-done
+func setupFakeServer(t *testing.T, received chan<- string) *httptest.Server {
+	fake := fakeServer(t, received)
+	if err := storage.Register(models.Listener{Event: event, Name: fake.URL, Address: fake.URL}); err != nil {
+		t.Fatalf("Couldn't register fake listener [%v]", err)
+	}
+	return fake
 }
 
 func TestPublishWithFakeServer(t *testing.T) {
-	setupFakeServer(t)
+	received := make(chan string, 1)
+	fake := setupFakeServer(t, received)
+	defer fake.Close()
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("POST", fmt.Sprintf("/publish/%s", event), strings.NewReader(publishedMsg))
-	p := NewHandlers(logger, storage)
+	p := NewHandlers(logger, storage, dispatch, Config{})
 
 	p.publish(w, r)
 
-	//redundant
-	if w.Code != http.StatusOK {
-		t.Logf("Expected status [%d], but got [%d]", http.StatusOK, w.Code)
+	if w.Code != http.StatusAccepted {
+		t.Logf("Expected status [%d], but got [%d]", http.StatusAccepted, w.Code)
+		t.Fail()
+	}
+	//delivery is asynchronous, so wait until dispatcher reaches the listener
+	select {
+	case actual := <-received:
+		if actual != publishedMsg {
+			t.Logf("Expected published event [%s], but got [%s]\n", publishedMsg, actual)
+			t.Fail()
+		}
+	case <-time.After(time.Second * 5):
+		t.Log("Listener hasn't received published event")
 		t.Fail()
 	}
 }
 
 func TestNewHandlers(t *testing.T) {
-	p := NewHandlers(nil, storage)
+	p := NewHandlers(nil, storage, dispatch, Config{})
 
 	if p.logger == nil {
 		t.Log("Logger cannot be nil")
 		t.Fail()
 	}
 }
+
+//staticRegistry is a Registry which knows a single event with fixed listeners
+type staticRegistry struct {
+	persistence.Registry
+	listeners []models.Listener
+}
+
+func (s staticRegistry) Lookup(e string) ([]models.Listener, error) {
+	if e != event {
+		return nil, persistence.ErrNotFound
+	}
+	return s.listeners, nil
+}
+
+func TestPublishWithMockRegistry(t *testing.T) {
+	received := make(chan string, 2)
+	fake := fakeServer(t, received)
+	defer fake.Close()
+	r := staticRegistry{listeners: []models.Listener{
+		{Event: event, Name: "first", Address: fake.URL},
+		{Event: event, Name: "second", Address: fake.URL},
+	}}
+	p := NewHandlers(logger, r, dispatch, Config{})
+	w := httptest.NewRecorder()
+
+	p.publish(w, httptest.NewRequest("POST", fmt.Sprintf("/publish/%s", event), strings.NewReader(publishedMsg)))
+
+	if w.Code != http.StatusAccepted {
+		t.Logf("Expected status [%d], but got [%d]", http.StatusAccepted, w.Code)
+		t.Fail()
+	}
+	for i := 0; i < len(r.listeners); i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Expected [%d] deliveries, but got [%d]", len(r.listeners), i)
+		}
+	}
+}
+
+//TestConcurrentPublish is meant to be run with -race
+//It publishes while listeners of the same event are registered and unregistered
+func TestConcurrentPublish(t *testing.T) {
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fake.Close()
+	p := NewHandlers(logger, storage, dispatch, Config{})
+	const workers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(3)
+		name := fmt.Sprintf("concurrent_%d", i)
+		go func() {
+			defer wg.Done()
+			if err := storage.Register(models.Listener{Event: "concurrent", Name: name, Address: fake.URL}); err != nil {
+				t.Errorf("Couldn't register listener [%v]", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			p.publish(w, httptest.NewRequest("POST", "/publish/concurrent", strings.NewReader(publishedMsg)))
+			if w.Code != http.StatusAccepted && w.Code != http.StatusNotFound {
+				t.Errorf("Expected [%d] or [%d], but got [%d]", http.StatusAccepted, http.StatusNotFound, w.Code)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			//listener may be not registered yet
+			if err := storage.Unregister(name, ""); err != nil && err != persistence.ErrNotFound {
+				t.Errorf("Couldn't unregister listener [%v]", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPublishToWildcardListener(t *testing.T) {
+	received := make(chan string, 1)
+	fake := fakeServer(t, received)
+	defer fake.Close()
+	if err := storage.Register(models.Listener{Event: "wildcard.#", Name: "wildcard", Address: fake.URL}); err != nil {
+		t.Fatalf("Couldn't register fake listener [%v]", err)
+	}
+	p := NewHandlers(logger, storage, dispatch, Config{})
+	w := httptest.NewRecorder()
+
+	p.publish(w, httptest.NewRequest("POST", "/publish/wildcard.orders.created", strings.NewReader(publishedMsg)))
+
+	if w.Code != http.StatusAccepted {
+		t.Logf("Expected status [%d], but got [%d]", http.StatusAccepted, w.Code)
+		t.Fail()
+	}
+	select {
+	case actual := <-received:
+		if actual != publishedMsg {
+			t.Logf("Expected published event [%s], but got [%s]\n", publishedMsg, actual)
+			t.Fail()
+		}
+	case <-time.After(time.Second * 5):
+		t.Log("Wildcard listener hasn't received published event")
+		t.Fail()
+	}
+}
+
+func TestForwarded(t *testing.T) {
+	h := forwarded(http.Header{
+		"Authorization": []string{"Bearer token"},
+		"X-Api-Key":     []string{"key"},
+		"Cookie":        []string{"session=1"},
+		"Content-Type":  []string{"text/plain"},
+		"X-Request-Id":  []string{"req-1"},
+	})
+	if len(h) != 2 || h.Get("Content-Type") != "text/plain" || h.Get("X-Request-Id") != "req-1" {
+		t.Logf("Expected only Content-Type and X-Request-Id, but got [%v]", h)
+		t.Fail()
+	}
+}
+
+func TestIdempotentPublish(t *testing.T) {
+	received := make(chan string, 2)
+	fake := fakeServer(t, received)
+	defer fake.Close()
+	r := staticRegistry{listeners: []models.Listener{{Event: event, Name: "idempotent", Address: fake.URL}}}
+	p := NewHandlers(logger, r, dispatch, Config{Idempotency: idempotency.New(time.Minute)})
+	publish := func(key string, status int) models.PublishResult {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", fmt.Sprintf("/publish/%s", event), strings.NewReader(publishedMsg))
+		req.Header.Set(idempotency.Header, key)
+		p.publish(w, req)
+		if w.Code != status {
+			t.Fatalf("Expected status [%d], but got [%d]", status, w.Code)
+		}
+		res := models.PublishResult{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Couldn't decode response [%v]", err)
+		}
+		return res
+	}
+
+	first := publish("key-1", http.StatusAccepted)
+	second := publish("key-1", http.StatusOK)
+	third := publish("key-2", http.StatusAccepted)
+
+	if first.ID == "" || first.Event != event || first.Duplicate {
+		t.Logf("Expected new message of the event [%s], but got [%+v]", event, first)
+		t.Fail()
+	}
+	if second.ID != first.ID || !second.Duplicate {
+		t.Logf("Expected duplicate of [%s], but got [%+v]", first.ID, second)
+		t.Fail()
+	}
+	if third.ID == first.ID || third.Duplicate {
+		t.Logf("Expected new message for another key, but got [%+v]", third)
+		t.Fail()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Expected [2] deliveries, but got [%d]", i)
+		}
+	}
+	select {
+	case <-received:
+		t.Log("Duplicate has been delivered")
+		t.Fail()
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestPublishWait(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	r := staticRegistry{listeners: []models.Listener{
+		{Event: event, Name: "ok", Address: ok.URL},
+		{Event: event, Name: "broken", Address: broken.URL, Retry: &models.RetryPolicy{MaxAttempts: 1}},
+		{Event: event, Name: "filtered", Address: ok.URL, Filter: "body.data == \"other\""},
+		{Event: event, Name: "suspended", Address: ok.URL, Suspended: true},
+	}}
+	tr := tracker.New(logger, 0, 0)
+	d := dispatcher.New(logger, dispatcher.Config{Observer: tr})
+	defer d.Stop()
+	p := NewHandlers(logger, r, d, Config{Tracker: tr})
+
+	w := httptest.NewRecorder()
+	p.publish(w, httptest.NewRequest("POST", fmt.Sprintf("/publish/%s?wait=5s", event), strings.NewReader(publishedMsg)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status [%d], but got [%d]", http.StatusOK, w.Code)
+	}
+	report := tracker.Message{}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Couldn't decode report [%v]", err)
+	}
+	if report.ID == "" || w.Header().Get("Location") != "/messages/"+report.ID || len(report.Listeners) != 4 {
+		t.Fatalf("Unexpected report [%+v] at [%s]", report, w.Header().Get("Location"))
+	}
+	expected := map[string]string{"ok": tracker.StateDelivered, "broken": tracker.StateFailed, "filtered": tracker.StateFiltered, "suspended": tracker.StateSuspended}
+	for _, s := range report.Listeners {
+		if s.State != expected[s.Listener] {
+			t.Logf("Expected listener [%s] to be [%s], but got [%+v]", s.Listener, expected[s.Listener], s)
+			t.Fail()
+		}
+	}
+	if s := report.Listeners[1]; s.Status != http.StatusInternalServerError || s.Error == "" || s.Attempts != 1 {
+		t.Logf("Expected failed attempt to be reported, but got [%+v]", s)
+		t.Fail()
+	}
+}
+
+func TestPublishInvalidWait(t *testing.T) {
+	p := NewHandlers(logger, staticRegistry{}, dispatch, Config{Tracker: tracker.New(logger, 0, 0)})
+	for _, wait := range []string{"yes", "-1s", "0s"} {
+		w := httptest.NewRecorder()
+		p.publish(w, httptest.NewRequest("POST", fmt.Sprintf("/publish/%s?wait=%s", event, wait), strings.NewReader(publishedMsg)))
+		if w.Code != http.StatusBadRequest {
+			t.Logf("Expected [%d] for wait [%s], but got [%d]", http.StatusBadRequest, wait, w.Code)
+			t.Fail()
+		}
+	}
+}
+
+func TestPublishRetained(t *testing.T) {
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fake.Close()
+	a := archive.New(time.Hour, 0)
+	p := NewHandlers(logger, staticRegistry{listeners: []models.Listener{{Event: event, Name: "retained", Address: fake.URL}}}, dispatch, Config{Archive: a})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", fmt.Sprintf("/publish/%s", event), strings.NewReader(publishedMsg))
+	r.Header.Set("Authorization", "Bearer token")
+
+	p.publish(w, r)
+
+	res := models.PublishResult{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Couldn't decode response [%v]", err)
+	}
+	retained := a.Since(time.Time{})
+	if len(retained) != 1 || retained[0].ID != res.ID || string(retained[0].Body) != publishedMsg || retained[0].Header.Get("Authorization") != "" {
+		t.Logf("Expected message [%s] to be retained without credentials, but got [%+v]", res.ID, retained)
+		t.Fail()
+	}
+}
+
+//TestPublishWaitPastDefault waits for the slow listener longer than DefaultWait behind the real server
+func TestPublishWaitPastDefault(t *testing.T) {
+	//response waiting for the listeners up to MaxWait has to be written before the server times out
+	srv := server.New(http.NewServeMux(), "127.0.0.1:0")
+	if MaxWait+time.Second*10 > srv.WriteTimeout {
+		t.Logf("Expected MaxWait [%s] to leave room within WriteTimeout [%s]", MaxWait, srv.WriteTimeout)
+		t.Fail()
+	}
+	if d, ok := waitFor("15s"); !ok || d != time.Second*15 {
+		t.Logf("Expected wait past DefaultWait [%s] to be kept, but got [%s]", DefaultWait, d)
+		t.Fail()
+	}
+}
+
+//TestIdempotentRetryAfterFullQueue retries publish which has been queued for some of the listeners only
+func TestIdempotentRetryAfterFullQueue(t *testing.T) {
+	blocked, release := make(chan struct{}, 1), make(chan struct{})
+	received := make(chan string, 4)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			blocked <- struct{}{}
+			<-release
+			return
+		}
+		received <- r.URL.Path
+	}))
+	defer fake.Close()
+	tr := tracker.New(logger, 0, 0)
+	d := dispatcher.New(logger, dispatcher.Config{Workers: 1, QueueSize: 1, Observer: tr})
+	defer d.Stop()
+	//the only worker is busy, so the queue has room for a single delivery
+	if err := d.Enqueue(dispatcher.Delivery{Listener: models.Listener{Name: "block", Address: fake.URL + "/block"}, Event: event, Body: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	<-blocked
+	r := staticRegistry{listeners: []models.Listener{
+		{Event: event, Name: "first", Address: fake.URL + "/first"},
+		{Event: event, Name: "second", Address: fake.URL + "/second"},
+	}}
+	p := NewHandlers(logger, r, d, Config{Idempotency: idempotency.New(time.Minute), Tracker: tr})
+	publish := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", fmt.Sprintf("/publish/%s", event), strings.NewReader(publishedMsg))
+		req.Header.Set(idempotency.Header, "key")
+		p.publish(w, req)
+		return w
+	}
+
+	if w := publish(); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status [%d], but got [%d]", http.StatusServiceUnavailable, w.Code)
+	}
+	close(release)
+	//retry is queued for the second listener only once the queue has room
+	var w *httptest.ResponseRecorder
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		if w = publish(); w.Code == http.StatusAccepted {
+			break
+		}
+	}
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status [%d], but got [%d]", http.StatusAccepted, w.Code)
+	}
+	delivered := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		select {
+		case path := <-received:
+			delivered[path]++
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Expected [2] deliveries, but got [%v]", delivered)
+		}
+	}
+	select {
+	case path := <-received:
+		delivered[path]++
+	case <-time.After(time.Millisecond * 200):
+	}
+	if delivered["/first"] != 1 || delivered["/second"] != 1 {
+		t.Logf("Expected a single delivery to every listener, but got [%v]", delivered)
+		t.Fail()
+	}
+	//listener queued by the failed attempt isn't left pending by the retry
+	var result models.PublishResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	report, settled := tr.Wait(result.ID, time.Second*5)
+	if !settled {
+		t.Logf("Expected report to settle, but got [%+v]", report)
+		t.Fail()
+	}
+	for _, s := range report.Listeners {
+		if s.State != tracker.StateDelivered {
+			t.Logf("Expected listener [%s] to be delivered, but got [%s]", s.Listener, s.State)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+//Package archive retains published messages per event, so listeners can catch up by replaying them
+package archive
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Message is a retained published message
+type Message struct {
+	ID        string
+	Event     string
+	Body      []byte
+	Header    http.Header
+	Published time.Time
+
+	seq uint64
+}
+
+type eventLog struct {
+	messages []*Message
+	size     int
+}
+
+//Archive keeps messages in memory per event
+//Message is dropped once it's older than window or its event exceeds maxBytes of bodies
+//It is safe for concurrent use
+type Archive struct {
+	mu       sync.Mutex
+	window   time.Duration
+	maxBytes int
+	events   map[string]*eventLog
+	ids      map[string]*Message
+	seq      uint64
+	now      func() time.Time
+}
+
+//New creates empty Archive, maxBytes <= 0 means the size of events isn't limited
+func New(window time.Duration, maxBytes int) *Archive {
+	return &Archive{window: window, maxBytes: maxBytes, events: make(map[string]*eventLog), ids: make(map[string]*Message), now: time.Now}
+}
+
+//Put retains the message, message with the same id published again replaces the previous one
+func (a *Archive) Put(m Message) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if old, ok := a.ids[m.ID]; ok {
+		a.drop(old)
+	}
+	a.seq++
+	m.seq = a.seq
+	m.Published = a.now()
+	e, ok := a.events[m.Event]
+	if !ok {
+		e = &eventLog{}
+		a.events[m.Event] = e
+	}
+	e.messages = append(e.messages, &m)
+	e.size += len(m.Body)
+	a.ids[m.ID] = &m
+	for a.maxBytes > 0 && e.size > a.maxBytes && len(e.messages) > 0 {
+		a.drop(e.messages[0])
+	}
+	a.expire()
+}
+
+//Since returns messages published at from or later, the oldest first
+func (a *Archive) Since(from time.Time) []Message {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expire()
+	return a.collect(func(m *Message) bool { return !m.Published.Before(from) })
+}
+
+//After returns messages published after the message with the id, the oldest first
+//It returns false when the message isn't retained
+func (a *Archive) After(id string) ([]Message, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expire()
+	from, ok := a.ids[id]
+	if !ok {
+		return nil, false
+	}
+	return a.collect(func(m *Message) bool { return m.seq > from.seq }), true
+}
+
+func (a *Archive) collect(match func(m *Message) bool) []Message {
+	var messages []Message
+	for _, e := range a.events {
+		for _, m := range e.messages {
+			if match(m) {
+				messages = append(messages, *m)
+			}
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].seq < messages[j].seq })
+	return messages
+}
+
+//expire drops messages older than window, messages of an event are ordered by the time they were put
+func (a *Archive) expire() {
+	deadline := a.now().Add(-a.window)
+	for _, e := range a.events {
+		for len(e.messages) > 0 && e.messages[0].Published.Before(deadline) {
+			a.drop(e.messages[0])
+		}
+	}
+}
+
+func (a *Archive) drop(m *Message) {
+	delete(a.ids, m.ID)
+	e := a.events[m.Event]
+	for i, v := range e.messages {
+		if v == m {
+			e.messages = append(e.messages[:i], e.messages[i+1:]...)
+			e.size -= len(m.Body)
+			break
+		}
+	}
+	if len(e.messages) == 0 {
+		delete(a.events, m.Event)
+	}
+}
@@ -0,0 +1,74 @@
+package archive
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func ids(messages []Message) []string {
+	ids := []string{}
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestArchive(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a := New(time.Hour, 0)
+	a.now = func() time.Time { return now }
+	a.Put(Message{ID: "1", Event: "orders", Body: []byte("1")})
+	now = now.Add(time.Minute)
+	a.Put(Message{ID: "2", Event: "users", Body: []byte("2")})
+	now = now.Add(time.Minute)
+	a.Put(Message{ID: "3", Event: "orders", Body: []byte("3")})
+
+	tests := []struct {
+		name     string
+		actual   []Message
+		expected []string
+	}{
+		{name: "All", actual: a.Since(time.Time{}), expected: []string{"1", "2", "3"}},
+		{name: "Since", actual: a.Since(time.Unix(1700000060, 0)), expected: []string{"2", "3"}},
+		{name: "Future", actual: a.Since(now.Add(time.Second)), expected: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if !reflect.DeepEqual(ids(test.actual), test.expected) {
+				t.Logf("Expected [%v], but got [%v]", test.expected, ids(test.actual))
+				t.Fail()
+			}
+		})
+	}
+	if messages, ok := a.After("1"); !ok || !reflect.DeepEqual(ids(messages), []string{"2", "3"}) {
+		t.Logf("Expected messages after [1], but got [%v] [%t]", ids(messages), ok)
+		t.Fail()
+	}
+	if _, ok := a.After("unknown"); ok {
+		t.Log("Expected unknown message not to be found")
+		t.Fail()
+	}
+
+	//message older than window is dropped
+	now = now.Add(time.Minute * 59)
+	if actual := ids(a.Since(time.Time{})); !reflect.DeepEqual(actual, []string{"2", "3"}) {
+		t.Logf("Expected expired message to be dropped, but got [%v]", actual)
+		t.Fail()
+	}
+}
+
+func TestArchiveMaxBytes(t *testing.T) {
+	a := New(time.Hour, 4)
+	a.Put(Message{ID: "1", Event: "orders", Body: []byte("12")})
+	a.Put(Message{ID: "2", Event: "users", Body: []byte("1234")})
+	a.Put(Message{ID: "3", Event: "orders", Body: []byte("34")})
+	a.Put(Message{ID: "4", Event: "orders", Body: []byte("5")})
+	//published again with the same id replaces the previous one
+	a.Put(Message{ID: "2", Event: "users", Body: []byte("5678")})
+
+	if actual := ids(a.Since(time.Time{})); !reflect.DeepEqual(actual, []string{"3", "4", "2"}) {
+		t.Logf("Expected the oldest messages of the event to be dropped, but got [%v]", actual)
+		t.Fail()
+	}
+}
@@ -0,0 +1,126 @@
+package archive
+
+import (
+	"errors"
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/models"
+	"github.com/volodimyr/publisher/pkg/persistence"
+	"github.com/volodimyr/publisher/pkg/tracker"
+	"strconv"
+	"time"
+)
+
+var (
+	//ErrUnknownMessage is returned when replay starts from message which isn't retained
+	ErrUnknownMessage = errors.New("archive: message isn't retained")
+	//ErrSuspended is returned when messages are replayed to the suspended listener
+	ErrSuspended = errors.New("archive: listener is suspended")
+)
+
+//Replayer delivers retained messages to a single listener through the dispatcher
+type Replayer struct {
+	a *Archive
+	r persistence.Registry
+	d *dispatcher.Dispatcher
+	t *tracker.Tracker
+}
+
+//NewReplayer creates Replayer of the archived messages
+//if t == nil, replayed deliveries aren't tracked
+func NewReplayer(a *Archive, registry persistence.Registry, d *dispatcher.Dispatcher, t *tracker.Tracker) *Replayer {
+	return &Replayer{a: a, r: registry, d: d, t: t}
+}
+
+//Replay queues retained messages of every event the listener is subscribed to, the oldest first
+//from is either RFC3339 or unix time the messages are published at or after,
+//or id of the message they're published after, empty from replays everything retained
+//Messages are delivered with the listener's current subscription, so its filter, secrets and retry apply
+//It returns persistence.ErrNotFound if the listener isn't registered and ErrSuspended if it's suspended
+//and stops at the first message which couldn't be queued
+func (p *Replayer) Replay(name, from string) (models.ReplayResult, error) {
+	res := models.ReplayResult{Listener: name}
+	events, err := p.r.List()
+	if err != nil {
+		return res, err
+	}
+	registered := false
+	for _, listeners := range events {
+		if l, ok := listeners[name]; ok {
+			if l.Suspended {
+				return res, ErrSuspended
+			}
+			registered = true
+		}
+	}
+	if !registered {
+		return res, persistence.ErrNotFound
+	}
+	messages, err := p.messages(from)
+	if err != nil {
+		return res, err
+	}
+	//exact subscription wins over wildcard one, so the listener is resolved the way publish does it
+	subscriptions := make(map[string]*models.Listener)
+	for _, m := range messages {
+		l, ok := subscriptions[m.Event]
+		if !ok {
+			l = p.subscription(m.Event, name)
+			subscriptions[m.Event] = l
+		}
+		if l == nil {
+			continue
+		}
+		//replay is reported along with the original deliveries of the message
+		if p.t != nil {
+			p.t.Replayed(m.ID, m.Event, *l)
+		}
+		err := p.d.Enqueue(dispatcher.NewDelivery(m.ID, m.Event, *l, m.Body, m.Header))
+		if err == dispatcher.ErrFiltered {
+			p.skip(m.ID, name, tracker.StateFiltered, "")
+			res.Filtered++
+			continue
+		}
+		if err != nil {
+			p.skip(m.ID, name, tracker.StateFailed, err.Error())
+			return res, err
+		}
+		res.Replayed++
+	}
+	return res, nil
+}
+
+func (p *Replayer) skip(id, listener, state, reason string) {
+	if p.t != nil {
+		p.t.Skip(id, listener, state, reason)
+	}
+}
+
+func (p *Replayer) messages(from string) ([]Message, error) {
+	if from == "" {
+		return p.a.Since(time.Time{}), nil
+	}
+	if t, err := time.Parse(time.RFC3339, from); err == nil {
+		return p.a.Since(t), nil
+	}
+	if sec, err := strconv.ParseInt(from, 10, 64); err == nil {
+		return p.a.Since(time.Unix(sec, 0)), nil
+	}
+	messages, ok := p.a.After(from)
+	if !ok {
+		return nil, ErrUnknownMessage
+	}
+	return messages, nil
+}
+
+func (p *Replayer) subscription(event, name string) *models.Listener {
+	listeners, err := p.r.Lookup(event)
+	if err != nil {
+		return nil
+	}
+	for _, l := range listeners {
+		if l.Name == name {
+			return &l
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package archive
+
+import (
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/models"
+	"github.com/volodimyr/publisher/pkg/persistence"
+	"github.com/volodimyr/publisher/pkg/tracker"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var logger = log.New(os.Stdout, "test: ", log.LstdFlags|log.Lshortfile)
+
+func TestReplay(t *testing.T) {
+	received := make(chan string, 10)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		received <- r.Header.Get(dispatcher.HeaderMessageID) + ":" + string(bs)
+	}))
+	defer fake.Close()
+	s := persistence.New(logger)
+	defer s.Close()
+	for _, l := range []models.Listener{
+		{Event: "orders.#", Name: "billing", Address: fake.URL},
+		{Event: "orders.paid", Name: "billing", Address: fake.URL, Filter: "body.total > 10"},
+		{Event: "orders.created", Name: "audit", Address: fake.URL},
+	} {
+		if err := s.Register(l); err != nil {
+			t.Fatalf("Couldn't register listener [%v]", err)
+		}
+	}
+	d := dispatcher.New(logger, dispatcher.Config{Workers: 1})
+	defer d.Stop()
+	a := New(time.Hour, 0)
+	a.Put(Message{ID: "m1", Event: "orders.created", Body: []byte(`{"total":1}`)})
+	a.Put(Message{ID: "m2", Event: "orders.paid", Body: []byte(`{"total":1}`)})
+	a.Put(Message{ID: "m3", Event: "orders.paid", Body: []byte(`{"total":20}`)})
+	a.Put(Message{ID: "m4", Event: "users", Body: []byte(`{}`)})
+	p := NewReplayer(a, s, d, nil)
+
+	res, err := p.Replay("billing", "m1")
+	expected := models.ReplayResult{Listener: "billing", Replayed: 1, Filtered: 1}
+	if err != nil || res != expected {
+		t.Fatalf("Expected [%+v], but got [%+v] [%v]", expected, res, err)
+	}
+	select {
+	case actual := <-received:
+		//exact subscription with its filter wins over the wildcard one
+		if actual != `m3:{"total":20}` {
+			t.Logf("Expected message [m3] to be replayed, but got [%s]", actual)
+			t.Fail()
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected message to be replayed")
+	}
+
+	res, err = p.Replay("billing", time.Now().Add(-time.Minute).Format(time.RFC3339))
+	if err != nil || res.Replayed != 2 || res.Filtered != 1 {
+		t.Logf("Expected every retained message to be replayed, but got [%+v] [%v]", res, err)
+		t.Fail()
+	}
+	if _, err := p.Replay("unknown", ""); err != persistence.ErrNotFound {
+		t.Logf("Expected [%v], but got [%v]", persistence.ErrNotFound, err)
+		t.Fail()
+	}
+	if _, err := p.Replay("billing", "unknown"); err != ErrUnknownMessage {
+		t.Logf("Expected [%v], but got [%v]", ErrUnknownMessage, err)
+		t.Fail()
+	}
+}
+
+func TestReplayTracked(t *testing.T) {
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fake.Close()
+	s := persistence.New(logger)
+	defer s.Close()
+	tr := tracker.New(logger, 0, 0)
+	d := dispatcher.New(logger, dispatcher.Config{Workers: 1, Observer: tr})
+	defer d.Stop()
+	a := New(time.Hour, 0)
+	a.Put(Message{ID: "m1", Event: "orders", Body: []byte("{}")})
+	//message was published before billing subscribed, so the report knows audit only
+	tr.Track("m1", "orders", []models.Listener{{Event: "orders", Name: "audit", Address: fake.URL}})
+	tr.Skip("m1", "audit", tracker.StateFailed, "unexpected status code [500]")
+	if err := s.Register(models.Listener{Event: "orders", Name: "billing", Address: fake.URL}); err != nil {
+		t.Fatalf("Couldn't register listener [%v]", err)
+	}
+	p := NewReplayer(a, s, d, tr)
+
+	if _, err := p.Replay("billing", ""); err != nil {
+		t.Fatalf("Couldn't replay [%v]", err)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		deliveries := tr.Deliveries("billing", "", 0)
+		if len(deliveries) == 1 && deliveries[0].MessageID == "m1" && deliveries[0].State == tracker.StateDelivered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected replayed delivery to be logged, but got [%+v]", deliveries)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if m, _ := tr.Get("m1"); len(m.Listeners) != 2 || m.Listeners[0].State != tracker.StateFailed {
+		t.Logf("Expected replay to be added to the original report, but got [%+v]", m)
+		t.Fail()
+	}
+}
+
+func TestReplayFrom(t *testing.T) {
+	a := New(time.Hour, 0)
+	a.Put(Message{ID: "m1", Event: "orders", Body: []byte("{}")})
+	p := NewReplayer(a, nil, nil, nil)
+	tests := []struct {
+		name     string
+		from     string
+		expected []string
+	}{
+		{name: "Empty", from: "", expected: []string{"m1"}},
+		{name: "Unix", from: "0", expected: []string{"m1"}},
+		{name: "RFC3339", from: time.Now().Add(time.Hour).Format(time.RFC3339), expected: []string{}},
+		{name: "ID", from: "m1", expected: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages, err := p.messages(test.from)
+			if err != nil || !reflect.DeepEqual(ids(messages), test.expected) {
+				t.Logf("Expected [%v], but got [%v] [%v]", test.expected, ids(messages), err)
+				t.Fail()
+			}
+		})
+	}
+}
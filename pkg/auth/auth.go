@@ -0,0 +1,181 @@
+//Package auth authenticates api callers by API key or JWT and authorizes them by scopes
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/volodimyr/publisher/pkg/topic"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	//KeyHeader is the header carrying API key, key can also be sent as "Authorization: Bearer {key}"
+	KeyHeader = "X-API-Key"
+
+	//ScopeListenersRead allows inspection of listeners and events
+	ScopeListenersRead = "listeners:read"
+	//ScopeListenersWrite allows registration, update and removal of listeners, it implies ScopeListenersRead
+	ScopeListenersWrite = "listeners:write"
+	//ScopeDeadLettersRead allows inspection of dead letters
+	ScopeDeadLettersRead = "deadletters:read"
+	//ScopeDeadLettersWrite allows redrive and removal of dead letters, it implies ScopeDeadLettersRead
+	ScopeDeadLettersWrite = "deadletters:write"
+	//ScopeMessagesRead allows inspection of the delivery log
+	ScopeMessagesRead = "messages:read"
+	//ScopePublish is the prefix of publish scopes, the rest is an event pattern, e.g. "publish:orders.*"
+	ScopePublish = "publish:"
+)
+
+var (
+	//ErrNoCredentials is returned when request carries neither API key nor token
+	ErrNoCredentials = errors.New("auth: no credentials")
+	//ErrInvalidCredentials is returned when API key is unknown or token can't be verified
+	ErrInvalidCredentials = errors.New("auth: invalid credentials")
+)
+
+//Principal is an authenticated caller
+type Principal struct {
+	Subject string
+	Scopes  []string
+}
+
+//Allows reports whether any scope of the principal grants scope
+//write scope grants read one and publish scope grants every event matching its pattern
+func (p *Principal) Allows(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+		if strings.HasSuffix(scope, ":read") && s == strings.TrimSuffix(scope, "read")+"write" {
+			return true
+		}
+		if strings.HasPrefix(scope, ScopePublish) && strings.HasPrefix(s, ScopePublish) &&
+			topic.Matches(strings.TrimPrefix(s, ScopePublish), strings.TrimPrefix(scope, ScopePublish)) {
+			return true
+		}
+	}
+	return false
+}
+
+//Config points to the credentials, at least one of the files should be set
+//APIKeys is a json file {"keys": [{"name": "ci", "key": "...", "scopes": ["publish:orders.*"]}]}
+//JWKS is a json web key set file, "oct" keys verify HS256 and "RSA" keys verify RS256 tokens
+//Issuer and Audience are optional, when set tokens must carry them in "iss" and "aud" claims
+type Config struct {
+	APIKeys  string
+	JWKS     string
+	Issuer   string
+	Audience string
+}
+
+//Authenticator checks credentials of the incoming requests
+type Authenticator struct {
+	logger   *log.Logger
+	keys     map[string]Principal
+	jwks     []jwk
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+//New creates Authenticator loading the credential files
+//if logger == nil, default will be taken
+func New(logger *log.Logger, cfg Config) (*Authenticator, error) {
+	if logger == nil {
+		logger = log.New(os.Stdout, "auth: ", log.LstdFlags|log.Lshortfile)
+	}
+	if cfg.APIKeys == "" && cfg.JWKS == "" {
+		return nil, errors.New("auth: neither API keys nor JWKS file is set")
+	}
+	a := &Authenticator{logger: logger, issuer: cfg.Issuer, audience: cfg.Audience, now: time.Now}
+	if cfg.APIKeys != "" {
+		keys, err := loadKeys(cfg.APIKeys)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = keys
+	}
+	if cfg.JWKS != "" {
+		set, err := loadJWKS(cfg.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		a.jwks = set
+	}
+	logger.Printf("Authentication is enabled with [%d] API keys and [%d] JWKS keys\n", len(a.keys), len(a.jwks))
+	return a, nil
+}
+
+//Authenticate returns principal of the request
+//Bearer credential with two dots is treated as JWT, anything else as API key
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if key := r.Header.Get(KeyHeader); key != "" {
+		return a.key(key)
+	}
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, ErrNoCredentials
+	}
+	credential := strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	if strings.Count(credential, ".") == 2 {
+		return a.token(credential)
+	}
+	return a.key(credential)
+}
+
+//Middleware lets request through only when it's authenticated and its principal is allowed scope(r)
+//Empty scope means any authenticated caller is allowed
+func (a *Authenticator) Middleware(next http.Handler, scope func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			a.logger.Printf("server: Unauthenticated request [%s %s] [%v]\n", r.Method, r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="publisher"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if s := scope(r); s != "" && !p.Allows(s) {
+			a.logger.Printf("server: [%s] isn't allowed [%s] for [%s %s]\n", p.Subject, s, r.Method, r.URL.Path)
+			http.Error(w, "Forbidden, missing scope "+s, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+type principalKey struct{}
+
+//FromContext returns principal of the authenticated request, nil when auth is disabled
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+//RouteScope returns scope required by the publisher api route
+func RouteScope(r *http.Request) string {
+	path := r.URL.Path
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	switch {
+	case strings.HasPrefix(path, "/messages/"),
+		strings.HasPrefix(path, "/listener/") && strings.HasSuffix(path, "/deliveries"):
+		return ScopeMessagesRead
+	case strings.HasPrefix(path, "/publish/"):
+		return ScopePublish + strings.TrimPrefix(path, "/publish/")
+	case path == "/listener" || strings.HasPrefix(path, "/listener/"),
+		path == "/events" || strings.HasPrefix(path, "/events/"):
+		if read {
+			return ScopeListenersRead
+		}
+		return ScopeListenersWrite
+	case path == "/deadletters" || strings.HasPrefix(path, "/deadletters/"):
+		if read {
+			return ScopeDeadLettersRead
+		}
+		return ScopeDeadLettersWrite
+	}
+	return ""
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var logger = log.New(os.Stdout, "test: ", log.LstdFlags|log.Lshortfile)
+
+var (
+	hmacSecret = []byte("0123456789abcdef0123456789abcdef")
+	now        = time.Unix(1700000000, 0)
+)
+
+func b64(bs []byte) string {
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+func sign(t *testing.T, alg, kid string, key interface{}, c map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	p, _ := json.Marshal(c)
+	input := b64(h) + "." + b64(p)
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(input))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return input + "." + b64(sig)
+}
+
+func setup(t *testing.T) (*Authenticator, *rsa.PrivateKey, func()) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := `{"keys": [
+		{"name": "orders-service", "key": "orders-key", "scopes": ["publish:orders.*"]},
+		{"name": "admin", "key": "admin-key", "scopes": ["listeners:write", "deadletters:read", "publish:#"]}
+	]}`
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "oct", "kid": "hs", "alg": "HS256", "k": b64(hmacSecret)},
+		{"kty": "RSA", "kid": "rs", "alg": "RS256", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+	}})
+	if err := ioutil.WriteFile(filepath.Join(dir, "keys.json"), []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "jwks.json"), jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(logger, Config{APIKeys: filepath.Join(dir, "keys.json"), JWKS: filepath.Join(dir, "jwks.json"), Issuer: "issuer", Audience: "publisher"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return now }
+	return a, rsaKey, func() { os.RemoveAll(dir) }
+}
+
+func TestAuthenticate(t *testing.T) {
+	a, rsaKey, cleanup := setup(t)
+	defer cleanup()
+	valid := map[string]interface{}{"sub": "ci", "iss": "issuer", "aud": []string{"other", "publisher"}, "exp": now.Add(time.Hour).Unix(), "scope": "listeners:read publish:users"}
+	with := func(k string, v interface{}) map[string]interface{} {
+		c := make(map[string]interface{}, len(valid))
+		for key, value := range valid {
+			c[key] = value
+		}
+		c[k] = v
+		return c
+	}
+	tests := []struct {
+		name     string
+		header   string
+		value    string
+		subject  string
+		expected error
+	}{
+		{name: "APIKey", header: KeyHeader, value: "orders-key", subject: "orders-service"},
+		{name: "APIKeyBearer", header: "Authorization", value: "Bearer admin-key", subject: "admin"},
+		{name: "UnknownAPIKey", header: KeyHeader, value: "unknown", expected: ErrInvalidCredentials},
+		{name: "NoCredentials", expected: ErrNoCredentials},
+		{name: "HS256", header: "Authorization", value: "Bearer " + sign(t, "HS256", "hs", hmacSecret, valid), subject: "ci"},
+		{name: "RS256", header: "Authorization", value: "Bearer " + sign(t, "RS256", "rs", rsaKey, valid), subject: "ci"},
+		{name: "RS256WithoutKid", header: "Authorization", value: "Bearer " + sign(t, "RS256", "", rsaKey, valid), subject: "ci"},
+		{name: "WrongKid", header: "Authorization", value: "Bearer " + sign(t, "HS256", "rs", hmacSecret, valid), expected: ErrInvalidCredentials},
+		{name: "WrongSecret", header: "Authorization", value: "Bearer " + sign(t, "HS256", "hs", []byte("other"), valid), expected: ErrInvalidCredentials},
+		{name: "AlgNone", header: "Authorization", value: "Bearer " + sign(t, "none", "", nil, valid), expected: ErrInvalidCredentials},
+		{name: "Expired", header: "Authorization", value: "Bearer " + sign(t, "HS256", "hs", hmacSecret, with("exp", now.Add(-time.Hour).Unix())), expected: ErrInvalidCredentials},
+		{name: "NoExpiration", header: "Authorization", value: "Bearer " + sign(t, "HS256", "hs", hmacSecret, with("exp", nil)), expected: ErrInvalidCredentials},
+		{name: "NotYetValid", header: "Authorization", value: "Bearer " + sign(t, "HS256", "hs", hmacSecret, with("nbf", now.Add(time.Hour).Unix())), expected: ErrInvalidCredentials},
+		{name: "WrongIssuer", header: "Authorization", value: "Bearer " + sign(t, "HS256", "hs", hmacSecret, with("iss", "other")), expected: ErrInvalidCredentials},
+		{name: "WrongAudience", header: "Authorization", value: "Bearer " + sign(t, "HS256", "hs", hmacSecret, with("aud", "other")), expected: ErrInvalidCredentials},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/events", nil)
+			if test.header != "" {
+				r.Header.Set(test.header, test.value)
+			}
+			p, err := a.Authenticate(r)
+			if err != test.expected {
+				t.Logf("Expected [%v], but got [%v]", test.expected, err)
+				t.Fail()
+				return
+			}
+			if err == nil && p.Subject != test.subject {
+				t.Logf("Expected subject [%s], but got [%s]", test.subject, p.Subject)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestPrincipal_Allows(t *testing.T) {
+	p := &Principal{Scopes: []string{"publish:orders.*", "listeners:write", "deadletters:read"}}
+	tests := []struct {
+		scope    string
+		expected bool
+	}{
+		{scope: "publish:orders.created", expected: true},
+		{scope: "publish:orders.eu.created", expected: false},
+		{scope: "publish:users", expected: false},
+		{scope: ScopeListenersWrite, expected: true},
+		{scope: ScopeListenersRead, expected: true},
+		{scope: ScopeDeadLettersRead, expected: true},
+		{scope: ScopeDeadLettersWrite, expected: false},
+	}
+	for _, test := range tests {
+		if actual := p.Allows(test.scope); actual != test.expected {
+			t.Logf("[%s] Expected [%v], but got [%v]", test.scope, test.expected, actual)
+			t.Fail()
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	a, _, cleanup := setup(t)
+	defer cleanup()
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(FromContext(r.Context()).Subject))
+	}), RouteScope)
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		key            string
+		expectedStatus int
+	}{
+		{name: "PUBLISH", method: "POST", path: "/publish/orders.created", key: "orders-key", expectedStatus: http.StatusOK},
+		{name: "PUBLISH_FORBIDDEN", method: "POST", path: "/publish/users", key: "orders-key", expectedStatus: http.StatusForbidden},
+		{name: "REGISTER_FORBIDDEN", method: "POST", path: "/listener", key: "orders-key", expectedStatus: http.StatusForbidden},
+		{name: "REGISTER", method: "POST", path: "/listener", key: "admin-key", expectedStatus: http.StatusOK},
+		{name: "INSPECT", method: "GET", path: "/events/users/listeners", key: "admin-key", expectedStatus: http.StatusOK},
+		{name: "UNSUBSCRIBE", method: "DELETE", path: "/events/users/listeners/audit", key: "admin-key", expectedStatus: http.StatusOK},
+		{name: "MESSAGE_FORBIDDEN", method: "GET", path: "/messages/1", key: "orders-key", expectedStatus: http.StatusForbidden},
+		{name: "DELIVERIES_FORBIDDEN", method: "GET", path: "/listener/audit/deliveries", key: "admin-key", expectedStatus: http.StatusForbidden},
+		{name: "REDRIVE_FORBIDDEN", method: "POST", path: "/deadletters/1/redrive", key: "admin-key", expectedStatus: http.StatusForbidden},
+		{name: "UNAUTHENTICATED", method: "POST", path: "/publish/orders.created", expectedStatus: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.path, nil)
+			if test.key != "" {
+				r.Header.Set(KeyHeader, test.key)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != test.expectedStatus {
+				t.Logf("Expected status [%d], but got [%d]", test.expectedStatus, w.Code)
+				t.Fail()
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+//leeway tolerates clock skew between the token issuer and the publisher
+const leeway = 30 * time.Second
+
+//jwk is a verification key of the JWKS file
+type jwk struct {
+	kid    string
+	alg    string
+	secret []byte
+	public *rsa.PublicKey
+}
+
+type jwksFile struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+		K   string `json:"k"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func loadJWKS(path string) ([]jwk, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f jwksFile
+	if err := json.Unmarshal(bs, &f); err != nil {
+		return nil, fmt.Errorf("auth: invalid JWKS file [%s] [%v]", path, err)
+	}
+	set := make([]jwk, 0, len(f.Keys))
+	for i, k := range f.Keys {
+		switch k.Kty {
+		case "oct":
+			if k.Alg != "" && k.Alg != "HS256" {
+				return nil, fmt.Errorf("auth: key [%d] in [%s] has unsupported alg [%s]", i, path, k.Alg)
+			}
+			secret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.K, "="))
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("auth: key [%d] in [%s] has invalid k", i, path)
+			}
+			set = append(set, jwk{kid: k.Kid, alg: "HS256", secret: secret})
+		case "RSA":
+			if k.Alg != "" && k.Alg != "RS256" {
+				return nil, fmt.Errorf("auth: key [%d] in [%s] has unsupported alg [%s]", i, path, k.Alg)
+			}
+			n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.N, "="))
+			if err != nil || len(n) == 0 {
+				return nil, fmt.Errorf("auth: key [%d] in [%s] has invalid n", i, path)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.E, "="))
+			if err != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("auth: key [%d] in [%s] has invalid e", i, path)
+			}
+			public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			set = append(set, jwk{kid: k.Kid, alg: "RS256", public: public})
+		default:
+			return nil, fmt.Errorf("auth: key [%d] in [%s] has unsupported kty [%s]", i, path, k.Kty)
+		}
+	}
+	return set, nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+//claims are the registered claims plus scopes either as OAuth "scope" string or "scopes" list
+type claims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	Scope     string          `json:"scope"`
+	Scopes    []string        `json:"scopes"`
+}
+
+//token verifies signature and claims of the compact serialized JWT
+//Algorithm must match the key type, so RSA public key can never be used as HMAC secret
+func (a *Authenticator) token(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidCredentials
+	}
+	var h header
+	if err := decode(parts[0], &h); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	input := []byte(parts[0] + "." + parts[1])
+	if !a.verify(h, input, sig) {
+		return nil, ErrInvalidCredentials
+	}
+	var c claims
+	if err := decode(parts[1], &c); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	now := a.now()
+	if c.ExpiresAt == nil || now.After(unix(*c.ExpiresAt).Add(leeway)) {
+		return nil, ErrInvalidCredentials
+	}
+	if c.NotBefore != nil && now.Add(leeway).Before(unix(*c.NotBefore)) {
+		return nil, ErrInvalidCredentials
+	}
+	if a.issuer != "" && c.Issuer != a.issuer {
+		return nil, ErrInvalidCredentials
+	}
+	if a.audience != "" && !audience(c.Audience, a.audience) {
+		return nil, ErrInvalidCredentials
+	}
+	scopes := c.Scopes
+	if c.Scope != "" {
+		scopes = append(scopes, strings.Fields(c.Scope)...)
+	}
+	return &Principal{Subject: c.Subject, Scopes: scopes}, nil
+}
+
+func (a *Authenticator) verify(h header, input, sig []byte) bool {
+	if h.Alg != "HS256" && h.Alg != "RS256" {
+		return false
+	}
+	digest := sha256.Sum256(input)
+	for _, k := range a.jwks {
+		if k.alg != h.Alg || (h.Kid != "" && k.kid != h.Kid) {
+			continue
+		}
+		switch k.alg {
+		case "HS256":
+			mac := hmac.New(sha256.New, k.secret)
+			mac.Write(input)
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return true
+			}
+		case "RS256":
+			if rsa.VerifyPKCS1v15(k.public, crypto.SHA256, digest[:], sig) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decode(part string, v interface{}) error {
+	bs, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+func unix(sec float64) time.Time {
+	return time.Unix(int64(sec), 0)
+}
+
+//audience checks "aud" claim which is either a string or a list of them
+func audience(raw json.RawMessage, expected string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == expected
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		for _, a := range many {
+			if a == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
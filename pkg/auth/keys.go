@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+type keysFile struct {
+	Keys []struct {
+		Name   string   `json:"name"`
+		Key    string   `json:"key"`
+		Scopes []string `json:"scopes"`
+	} `json:"keys"`
+}
+
+//loadKeys reads API keys file, keys are indexed by their hash so they aren't kept in memory as is
+func loadKeys(path string) (map[string]Principal, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f keysFile
+	if err := json.Unmarshal(bs, &f); err != nil {
+		return nil, fmt.Errorf("auth: invalid API keys file [%s] [%v]", path, err)
+	}
+	keys := make(map[string]Principal, len(f.Keys))
+	for i, k := range f.Keys {
+		if k.Name == "" || k.Key == "" {
+			return nil, fmt.Errorf("auth: API key [%d] in [%s] should have name and key", i, path)
+		}
+		h := hash(k.Key)
+		if _, ok := keys[h]; ok {
+			return nil, fmt.Errorf("auth: API key [%s] in [%s] is duplicated", k.Name, path)
+		}
+		keys[h] = Principal{Subject: k.Name, Scopes: k.Scopes}
+	}
+	return keys, nil
+}
+
+func (a *Authenticator) key(key string) (*Principal, error) {
+	p, ok := a.keys[hash(key)]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return &p, nil
+}
+
+func hash(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
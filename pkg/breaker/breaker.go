@@ -0,0 +1,153 @@
+//Package breaker stops calling listener addresses which keep failing and lets them recover with probe requests
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+//States of a breaker
+const (
+	//StateClosed lets every request through
+	StateClosed = "closed"
+	//StateOpen fails requests fast until the cooldown passes
+	StateOpen = "open"
+	//StateHalfOpen lets a single probe request through at a time
+	StateHalfOpen = "half-open"
+)
+
+//Config defines when breakers open and how they recover
+//Threshold is the amount of consecutive failures which opens the breaker
+//Cooldown is how long breaker stays open before it lets a probe through
+//Probes is the amount of successful probes in a row which closes the breaker again
+//Zero values are replaced with defaults
+type Config struct {
+	Threshold int
+	Cooldown  time.Duration
+	Probes    int
+}
+
+//Defaults of Config
+const (
+	DefaultThreshold = 5
+	DefaultCooldown  = 30 * time.Second
+	DefaultProbes    = 1
+)
+
+type breaker struct {
+	state    string
+	failures int
+	//successes counts successful probes since the breaker became half-open
+	successes int
+	probing   bool
+	opened    time.Time
+}
+
+//Breakers keeps a breaker per address, addresses without failures aren't kept at all
+//It is safe for concurrent use
+type Breakers struct {
+	mu       sync.Mutex
+	cfg      Config
+	breakers map[string]*breaker
+	now      func() time.Time
+}
+
+//New creates Breakers where every address is closed
+func New(cfg Config) *Breakers {
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = DefaultThreshold
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = DefaultCooldown
+	}
+	if cfg.Probes <= 0 {
+		cfg.Probes = DefaultProbes
+	}
+	return &Breakers{cfg: cfg, breakers: make(map[string]*breaker), now: time.Now}
+}
+
+//Allow reports whether a request to the address can be made now, allowed request must be followed by Done
+//When it can't, wait is how long until the breaker lets a probe through, 0 means the probe is in flight already
+func (b *Breakers) Allow(address string) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.breakers[address]
+	if !ok {
+		return true, 0
+	}
+	switch br.state {
+	case StateOpen:
+		if wait := br.opened.Add(b.cfg.Cooldown).Sub(b.now()); wait > 0 {
+			return false, wait
+		}
+		br.state = StateHalfOpen
+		br.successes = 0
+	case StateClosed:
+		return true, 0
+	}
+	if br.probing {
+		return false, 0
+	}
+	br.probing = true
+	return true, 0
+}
+
+//Done records outcome of the request allowed by Allow and returns state of the breaker after it
+//wait is how long until the next probe when the breaker is open
+func (b *Breakers) Done(address string, ok bool) (state string, wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, exists := b.breakers[address]
+	if !exists {
+		if ok {
+			return StateClosed, 0
+		}
+		br = &breaker{state: StateClosed}
+		b.breakers[address] = br
+	}
+	if br.state == StateHalfOpen {
+		br.probing = false
+		if !ok {
+			return b.open(br), b.cfg.Cooldown
+		}
+		if br.successes++; br.successes < b.cfg.Probes {
+			return StateHalfOpen, 0
+		}
+		delete(b.breakers, address)
+		return StateClosed, 0
+	}
+	if br.state == StateOpen {
+		//request allowed before the breaker opened, it doesn't change anything
+		return StateOpen, br.opened.Add(b.cfg.Cooldown).Sub(b.now())
+	}
+	if ok {
+		delete(b.breakers, address)
+		return StateClosed, 0
+	}
+	if br.failures++; br.failures >= b.cfg.Threshold {
+		return b.open(br), b.cfg.Cooldown
+	}
+	return StateClosed, 0
+}
+
+func (b *Breakers) open(br *breaker) string {
+	br.state = StateOpen
+	br.opened = b.now()
+	br.failures = 0
+	br.successes = 0
+	return StateOpen
+}
+
+//State returns state of the breaker of the address
+func (b *Breakers) State(address string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.breakers[address]
+	if !ok {
+		return StateClosed
+	}
+	if br.state == StateOpen && !b.now().Before(br.opened.Add(b.cfg.Cooldown)) {
+		return StateHalfOpen
+	}
+	return br.state
+}
@@ -0,0 +1,84 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakers(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := New(Config{Threshold: 2, Cooldown: time.Minute, Probes: 2})
+	b.now = func() time.Time { return now }
+	const addr = "http://localhost:8090/a"
+
+	type step struct {
+		name    string
+		advance time.Duration
+		//done is skipped when allowed is false
+		ok       bool
+		allowed  bool
+		wait     time.Duration
+		expected string
+	}
+	steps := []step{
+		{name: "FIRST_FAILURE", allowed: true, ok: false, expected: StateClosed},
+		{name: "SUCCESS_RESETS", allowed: true, ok: true, expected: StateClosed},
+		{name: "FAILURE_AFTER_RESET", allowed: true, ok: false, expected: StateClosed},
+		{name: "THRESHOLD", allowed: true, ok: false, expected: StateOpen},
+		{name: "FAST_FAIL", advance: 20 * time.Second, allowed: false, wait: 40 * time.Second, expected: StateOpen},
+		{name: "FAILED_PROBE", advance: 40 * time.Second, allowed: true, ok: false, expected: StateOpen},
+		{name: "REOPENED", allowed: false, wait: time.Minute, expected: StateOpen},
+		{name: "FIRST_PROBE", advance: time.Minute, allowed: true, ok: true, expected: StateHalfOpen},
+		{name: "SECOND_PROBE", allowed: true, ok: true, expected: StateClosed},
+	}
+	for _, s := range steps {
+		now = now.Add(s.advance)
+		allowed, wait := b.Allow(addr)
+		if allowed != s.allowed || wait != s.wait {
+			t.Logf("%s: expected [%t] [%s], but got [%t] [%s]", s.name, s.allowed, s.wait, allowed, wait)
+			t.Fail()
+			continue
+		}
+		if allowed {
+			b.Done(addr, s.ok)
+		}
+		if state := b.State(addr); state != s.expected {
+			t.Logf("%s: expected state [%s], but got [%s]", s.name, s.expected, state)
+			t.Fail()
+		}
+	}
+	if len(b.breakers) != 0 {
+		t.Logf("Expected closed breaker to be forgotten, but got [%d] of them", len(b.breakers))
+		t.Fail()
+	}
+}
+
+func TestSingleProbe(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := New(Config{Threshold: 1, Cooldown: time.Minute})
+	b.now = func() time.Time { return now }
+	const addr = "http://localhost:8090/a"
+
+	b.Done(addr, false)
+	if other, _ := b.Allow("http://localhost:8090/b"); !other {
+		t.Logf("Expected other address to be allowed")
+		t.Fail()
+	}
+	now = now.Add(time.Minute)
+	if state := b.State(addr); state != StateHalfOpen {
+		t.Logf("Expected [%s] once cooldown passed, but got [%s]", StateHalfOpen, state)
+		t.Fail()
+	}
+	if probe, _ := b.Allow(addr); !probe {
+		t.Logf("Expected probe to be allowed")
+		t.Fail()
+	}
+	if allowed, wait := b.Allow(addr); allowed || wait != 0 {
+		t.Logf("Expected request to wait for the probe in flight, but got [%t] [%s]", allowed, wait)
+		t.Fail()
+	}
+	if state, _ := b.Done(addr, true); state != StateClosed {
+		t.Logf("Expected [%s] after the probe, but got [%s]", StateClosed, state)
+		t.Fail()
+	}
+}
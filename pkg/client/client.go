@@ -2,22 +2,74 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"github.com/volodimyr/publisher/pkg/egress"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"time"
 )
 
-var (
-	timeout = time.Second * 3
-
-	client = &http.Client{Timeout: timeout}
+const (
+	//DefaultTimeout limits a request which doesn't set its own timeout
+	DefaultTimeout = time.Second * 3
+	//MaxTimeout is the longest timeout a request can set, it also limits connecting to the server
+	MaxTimeout = time.Second * 30
 )
 
+//client is shared by every request, so connections to the same listener are pooled whatever its timeout is
+var client = newClient(nil)
+
+//operator makes requests to the addresses set by the operator, e.g. webhooks, Guard doesn't apply to it
+var operator = newClient(nil)
+
+//Guard makes every following request connect only to the IPs allowed by the policy
+//It should be called on startup, before any request is made, nil policy allows everything
+func Guard(p *egress.Policy) {
+	client = newClient(p)
+}
+
+//newClient never follows redirects, listener is called only at its registered address
+//Proxy isn't used, otherwise policy would check the proxy instead of the listener
+//Client itself has no timeout, every request is limited by the deadline of its context
+func newClient(p *egress.Policy) *http.Client {
+	dialer := &net.Dialer{Timeout: MaxTimeout, KeepAlive: 30 * time.Second}
+	if p != nil {
+		dialer.Control = p.Control
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: MaxTimeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+//DoGET uses for making http GET request to a specific URL
+//request has DefaultTimeout
+//returns nil error if request was sent successfully
+func DoGET(URL string, logger *log.Logger) (*http.Response, error) {
+	resp, err := Do(http.MethodGet, URL, nil, nil, 0, logger)
+	if err != nil {
+		logger.Printf("Couldn't send a request to [%s]: [%v]\n", URL, err)
+		return nil, err
+	}
+	return resp, nil
+}
+
 //DoPOST uses for making http POST request to a specific URL
-//client has set timeout for 3 seconds
+//header is added to the request, it can be nil, Content-Type is application/json unless header sets it
+//request has DefaultTimeout
 //returns nil error if request was sent successfully
-func DoPOST(URL string, body []byte, logger *log.Logger) (*http.Response, error) {
-	resp, err := client.Post(URL, "application /json", bytes.NewBuffer(body))
+func DoPOST(URL string, body []byte, header http.Header, logger *log.Logger) (*http.Response, error) {
+	resp, err := Do(http.MethodPost, URL, body, header, 0, logger)
 	if err != nil {
 		logger.Printf("Couldn't send a request [%s] to server: [%v]\n", string(body), err)
 		return nil, err
@@ -25,6 +77,69 @@ func DoPOST(URL string, body []byte, logger *log.Logger) (*http.Response, error)
 	if resp.StatusCode != http.StatusOK {
 		logger.Printf("Sent message [%s], but listener gave respond with status code: [%d]\n", string(body), resp.StatusCode)
 	}
+	return resp, nil
+}
+
+//Notify makes http POST request with DefaultTimeout to the address set by the operator, e.g. a webhook
+//Such address is trusted, so it isn't checked against the policy set by Guard
+//returns nil error if request was sent successfully
+func Notify(URL string, body []byte, logger *log.Logger) (*http.Response, error) {
+	resp, err := do(operator, http.MethodPost, URL, body, nil, 0, logger)
+	if err != nil {
+		logger.Printf("Couldn't notify [%s]: [%v]\n", URL, err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+//Do makes http request with the method to a specific URL, body can be nil
+//header is added to the request, it can be nil, Content-Type is application/json unless header sets it
+//timeout <= 0 means DefaultTimeout, longer than MaxTimeout is cut to it
+//timeout covers reading the response body as well, so the body must be closed
+func Do(method, URL string, body []byte, header http.Header, timeout time.Duration, logger *log.Logger) (*http.Response, error) {
+	return do(client, method, URL, body, header, timeout, logger)
+}
+
+func do(c *http.Client, method, URL string, body []byte, header http.Header, timeout time.Duration, logger *log.Logger) (*http.Response, error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	if timeout > MaxTimeout {
+		timeout = MaxTimeout
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, URL, reader)
+	if err != nil {
+		logger.Printf("Couldn't create a request to [%s]: [%v]\n", URL, err)
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+//cancelBody releases the request context once the body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
 
-	return resp, err
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"github.com/volodimyr/publisher/pkg/egress"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+var logger = log.New(os.Stdout, "test: ", log.LstdFlags|log.Lshortfile)
+
+func TestGuard(t *testing.T) {
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fake.Close()
+	defer Guard(nil)
+
+	//address is checked again while connecting, whatever was validated on registration
+	policy, err := egress.New(nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Guard(policy)
+	if _, err := DoPOST(fake.URL, []byte("{}"), nil, logger); err == nil {
+		t.Logf("Expected connection to loopback to be refused")
+		t.Fail()
+	}
+	//webhook set by the operator isn't subject to the policy
+	resp, err := Notify(fake.URL, []byte("{}"), logger)
+	if err != nil {
+		t.Logf("Expected operator address to be reached, but got [%v]", err)
+		t.Fail()
+	} else {
+		resp.Body.Close()
+	}
+
+	allowed, err := egress.New([]string{"127.0.0.0/8"}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Guard(allowed)
+	resp, err = DoPOST(fake.URL, []byte("{}"), nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestRedirectNotFollowed(t *testing.T) {
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/", http.StatusFound)
+	}))
+	defer fake.Close()
+
+	resp, err := DoPOST(fake.URL, []byte("{}"), nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Logf("Expected redirect to be returned as is, but got [%d]", resp.StatusCode)
+		t.Fail()
+	}
+}
+
+func TestDo(t *testing.T) {
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Millisecond * 200)
+		}
+		w.Header().Set("X-Method", r.Method)
+	}))
+	defer fake.Close()
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		timeout time.Duration
+		fails   bool
+	}{
+		{name: "PUT", method: http.MethodPut, path: "/"},
+		{name: "DEFAULT_TIMEOUT", method: http.MethodPost, path: "/slow"},
+		{name: "TIMEOUT", method: http.MethodPost, path: "/slow", timeout: time.Millisecond * 50, fails: true},
+		{name: "LONG_TIMEOUT", method: http.MethodPost, path: "/slow", timeout: time.Second},
+	}
+	for _, test := range tests {
+		resp, err := Do(test.method, fake.URL+test.path, []byte("{}"), nil, test.timeout, logger)
+		if (err != nil) != test.fails {
+			t.Logf("%s: expected failure [%t], but got [%v]", test.name, test.fails, err)
+			t.Fail()
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if m := resp.Header.Get("X-Method"); m != test.method {
+			t.Logf("%s: expected method [%s], but got [%s]", test.name, test.method, m)
+			t.Fail()
+		}
+	}
+}
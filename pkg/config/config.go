@@ -0,0 +1,201 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"github.com/volodimyr/publisher/pkg/models"
+	"strings"
+	"time"
+)
+
+//Config holds all runtime settings of the publisher service
+type Config struct {
+	//Addr is the address http server listens on
+	Addr string
+	//Workers is the amount of goroutines delivering messages to listeners, it's the global limit of deliveries in flight
+	Workers int
+	//QueueSize is the amount of deliveries which can wait for a free worker
+	QueueSize int
+	//Retry is the global retry policy, listeners can override it on registration
+	Retry models.RetryPolicy
+	//BreakerThreshold is the amount of consecutive failures which opens the breaker of a listener address, 0 disables breakers
+	//BreakerCooldown is how long deliveries to the open address are parked before a probe, BreakerProbes is the amount
+	//of successful probes which closes the breaker
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	BreakerProbes    int
+	//SuspendAfterFailures and SuspendAfter suspend the listener after that many failed attempts in a row
+	//or once its attempts keep failing for that long, 0 disables the rule
+	//SuspendWebhook is an optional address notified about every suspended listener
+	SuspendAfterFailures int
+	SuspendAfter         time.Duration
+	SuspendWebhook       string
+	//IdempotencyWindow is how long Idempotency-Key of a published message is remembered, 0 disables deduplication
+	IdempotencyWindow time.Duration
+	//PassthroughHeaders are publish request headers forwarded to listeners along with Content-Type
+	PassthroughHeaders []string
+	//DeadLetterCapacity is the amount of given up deliveries kept for inspection and redrive
+	DeadLetterCapacity int
+	//MessageCapacity is the amount of published messages whose delivery log is kept
+	MessageCapacity int
+	//MessageRetention is how long delivery log of a published message is kept, 0 means until capacity is reached
+	MessageRetention time.Duration
+	//ReplayWindow is how long published messages are retained for replay, 0 disables replay
+	ReplayWindow time.Duration
+	//ReplayMaxBytes limits size of the retained bodies per event, 0 means unlimited
+	ReplayMaxBytes int
+	//Storage is either StorageMemory or StorageFile
+	Storage string
+	//DataDir is the directory where StorageFile keeps its snapshot and journal
+	DataDir string
+	//SnapshotInterval is how often StorageFile compacts its journal into the snapshot
+	SnapshotInterval time.Duration
+	//APIKeysFile and JWKSFile enable authentication, api is open when neither is set
+	APIKeysFile string
+	JWKSFile    string
+	//JWTIssuer and JWTAudience are optional, when set tokens must carry them
+	JWTIssuer   string
+	JWTAudience string
+	//EgressAllowCIDRs, EgressDenyCIDRs, EgressAllowHosts and EgressDenyHosts restrict listener addresses,
+	//private and loopback ranges are denied unless they're allowed explicitly, see egress.Policy
+	EgressAllowCIDRs []string
+	EgressDenyCIDRs  []string
+	EgressAllowHosts []string
+	EgressDenyHosts  []string
+	//VerifyListeners makes registration pending until the listener echoes the challenge
+	VerifyListeners bool
+	//VerificationExpiry is how long registration stays pending, VerificationInterval is the delay between attempts
+	VerificationExpiry   time.Duration
+	VerificationInterval time.Duration
+}
+
+//AuthEnabled reports whether api requires authentication
+func (c *Config) AuthEnabled() bool {
+	return c.APIKeysFile != "" || c.JWKSFile != ""
+}
+
+const (
+	//StorageMemory keeps registrations in memory only, they are lost on restart
+	StorageMemory = "memory"
+	//StorageFile keeps registrations on disk, they are replayed on startup
+	StorageFile = "file"
+)
+
+//Parse builds Config from command line arguments, e.g. os.Args[1:]
+//Omitted flags fall back to their default values
+func Parse(args []string) (*Config, error) {
+	c := &Config{}
+	fs := flag.NewFlagSet("publisher", flag.ContinueOnError)
+	fs.StringVar(&c.Addr, "addr", ":8080", "address the http server listens on")
+	fs.IntVar(&c.Workers, "workers", 10, "number of delivery workers, it's the global limit of deliveries in flight")
+	fs.IntVar(&c.QueueSize, "queue-size", 1000, "number of deliveries waiting for a free worker")
+	var initial, maxInterval, maxAge time.Duration
+	fs.IntVar(&c.Retry.MaxAttempts, "retry-max-attempts", 5, "number of delivery attempts before the message is given up")
+	fs.DurationVar(&initial, "retry-initial-interval", time.Second, "delay before the first retry")
+	fs.DurationVar(&maxInterval, "retry-max-interval", time.Minute, "upper limit of the delay between retries")
+	fs.Float64Var(&c.Retry.Multiplier, "retry-multiplier", 2, "growth factor of the delay between retries")
+	fs.Float64Var(&c.Retry.Jitter, "retry-jitter", 0.2, "random deviation of the delay as a fraction of it, in range [0, 1]")
+	fs.DurationVar(&maxAge, "retry-max-age", time.Hour, "message isn't retried once it's older than this")
+	fs.IntVar(&c.BreakerThreshold, "breaker-threshold", 5, "consecutive failures of a listener address which park its deliveries, 0 disables circuit breakers")
+	fs.DurationVar(&c.BreakerCooldown, "breaker-cooldown", 30*time.Second, "how long deliveries to the failing address are parked before a probe request")
+	fs.IntVar(&c.BreakerProbes, "breaker-probes", 1, "successful probe requests in a row which resume deliveries to the address")
+	fs.IntVar(&c.SuspendAfterFailures, "suspend-after-failures", 0, "failed attempts in a row which suspend the listener, 0 disables the rule")
+	fs.DurationVar(&c.SuspendAfter, "suspend-after", 0, "how long attempts to the listener keep failing before it's suspended, 0 disables the rule")
+	fs.StringVar(&c.SuspendWebhook, "suspend-webhook", "", "address notified with a POST about every suspended listener")
+	fs.IntVar(&c.DeadLetterCapacity, "deadletter-capacity", 10000, "number of given up deliveries kept, the oldest are evicted first")
+	fs.IntVar(&c.MessageCapacity, "message-capacity", 10000, "number of published messages whose delivery log is kept, the oldest are evicted first")
+	fs.DurationVar(&c.MessageRetention, "message-retention", 24*time.Hour, "how long delivery log of a published message is kept, 0 means until capacity is reached")
+	fs.DurationVar(&c.ReplayWindow, "replay-window", time.Hour, "how long published messages are retained for replay, 0 disables replay")
+	fs.IntVar(&c.ReplayMaxBytes, "replay-max-bytes", 10<<20, "size of the retained bodies per event, the oldest are dropped first, 0 means unlimited")
+	fs.StringVar(&c.Storage, "storage", StorageMemory, "registry storage, either \"memory\" or \"file\"")
+	fs.StringVar(&c.DataDir, "data-dir", "data", "directory of the file storage")
+	fs.DurationVar(&c.SnapshotInterval, "snapshot-interval", time.Minute*5, "how often the file storage compacts its journal into a snapshot")
+	fs.StringVar(&c.APIKeysFile, "api-keys-file", "", "json file of API keys with their scopes, enables authentication")
+	fs.StringVar(&c.JWKSFile, "jwks-file", "", "json web key set verifying HS256 and RS256 tokens, enables authentication")
+	fs.StringVar(&c.JWTIssuer, "jwt-issuer", "", "required \"iss\" claim of the tokens")
+	fs.StringVar(&c.JWTAudience, "jwt-audience", "", "required \"aud\" claim of the tokens")
+	fs.DurationVar(&c.IdempotencyWindow, "idempotency-window", 24*time.Hour, "how long Idempotency-Key of a published message is remembered, 0 disables deduplication")
+	var passthrough, allowCIDRs, denyCIDRs, allowHosts, denyHosts string
+	fs.StringVar(&passthrough, "passthrough-headers", "", "comma separated publish request headers forwarded to listeners, e.g. X-Request-Id,X-Tenant")
+	fs.StringVar(&allowCIDRs, "egress-allow-cidrs", "", "comma separated CIDRs listeners can be in even if they're private, e.g. 10.0.0.0/8")
+	fs.StringVar(&denyCIDRs, "egress-deny-cidrs", "", "comma separated CIDRs listeners can never be in")
+	fs.StringVar(&allowHosts, "egress-allow-hosts", "", "comma separated hosts listeners are limited to, e.g. hooks.example.com,*.example.org")
+	fs.StringVar(&denyHosts, "egress-deny-hosts", "", "comma separated hosts listeners can never be at")
+	fs.BoolVar(&c.VerifyListeners, "verify-listeners", false, "register listeners only once they echo the verification challenge")
+	fs.DurationVar(&c.VerificationExpiry, "verification-expiry", 10*time.Minute, "how long registration waits for the listener to confirm it")
+	fs.DurationVar(&c.VerificationInterval, "verification-interval", 30*time.Second, "delay between verification attempts")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	c.PassthroughHeaders = list(passthrough)
+	c.EgressAllowCIDRs = list(allowCIDRs)
+	c.EgressDenyCIDRs = list(denyCIDRs)
+	c.EgressAllowHosts = list(allowHosts)
+	c.EgressDenyHosts = list(denyHosts)
+	c.Retry.InitialInterval = models.Duration(initial)
+	c.Retry.MaxInterval = models.Duration(maxInterval)
+	c.Retry.MaxAge = models.Duration(maxAge)
+	if err := c.Retry.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Workers <= 0 {
+		return nil, fmt.Errorf("workers must be positive, got [%d]", c.Workers)
+	}
+	if c.QueueSize <= 0 {
+		return nil, fmt.Errorf("queue-size must be positive, got [%d]", c.QueueSize)
+	}
+	if c.Storage != StorageMemory && c.Storage != StorageFile {
+		return nil, fmt.Errorf("unknown storage [%s]", c.Storage)
+	}
+	if c.Storage == StorageFile && c.DataDir == "" {
+		return nil, fmt.Errorf("data-dir must be set for the file storage")
+	}
+	if c.JWKSFile == "" && (c.JWTIssuer != "" || c.JWTAudience != "") {
+		return nil, fmt.Errorf("jwt-issuer and jwt-audience require jwks-file")
+	}
+	if c.IdempotencyWindow < 0 {
+		return nil, fmt.Errorf("idempotency-window must not be negative, got [%s]", c.IdempotencyWindow)
+	}
+	if c.VerificationExpiry <= 0 || c.VerificationInterval <= 0 {
+		return nil, fmt.Errorf("verification-expiry and verification-interval must be positive")
+	}
+	if c.BreakerThreshold < 0 {
+		return nil, fmt.Errorf("breaker-threshold must not be negative, got [%d]", c.BreakerThreshold)
+	}
+	if c.BreakerCooldown <= 0 || c.BreakerProbes <= 0 {
+		return nil, fmt.Errorf("breaker-cooldown and breaker-probes must be positive")
+	}
+	if c.SuspendAfterFailures < 0 || c.SuspendAfter < 0 {
+		return nil, fmt.Errorf("suspend-after-failures and suspend-after must not be negative")
+	}
+	if c.SuspendWebhook != "" && c.SuspendAfterFailures == 0 && c.SuspendAfter == 0 {
+		return nil, fmt.Errorf("suspend-webhook requires suspend-after-failures or suspend-after")
+	}
+	if c.DeadLetterCapacity <= 0 {
+		return nil, fmt.Errorf("deadletter-capacity must be positive, got [%d]", c.DeadLetterCapacity)
+	}
+	if c.MessageCapacity <= 0 {
+		return nil, fmt.Errorf("message-capacity must be positive, got [%d]", c.MessageCapacity)
+	}
+	if c.MessageRetention < 0 {
+		return nil, fmt.Errorf("message-retention must not be negative, got [%s]", c.MessageRetention)
+	}
+	if c.ReplayWindow < 0 {
+		return nil, fmt.Errorf("replay-window must not be negative, got [%s]", c.ReplayWindow)
+	}
+	if c.ReplayMaxBytes < 0 {
+		return nil, fmt.Errorf("replay-max-bytes must not be negative, got [%d]", c.ReplayMaxBytes)
+	}
+	return c, nil
+}
+
+//list splits comma separated flag value, empty value gives empty list
+func list(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
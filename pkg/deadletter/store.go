@@ -0,0 +1,151 @@
+package deadletter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/models"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//DefaultCapacity is the amount of records kept when capacity isn't set
+const DefaultCapacity = 10000
+
+//Record is a delivery which exhausted its retry policy
+//Secrets, Header and delivery options of the listener are kept for redrive only, they're never responded with
+type Record struct {
+	dispatcher.Delivery
+	ID   string
+	Died time.Time
+}
+
+//MarshalJSON responds with the delivery and its attempts
+//Body is embedded as is when it's a valid json, otherwise as a string
+func (r Record) MarshalJSON() ([]byte, error) {
+	body := json.RawMessage(r.Body)
+	if !json.Valid(r.Body) {
+		body, _ = json.Marshal(string(r.Body))
+	}
+	return json.Marshal(struct {
+		ID        string               `json:"id"`
+		MessageID string               `json:"message_id,omitempty"`
+		Event     string               `json:"event"`
+		Listener  string               `json:"listener"`
+		Address   string               `json:"address"`
+		Retry     *models.RetryPolicy  `json:"retry,omitempty"`
+		Attempts  []dispatcher.Attempt `json:"attempts"`
+		LastError string               `json:"last_error"`
+		Created   time.Time            `json:"created"`
+		Died      time.Time            `json:"died"`
+		Body      json.RawMessage      `json:"body"`
+	}{ID: r.ID, MessageID: r.MessageID, Event: r.Event, Listener: r.Name, Address: r.Address, Retry: r.Retry, Attempts: r.Attempts, LastError: r.LastError(),
+		Created: r.Created, Died: r.Died, Body: body})
+}
+
+//Redelivery converts record back into a fresh delivery with empty attempt history
+func (r *Record) Redelivery() dispatcher.Delivery {
+	dl := r.Delivery
+	dl.Attempts = nil
+	dl.Created = time.Time{}
+	return dl
+}
+
+//Store keeps dead letters in memory
+//When capacity is reached the oldest record is evicted
+//It is safe for concurrent use
+type Store struct {
+	mu       sync.RWMutex
+	logger   *log.Logger
+	capacity int
+	records  map[string]Record
+	order    []string
+}
+
+//New creates empty Store, capacity <= 0 means DefaultCapacity
+//if logger == nil, default will be taken
+func New(logger *log.Logger, capacity int) *Store {
+	if logger == nil {
+		logger = log.New(os.Stdout, "deadletter: ", log.LstdFlags|log.Lshortfile)
+	}
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Store{logger: logger, capacity: capacity, records: make(map[string]Record)}
+}
+
+//Put stores given up delivery, it implements dispatcher.DeadLetters
+func (s *Store) Put(dl dispatcher.Delivery) {
+	r := Record{Delivery: dl, ID: newID(), Died: time.Now()}
+	s.add(r)
+	s.logger.Printf("Dead letter [%s] stored for the listener [%s] of the event [%s]\n", r.ID, r.Name, r.Event)
+}
+
+//Restore puts back record which has been taken, e.g. when it couldn't be redriven, it keeps its id
+func (s *Store) Restore(r Record) {
+	s.add(r)
+}
+
+func (s *Store) add(r Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.order) >= s.capacity {
+		delete(s.records, s.order[0])
+		s.logger.Printf("Dead letter [%s] evicted, capacity [%d] is reached\n", s.order[0], s.capacity)
+		s.order = s.order[1:]
+	}
+	s.records[r.ID] = r
+	s.order = append(s.order, r.ID)
+}
+
+//List returns all records, the oldest first
+func (s *Store) List() []Record {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Record, 0, len(s.records))
+	for _, id := range s.order {
+		list = append(list, s.records[id])
+	}
+	return list
+}
+
+//Get returns record by its id
+func (s *Store) Get(id string) (Record, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.records[id]
+	return r, ok
+}
+
+//Remove deletes record by its id, returns false if there was no such record
+func (s *Store) Remove(id string) bool {
+	_, ok := s.Take(id)
+	return ok
+}
+
+//Take removes record by its id and returns it, so only one of the concurrent callers gets it
+func (s *Store) Take(id string) (Record, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[id]
+	if !ok {
+		return Record{}, false
+	}
+	delete(s.records, id)
+	for i, v := range s.order {
+		if v == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return r, true
+}
+
+func newID() string {
+	bs := make([]byte, 8)
+	rand.Read(bs)
+	return hex.EncodeToString(bs)
+}
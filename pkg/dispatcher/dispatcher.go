@@ -0,0 +1,640 @@
+package dispatcher
+
+import (
+	"errors"
+	"fmt"
+	"github.com/volodimyr/publisher/pkg/breaker"
+	"github.com/volodimyr/publisher/pkg/client"
+	"github.com/volodimyr/publisher/pkg/filter"
+	"github.com/volodimyr/publisher/pkg/models"
+	"github.com/volodimyr/publisher/pkg/signature"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//DefaultWorkers is the amount of delivery workers used when Config.Workers isn't set
+	DefaultWorkers = 10
+	//DefaultQueueSize is the capacity of the delivery queue used when Config.QueueSize isn't set
+	DefaultQueueSize = 1000
+	//DefaultContentType is sent when publisher didn't set Content-Type
+	DefaultContentType = "application/json"
+	//SnippetSize is the amount of response body bytes kept with the attempt
+	SnippetSize = 256
+	//DrainSize is the amount of response body bytes read after the snippet, so the connection can be reused
+	//Longer body isn't worth reading, the connection is closed instead
+	DrainSize = 64 << 10
+)
+
+//Metadata headers are added by the publisher to every delivery
+const (
+	HeaderEvent     = "Publisher-Event"
+	HeaderMessageID = "Publisher-Message-Id"
+	HeaderAttempt   = "Publisher-Attempt"
+	HeaderTimestamp = "Publisher-Timestamp"
+)
+
+//DefaultRetry is the retry policy used when Config.Retry isn't set
+var DefaultRetry = models.RetryPolicy{
+	MaxAttempts:     5,
+	InitialInterval: models.Duration(time.Second),
+	MaxInterval:     models.Duration(time.Minute),
+	Multiplier:      2,
+	Jitter:          0.2,
+	MaxAge:          models.Duration(time.Hour),
+}
+
+var (
+	//ErrQueueFull is returned when the delivery queue has no free slots left
+	ErrQueueFull = errors.New("dispatcher: delivery queue is full")
+	//ErrStopped is returned when delivery is enqueued into stopped dispatcher
+	ErrStopped = errors.New("dispatcher: stopped")
+	//ErrFiltered is returned when delivery doesn't match the listener's filter and therefore is dropped
+	ErrFiltered = errors.New("dispatcher: filtered out")
+)
+
+//Delivery is a single message addressed to a single listener
+//Listener is the listener as it was when the message was published, its options apply to every attempt:
+//Retry overrides Config.Retry, Filter is evaluated against Body and Header when delivery is enqueued,
+//every attempt is signed with Secrets and a fresh timestamp, MaxConcurrency limits deliveries to the listener
+//with the same Name in flight at once, Ordered deliveries to the listener with the same Name and value of PartitionKey
+//are made one by one in enqueue order, and Timeout, Method and SuccessCodes define the request
+//Event is the published event, it hides Listener.Event which may be a pattern
+//Header is the publish request header, Content-Type and allowed headers are passed to the listener
+//Attempts and Created are maintained by the dispatcher
+type Delivery struct {
+	models.Listener
+	MessageID string
+	Event     string
+	Body      []byte
+	Header    http.Header
+
+	Attempts []Attempt
+	Created  time.Time
+
+	//lane is the ordering key of Ordered delivery, it's set on enqueue
+	lane string
+}
+
+//NewDelivery creates delivery of the message with the id to the listener
+func NewDelivery(id, event string, l models.Listener, body []byte, header http.Header) Delivery {
+	return Delivery{Listener: l, MessageID: id, Event: event, Body: body, Header: header}
+}
+
+//Attempt describes outcome of a single delivery attempt
+//Status is 0 when listener couldn't be reached
+//Response is the beginning of the response body, at most SnippetSize bytes
+type Attempt struct {
+	Time     time.Time       `json:"time"`
+	Status   int             `json:"status,omitempty"`
+	Latency  models.Duration `json:"latency"`
+	Response string          `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+//LastError returns error of the latest attempt or empty string if there were no attempts
+func (dl *Delivery) LastError() string {
+	if len(dl.Attempts) == 0 {
+		return ""
+	}
+	return dl.Attempts[len(dl.Attempts)-1].Error
+}
+
+//DeadLetters receives deliveries which exhausted their retry policy
+type DeadLetters interface {
+	Put(dl Delivery)
+}
+
+//Observer is notified after every delivery attempt, the attempt is the last one of dl.Attempts
+//final is true when delivery succeeded or has been given up, otherwise it's going to be retried
+//It's called by the workers, so it should return quickly
+type Observer interface {
+	Attempted(dl Delivery, final bool)
+}
+
+//Observers notifies every observer in turn
+type Observers []Observer
+
+//Attempted implements Observer
+func (o Observers) Attempted(dl Delivery, final bool) {
+	for _, obs := range o {
+		obs.Attempted(dl, final)
+	}
+}
+
+//Config defines size of the worker pool, the delivery queue and the global retry policy
+//Zero values are replaced with defaults
+//DeadLetters is optional, without it given up deliveries are only logged
+//Passthrough lists publish request headers which are forwarded to listeners along with Content-Type
+//Observer is optional, it's notified about outcome of every attempt
+//Breakers is optional, without it listeners are attempted no matter how many times they failed
+type Config struct {
+	Workers     int
+	QueueSize   int
+	Retry       models.RetryPolicy
+	DeadLetters DeadLetters
+	Passthrough []string
+	Observer    Observer
+	Breakers    *breaker.Breakers
+}
+
+//Dispatcher delivers queued messages to listeners using a pool of workers
+//Every worker makes a single request at a time, so the amount of workers is the global limit of deliveries in flight
+//It is the only place where network I/O to the listeners happens
+type Dispatcher struct {
+	//backlog is the amount of deliveries parked by limits and breakers or waiting in lanes, they take room in the queue
+	//it's the first field, so it's 64-bit aligned for atomic access
+	backlog int64
+
+	logger *log.Logger
+	queue  chan Delivery
+	retry  models.RetryPolicy
+	dead   DeadLetters
+	obs    Observer
+	cb     *breaker.Breakers
+	pass   []string
+	quit   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	filters map[string]*filter.Expr
+	paths   map[string]*filter.Path
+
+	lmu    sync.Mutex
+	limits map[string]*limit
+
+	omu   sync.Mutex
+	lanes map[string]*lane
+
+	//bmu is held around every call to cb, so delivery can't be parked after the probe has released its address
+	bmu    sync.Mutex
+	parked map[string]*parking
+}
+
+//limit tracks deliveries to a listener with MaxConcurrency
+//Deliveries over the limit are parked instead of blocking the worker, they're taken over by the worker which frees the slot
+type limit struct {
+	active int
+	parked []Delivery
+}
+
+//lane holds ordered deliveries waiting for the one in flight, lane exists while any of its deliveries is in flight
+type lane struct {
+	waiting []Delivery
+}
+
+//parking holds deliveries to the address whose breaker isn't closed
+//woken is set while a timer is going to release the next probe
+type parking struct {
+	deliveries []Delivery
+	woken      bool
+}
+
+//New creates Dispatcher and starts its workers
+//if logger == nil, default will be taken
+func New(logger *log.Logger, cfg Config) *Dispatcher {
+	if logger == nil {
+		logger = log.New(os.Stdout, "dispatcher: ", log.LstdFlags|log.Lshortfile)
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultWorkers
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	d := &Dispatcher{
+		logger: logger,
+		queue:  make(chan Delivery, cfg.QueueSize),
+		retry:  DefaultRetry.Merge(&cfg.Retry),
+		dead:   cfg.DeadLetters,
+		obs:    cfg.Observer,
+		cb:     cfg.Breakers,
+		pass:   canonical(cfg.Passthrough),
+		quit:   make(chan struct{}),
+
+		filters: make(map[string]*filter.Expr),
+		paths:   make(map[string]*filter.Path),
+		limits:  make(map[string]*limit),
+		lanes:   make(map[string]*lane),
+		parked:  make(map[string]*parking),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	logger.Printf("Dispatcher is online with [%d] workers\n", cfg.Workers)
+	return d
+}
+
+//Enqueue puts delivery into the queue without blocking
+//Ordered delivery waits in its lane instead while the previous one of the lane isn't done
+//returns ErrQueueFull if there is no room for it, parked and waiting deliveries count as queued
+//and ErrFiltered if delivery has never been attempted and doesn't match its filter
+func (d *Dispatcher) Enqueue(dl Delivery) error {
+	if dl.Created.IsZero() {
+		dl.Created = time.Now()
+	}
+	select {
+	case <-d.quit:
+		return ErrStopped
+	default:
+	}
+	if len(dl.Attempts) == 0 && !d.matches(dl) {
+		return ErrFiltered
+	}
+	if len(d.queue)+int(atomic.LoadInt64(&d.backlog)) >= cap(d.queue) {
+		return ErrQueueFull
+	}
+	if dl.Ordered {
+		dl.lane = d.laneOf(dl)
+		d.omu.Lock()
+		if l, ok := d.lanes[dl.lane]; ok {
+			l.waiting = append(l.waiting, dl)
+			atomic.AddInt64(&d.backlog, 1)
+			d.omu.Unlock()
+			return nil
+		}
+		d.lanes[dl.lane] = &lane{}
+		d.omu.Unlock()
+	}
+	select {
+	case d.queue <- dl:
+		return nil
+	default:
+		if dl.Ordered {
+			d.advance(dl.lane)
+		}
+		return ErrQueueFull
+	}
+}
+
+//laneOf returns ordering key of the delivery, message without the partition key falls into the same lane
+func (d *Dispatcher) laneOf(dl Delivery) string {
+	if dl.PartitionKey == "" {
+		return dl.Name
+	}
+	d.mu.Lock()
+	p, ok := d.paths[dl.PartitionKey]
+	if !ok {
+		var err error
+		if p, err = filter.CompilePath(dl.PartitionKey); err != nil {
+			d.mu.Unlock()
+			d.logger.Printf("Couldn't compile partition key of the listener [%s] [%v]\n", dl.Name, err)
+			return dl.Name
+		}
+		d.paths[dl.PartitionKey] = p
+	}
+	d.mu.Unlock()
+	v, _ := p.Value(dl.Body, dl.Header)
+	return dl.Name + "\x00" + v
+}
+
+//advance queues the next delivery waiting in the lane or removes the lane when there is none
+//It doesn't block, the next delivery waits for room in the queue on its own like a retry does
+func (d *Dispatcher) advance(key string) {
+	d.omu.Lock()
+	l, ok := d.lanes[key]
+	if !ok {
+		d.omu.Unlock()
+		return
+	}
+	if len(l.waiting) == 0 {
+		delete(d.lanes, key)
+		d.omu.Unlock()
+		return
+	}
+	next := l.waiting[0]
+	l.waiting = l.waiting[1:]
+	atomic.AddInt64(&d.backlog, -1)
+	d.omu.Unlock()
+	go func() {
+		select {
+		case d.queue <- next:
+		case <-d.quit:
+		}
+	}()
+}
+
+//done is called once delivery succeeded or has been given up
+func (d *Dispatcher) done(dl Delivery) {
+	d.observe(dl, true)
+	if dl.lane != "" {
+		d.advance(dl.lane)
+	}
+}
+
+//Stop stops all workers and waits until in-flight deliveries are finished
+//Deliveries which are still queued are dropped
+func (d *Dispatcher) Stop() {
+	d.once.Do(func() {
+		close(d.quit)
+	})
+	d.wg.Wait()
+	d.logger.Printf("Dispatcher is offline, dropped [%d] queued deliveries\n", len(d.queue))
+}
+
+//matches evaluates filter of the delivery, compiled filters are cached by their source
+//Filter which can't be compiled drops nothing, filters are validated on registration
+func (d *Dispatcher) matches(dl Delivery) bool {
+	if dl.Filter == "" {
+		return true
+	}
+	d.mu.Lock()
+	expr, ok := d.filters[dl.Filter]
+	if !ok {
+		var err error
+		if expr, err = filter.Compile(dl.Filter); err != nil {
+			d.mu.Unlock()
+			d.logger.Printf("Couldn't compile filter of the listener [%s] [%v]\n", dl.Name, err)
+			return true
+		}
+		d.filters[dl.Filter] = expr
+	}
+	d.mu.Unlock()
+	return expr.Match(dl.Body, dl.Header)
+}
+
+func (d *Dispatcher) worker() {
+	defer d.wg.Done()
+	for {
+		select {
+		case dl := <-d.queue:
+			d.process(dl)
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+//process delivers dl and then every delivery parked behind it while the listener was at its limit
+func (d *Dispatcher) process(dl Delivery) {
+	held, parked := d.acquire(dl)
+	if parked {
+		return
+	}
+	for {
+		d.deliver(dl)
+		if !held {
+			return
+		}
+		//parked delivery takes over the slot, even if its listener isn't limited anymore
+		next, ok := d.release(dl.Name)
+		if !ok {
+			return
+		}
+		select {
+		case <-d.quit:
+			return
+		default:
+		}
+		dl = next
+	}
+}
+
+//acquire takes a slot of the listener with MaxConcurrency, it parks the delivery if there is none
+func (d *Dispatcher) acquire(dl Delivery) (held, parked bool) {
+	if dl.MaxConcurrency <= 0 {
+		return false, false
+	}
+	d.lmu.Lock()
+	defer d.lmu.Unlock()
+	l, ok := d.limits[dl.Name]
+	if !ok {
+		l = &limit{}
+		d.limits[dl.Name] = l
+	}
+	if l.active >= dl.MaxConcurrency {
+		l.parked = append(l.parked, dl)
+		atomic.AddInt64(&d.backlog, 1)
+		return false, true
+	}
+	l.active++
+	return true, false
+}
+
+//release frees a slot of the listener or hands it over to the oldest parked delivery which is returned
+func (d *Dispatcher) release(name string) (Delivery, bool) {
+	d.lmu.Lock()
+	defer d.lmu.Unlock()
+	l, ok := d.limits[name]
+	if !ok {
+		return Delivery{}, false
+	}
+	if len(l.parked) > 0 {
+		next := l.parked[0]
+		l.parked = l.parked[1:]
+		atomic.AddInt64(&d.backlog, -1)
+		return next, true
+	}
+	l.active--
+	if l.active <= 0 {
+		delete(d.limits, name)
+	}
+	return Delivery{}, false
+}
+
+func (d *Dispatcher) deliver(dl Delivery) {
+	if !d.admit(dl) {
+		return
+	}
+	a := Attempt{Time: time.Now()}
+	d.logger.Printf("Sending event [%s] to the next listener: [%s] at [%s], attempt [%d]\n", dl.Event, dl.Name, dl.Address, len(dl.Attempts)+1)
+	method := dl.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	resp, err := client.Do(method, dl.Address, dl.Body, d.header(dl, a.Time), time.Duration(dl.Timeout), d.logger)
+	a.Latency = models.Duration(time.Since(a.Time))
+	if err != nil {
+		a.Error = err.Error()
+	} else {
+		snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, SnippetSize))
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, DrainSize))
+		resp.Body.Close()
+		a.Response = string(snippet)
+		a.Status = resp.StatusCode
+		if !models.Accepted(dl.SuccessCodes, resp.StatusCode) {
+			a.Error = fmt.Sprintf("unexpected status code [%d]", resp.StatusCode)
+		}
+	}
+	if a.Error != "" {
+		d.logger.Printf("Attempt to deliver event [%s] to the listener [%s] failed [%s]\n", dl.Event, dl.Name, a.Error)
+	}
+	d.settle(dl.Address, a.Status != 0 && a.Status < http.StatusInternalServerError)
+	dl.Attempts = append(dl.Attempts, a)
+	if a.Error == "" {
+		d.done(dl)
+		return
+	}
+	d.reschedule(dl)
+}
+
+//admit asks the breaker of the address whether dl can be attempted
+//otherwise dl is parked without an attempt until the breaker lets a probe through
+func (d *Dispatcher) admit(dl Delivery) bool {
+	if d.cb == nil {
+		return true
+	}
+	d.bmu.Lock()
+	defer d.bmu.Unlock()
+	allowed, wait := d.cb.Allow(dl.Address)
+	if allowed {
+		return true
+	}
+	p, ok := d.parked[dl.Address]
+	if !ok {
+		p = &parking{}
+		d.parked[dl.Address] = p
+	}
+	p.deliveries = append(p.deliveries, dl)
+	atomic.AddInt64(&d.backlog, 1)
+	if wait > 0 {
+		d.wake(dl.Address, p, wait)
+	}
+	return false
+}
+
+//settle records outcome of the attempt with the breaker of the address
+//reached is false when listener couldn't be reached or failed on its side, other responses mean it's up
+//Parked deliveries are released all at once when the breaker closes, otherwise one by one as probes
+func (d *Dispatcher) settle(address string, reached bool) {
+	if d.cb == nil {
+		return
+	}
+	d.bmu.Lock()
+	defer d.bmu.Unlock()
+	state, wait := d.cb.Done(address, reached)
+	p, ok := d.parked[address]
+	if !ok {
+		return
+	}
+	switch state {
+	case breaker.StateClosed:
+		d.unpark(address, len(p.deliveries))
+	case breaker.StateHalfOpen:
+		d.unpark(address, 1)
+	default:
+		d.wake(address, p, wait)
+	}
+}
+
+//wake releases the next probe of the address once the breaker is going to allow it
+func (d *Dispatcher) wake(address string, p *parking, wait time.Duration) {
+	if p.woken {
+		return
+	}
+	p.woken = true
+	d.logger.Printf("Listener at [%s] keeps failing, its deliveries are parked for [%s]\n", address, wait)
+	time.AfterFunc(wait, func() {
+		d.bmu.Lock()
+		defer d.bmu.Unlock()
+		p.woken = false
+		d.unpark(address, 1)
+	})
+}
+
+//unpark queues n oldest deliveries parked at the address, bmu must be held
+func (d *Dispatcher) unpark(address string, n int) {
+	p, ok := d.parked[address]
+	if !ok {
+		return
+	}
+	if n > len(p.deliveries) {
+		n = len(p.deliveries)
+	}
+	released := p.deliveries[:n:n]
+	p.deliveries = p.deliveries[n:]
+	atomic.AddInt64(&d.backlog, -int64(n))
+	if len(p.deliveries) == 0 && !p.woken {
+		delete(d.parked, address)
+	}
+	for _, dl := range released {
+		go func(dl Delivery) {
+			select {
+			case d.queue <- dl:
+			case <-d.quit:
+			}
+		}(dl)
+	}
+}
+
+func (d *Dispatcher) observe(dl Delivery, final bool) {
+	if d.obs != nil {
+		d.obs.Attempted(dl, final)
+	}
+}
+
+//header builds headers of the delivery attempt made at t
+//Metadata and signature are set last, so they can't be spoofed by passthrough headers
+func (d *Dispatcher) header(dl Delivery, t time.Time) http.Header {
+	h := make(http.Header)
+	for _, name := range d.pass {
+		if v, ok := dl.Header[name]; ok {
+			h[name] = v
+		}
+	}
+	h.Set("Content-Type", DefaultContentType)
+	if ct := dl.Header.Get("Content-Type"); ct != "" {
+		h.Set("Content-Type", ct)
+	}
+	h.Set(HeaderEvent, dl.Event)
+	h.Set(HeaderAttempt, strconv.Itoa(len(dl.Attempts)+1))
+	h.Set(HeaderTimestamp, strconv.FormatInt(t.Unix(), 10))
+	if dl.MessageID != "" {
+		h.Set(HeaderMessageID, dl.MessageID)
+	}
+	if len(dl.Secrets) > 0 {
+		h.Set(signature.Header, signature.Generate(dl.Secrets, t, dl.Body))
+	}
+	return h
+}
+
+func canonical(names []string) []string {
+	canonical := make([]string, 0, len(names))
+	for _, name := range names {
+		canonical = append(canonical, http.CanonicalHeaderKey(name))
+	}
+	return canonical
+}
+
+//reschedule puts failed delivery back into the queue after the backoff delay
+//or gives it up when the retry policy is exhausted
+func (d *Dispatcher) reschedule(dl Delivery) {
+	policy := d.retry.Merge(dl.Retry)
+	delay := policy.Backoff(len(dl.Attempts), rand.Float64())
+	if len(dl.Attempts) >= policy.MaxAttempts {
+		d.logger.Printf("Gave up delivery of event [%s] to the listener [%s] after [%d] attempts\n", dl.Event, dl.Name, len(dl.Attempts))
+		d.giveUp(dl)
+		return
+	}
+	if policy.MaxAge > 0 && time.Since(dl.Created)+delay > time.Duration(policy.MaxAge) {
+		d.logger.Printf("Gave up delivery of event [%s] to the listener [%s], it's older than [%s]\n", dl.Event, dl.Name, time.Duration(policy.MaxAge))
+		d.giveUp(dl)
+		return
+	}
+	d.observe(dl, false)
+	d.logger.Printf("Retrying delivery of event [%s] to the listener [%s] in [%s]\n", dl.Event, dl.Name, delay)
+	time.AfterFunc(delay, func() {
+		select {
+		case d.queue <- dl:
+		case <-d.quit:
+		}
+	})
+}
+
+//giveUp dead letters the delivery before the next ordered one is let through
+func (d *Dispatcher) giveUp(dl Delivery) {
+	if d.dead != nil {
+		d.dead.Put(dl)
+	}
+	d.done(dl)
+}
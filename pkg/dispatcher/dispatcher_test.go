@@ -0,0 +1,736 @@
+package dispatcher
+
+import (
+	"github.com/volodimyr/publisher/pkg/breaker"
+	"github.com/volodimyr/publisher/pkg/models"
+	"github.com/volodimyr/publisher/pkg/signature"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var logger = log.New(os.Stdout, "test: ", log.LstdFlags|log.Lshortfile)
+
+func TestEnqueueDelivers(t *testing.T) {
+	received := make(chan string, 3)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		bs, _ := ioutil.ReadAll(r.Body)
+		received <- string(bs)
+	}))
+	defer fake.Close()
+	d := New(logger, Config{Workers: 2})
+	defer d.Stop()
+
+	for _, body := range []string{"1", "2", "3"} {
+		if err := d.Enqueue(Delivery{Listener: models.Listener{Name: "fake", Address: fake.URL}, Event: "event", Body: []byte(body)}); err != nil {
+			t.Fatalf("Expected delivery to be queued, but got [%v]", err)
+		}
+	}
+
+	got := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		select {
+		case body := <-received:
+			got[body] = true
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Expected [3] deliveries, but got [%d]", len(got))
+		}
+	}
+	if len(got) != 3 {
+		t.Logf("Expected [3] distinct deliveries, but got [%v]", got)
+		t.Fail()
+	}
+}
+
+func TestEnqueueQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer fake.Close()
+	d := New(logger, Config{Workers: 1, QueueSize: 1})
+	defer d.Stop()
+	defer close(block)
+
+	var err error
+	//one delivery is taken by the worker, one waits in the queue, the rest can't fit
+	for i := 0; i < 5 && err == nil; i++ {
+		err = d.Enqueue(Delivery{Listener: models.Listener{Name: "fake", Address: fake.URL}, Event: "event", Body: []byte("{}")})
+	}
+	if err != ErrQueueFull {
+		t.Logf("Expected [%v], but got [%v]", ErrQueueFull, err)
+		t.Fail()
+	}
+}
+
+func TestEnqueueStopped(t *testing.T) {
+	d := New(logger, Config{})
+	d.Stop()
+
+	if err := d.Enqueue(Delivery{Event: "event"}); err != ErrStopped {
+		t.Logf("Expected [%v], but got [%v]", ErrStopped, err)
+		t.Fail()
+	}
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	var calls int32
+	done := make(chan struct{})
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		close(done)
+	}))
+	defer fake.Close()
+	d := New(logger, Config{Workers: 1, Retry: models.RetryPolicy{InitialInterval: models.Duration(time.Millisecond * 10)}})
+	defer d.Stop()
+
+	if err := d.Enqueue(Delivery{Listener: models.Listener{Name: "fake", Address: fake.URL}, Event: "event", Body: []byte("{}")}); err != nil {
+		t.Fatalf("Expected delivery to be queued, but got [%v]", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Logf("Expected delivery to succeed on the third attempt, but got [%d] attempts", atomic.LoadInt32(&calls))
+		t.Fail()
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	var calls int32
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer fake.Close()
+	d := New(logger, Config{Workers: 1, Retry: models.RetryPolicy{InitialInterval: models.Duration(time.Millisecond * 10)}})
+	defer d.Stop()
+
+	//listener's own policy overrides the global one
+	retry := &models.RetryPolicy{MaxAttempts: 2}
+	if err := d.Enqueue(Delivery{Listener: models.Listener{Name: "fake", Address: fake.URL, Retry: retry}, Event: "event", Body: []byte("{}")}); err != nil {
+		t.Fatalf("Expected delivery to be queued, but got [%v]", err)
+	}
+
+	time.Sleep(time.Millisecond * 300)
+	if actual := atomic.LoadInt32(&calls); actual != 2 {
+		t.Logf("Expected [2] attempts, but got [%d]", actual)
+		t.Fail()
+	}
+}
+
+type deadLetters chan Delivery
+
+func (d deadLetters) Put(dl Delivery) {
+	d <- dl
+}
+
+func TestGiveUpToDeadLetters(t *testing.T) {
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer fake.Close()
+	dead := make(deadLetters, 1)
+	d := New(logger, Config{Workers: 1, DeadLetters: dead,
+		Retry: models.RetryPolicy{MaxAttempts: 2, InitialInterval: models.Duration(time.Millisecond * 10)}})
+	defer d.Stop()
+
+	if err := d.Enqueue(Delivery{Listener: models.Listener{Name: "fake", Address: fake.URL}, Event: "event", Body: []byte("{}")}); err != nil {
+		t.Fatalf("Expected delivery to be queued, but got [%v]", err)
+	}
+
+	select {
+	case dl := <-dead:
+		if len(dl.Attempts) != 2 || dl.Attempts[1].Status != http.StatusInternalServerError || dl.LastError() == "" {
+			t.Logf("Unexpected attempt history [%v]", dl.Attempts)
+			t.Fail()
+		}
+	case <-time.After(time.Second * 5):
+		t.Log("Expected delivery to be dead lettered")
+		t.Fail()
+	}
+}
+
+type observed struct {
+	dl    Delivery
+	final bool
+}
+
+type observer chan observed
+
+func (o observer) Attempted(dl Delivery, final bool) {
+	o <- observed{dl: dl, final: final}
+}
+
+func TestObserver(t *testing.T) {
+	var calls int32
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(strings.Repeat("x", SnippetSize*4)))
+		}
+	}))
+	defer fake.Close()
+	obs := make(observer, 2)
+	d := New(logger, Config{Workers: 1, Observer: obs,
+		Retry: models.RetryPolicy{InitialInterval: models.Duration(time.Millisecond * 10)}})
+	defer d.Stop()
+
+	if err := d.Enqueue(Delivery{Listener: models.Listener{Name: "fake", Address: fake.URL}, Event: "event", Body: []byte("{}")}); err != nil {
+		t.Fatalf("Expected delivery to be queued, but got [%v]", err)
+	}
+
+	expected := []observed{
+		{final: false, dl: Delivery{Attempts: []Attempt{{Status: http.StatusBadGateway}}}},
+		{final: true, dl: Delivery{Attempts: []Attempt{{Status: http.StatusBadGateway}, {Status: http.StatusOK}}}},
+	}
+	for _, e := range expected {
+		select {
+		case o := <-obs:
+			last := o.dl.Attempts[len(o.dl.Attempts)-1]
+			if o.final != e.final || len(o.dl.Attempts) != len(e.dl.Attempts) || last.Status != e.dl.Attempts[len(e.dl.Attempts)-1].Status {
+				t.Logf("Expected final [%t] after [%d] attempts, but got [%t] after [%v]", e.final, len(e.dl.Attempts), o.final, o.dl.Attempts)
+				t.Fail()
+			}
+			if last.Latency <= 0 {
+				t.Log("Expected latency of the attempt to be measured")
+				t.Fail()
+			}
+			if !o.final && len(last.Response) != SnippetSize {
+				t.Logf("Expected response snippet of [%d] bytes, but got [%d]", SnippetSize, len(last.Response))
+				t.Fail()
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Expected observer to be notified")
+		}
+	}
+}
+
+func TestParallelFanOut(t *testing.T) {
+	const listeners = 5
+	done := make(chan struct{}, listeners)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 200)
+		done <- struct{}{}
+	}))
+	defer fake.Close()
+	d := New(logger, Config{Workers: listeners})
+	defer d.Stop()
+
+	start := time.Now()
+	for i := 0; i < listeners; i++ {
+		if err := d.Enqueue(Delivery{Listener: models.Listener{Name: strconv.Itoa(i), Address: fake.URL}, Event: "event", Body: []byte("{}")}); err != nil {
+			t.Fatalf("Expected delivery to be queued, but got [%v]", err)
+		}
+	}
+	for i := 0; i < listeners; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Expected [%d] deliveries, but got [%d]", listeners, i)
+		}
+	}
+	//listeners are called at once, so it takes about as long as the slowest of them
+	if elapsed := time.Since(start); elapsed > time.Millisecond*600 {
+		t.Logf("Expected deliveries to run in parallel, but they took [%s]", elapsed)
+		t.Fail()
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	const deliveries = 6
+	var active, max int32
+	done := make(chan struct{}, deliveries)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 20)
+		atomic.AddInt32(&active, -1)
+		done <- struct{}{}
+	}))
+	defer fake.Close()
+	d := New(logger, Config{Workers: 4})
+	defer d.Stop()
+
+	for i := 0; i < deliveries; i++ {
+		if err := d.Enqueue(Delivery{Listener: models.Listener{Name: "limited", Address: fake.URL, MaxConcurrency: 2}, Event: "event", Body: []byte("{}")}); err != nil {
+			t.Fatalf("Expected delivery to be queued, but got [%v]", err)
+		}
+	}
+	for i := 0; i < deliveries; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Expected [%d] deliveries, but got [%d]", deliveries, i)
+		}
+	}
+	if actual := atomic.LoadInt32(&max); actual != 2 {
+		t.Logf("Expected at most [2] deliveries in flight, but got [%d]", actual)
+		t.Fail()
+	}
+	//listener responds before the worker releases the slot
+	deadline := time.Now().Add(time.Second)
+	for {
+		d.lmu.Lock()
+		released := len(d.limits) == 0
+		d.lmu.Unlock()
+		if released {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected every slot to be released")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestEnqueueFiltered(t *testing.T) {
+	received := make(chan string, 2)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		received <- string(bs)
+	}))
+	defer fake.Close()
+	d := New(logger, Config{Workers: 1})
+	defer d.Stop()
+	l := models.Listener{Name: "fake", Address: fake.URL, Filter: `body.region == "eu" && header["X-Priority"] == "high"`}
+	high := http.Header{"X-Priority": []string{"high"}}
+
+	if err := d.Enqueue(NewDelivery("id", "event", l, []byte(`{"region":"us"}`), high)); err != ErrFiltered {
+		t.Logf("Expected [%v], but got [%v]", ErrFiltered, err)
+		t.Fail()
+	}
+	if err := d.Enqueue(NewDelivery("id", "event", l, []byte(`{"region":"eu"}`), nil)); err != ErrFiltered {
+		t.Logf("Expected [%v], but got [%v]", ErrFiltered, err)
+		t.Fail()
+	}
+	if err := d.Enqueue(NewDelivery("id", "event", l, []byte(`{"region":"eu"}`), high)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case body := <-received:
+		if body != `{"region":"eu"}` {
+			t.Logf("Expected only matching message to be delivered, but got [%s]", body)
+			t.Fail()
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Matching message wasn't delivered")
+	}
+}
+
+func TestDeliverySigned(t *testing.T) {
+	verified := make(chan error, 1)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		verified <- signature.Verify(r.Header.Get(signature.Header), bs, []string{"old"}, signature.DefaultTolerance)
+	}))
+	defer fake.Close()
+	d := New(logger, Config{Workers: 1})
+	defer d.Stop()
+	l := models.Listener{Name: "fake", Address: fake.URL, Secrets: []string{"new", "old"}}
+
+	if err := d.Enqueue(NewDelivery("id", "event", l, []byte("{}"), nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Logf("Expected delivery signed with both secrets, but got [%v]", err)
+			t.Fail()
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message wasn't delivered")
+	}
+}
+
+func TestDeliveryHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	}))
+	defer fake.Close()
+	d := New(logger, Config{Workers: 1, Passthrough: []string{"x-request-id"}})
+	defer d.Stop()
+	header := http.Header{
+		"Content-Type":    []string{"application/cloudevents+json"},
+		"X-Request-Id":    []string{"req-1"},
+		"X-Internal":      []string{"secret"},
+		"Publisher-Event": []string{"spoofed"},
+	}
+
+	if err := d.Enqueue(NewDelivery("msg-1", "orders.created", models.Listener{Name: "fake", Address: fake.URL}, []byte("{}"), header)); err != nil {
+		t.Fatal(err)
+	}
+
+	var h http.Header
+	select {
+	case h = <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message wasn't delivered")
+	}
+	expected := map[string]string{
+		"Content-Type":   "application/cloudevents+json",
+		"X-Request-Id":   "req-1",
+		"X-Internal":     "",
+		HeaderEvent:      "orders.created",
+		HeaderMessageID:  "msg-1",
+		HeaderAttempt:    "1",
+		signature.Header: "",
+	}
+	for name, value := range expected {
+		if actual := h.Get(name); actual != value {
+			t.Logf("[%s] Expected [%s], but got [%s]", name, value, actual)
+			t.Fail()
+		}
+	}
+	if h.Get(HeaderTimestamp) == "" {
+		t.Logf("Expected [%s] to be set", HeaderTimestamp)
+		t.Fail()
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	received := make(chan string, 1)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("Content-Type")
+	}))
+	defer fake.Close()
+	d := New(logger, Config{Workers: 1})
+	defer d.Stop()
+
+	if err := d.Enqueue(NewDelivery("msg-1", "event", models.Listener{Name: "fake", Address: fake.URL}, []byte("{}"), nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ct := <-received:
+		if ct != DefaultContentType {
+			t.Logf("Expected [%s], but got [%s]", DefaultContentType, ct)
+			t.Fail()
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message wasn't delivered")
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	var active, overlapped int32
+	received := make(chan string, 10)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		time.Sleep(time.Millisecond * 5)
+		atomic.AddInt32(&active, -1)
+		//every message fails once, so the next one has to wait for the retry
+		if r.Header.Get(HeaderAttempt) == "1" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received <- string(bs)
+	}))
+	defer fake.Close()
+	d := New(logger, Config{Workers: 4, Retry: models.RetryPolicy{InitialInterval: models.Duration(time.Millisecond * 5), Jitter: 0.01}})
+	defer d.Stop()
+
+	expected := []string{"1", "2", "3", "4", "5"}
+	for _, body := range expected {
+		if err := d.Enqueue(Delivery{Listener: models.Listener{Name: "billing", Address: fake.URL, Ordered: true}, Event: "event", Body: []byte(body)}); err != nil {
+			t.Fatalf("Expected delivery to be queued, but got [%v]", err)
+		}
+	}
+	for _, e := range expected {
+		select {
+		case actual := <-received:
+			if actual != e {
+				t.Fatalf("Expected message [%s], but got [%s]", e, actual)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Expected message [%s] to be delivered", e)
+		}
+	}
+	if atomic.LoadInt32(&overlapped) != 0 {
+		t.Log("Expected ordered deliveries not to overlap")
+		t.Fail()
+	}
+}
+
+func TestOrderedPartitions(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan string, 10)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		if string(bs) == `{"customer":"a","n":1}` {
+			<-release
+		}
+		received <- string(bs)
+	}))
+	defer fake.Close()
+	dead := make(deadLetters, 1)
+	d := New(logger, Config{Workers: 4, DeadLetters: dead})
+	defer d.Stop()
+
+	for _, body := range []string{`{"customer":"a","n":1}`, `{"customer":"a","n":2}`, `{"customer":"b","n":1}`} {
+		if err := d.Enqueue(Delivery{Listener: models.Listener{Name: "billing", Address: fake.URL, Ordered: true, PartitionKey: "body.customer"}, Event: "event", Body: []byte(body)}); err != nil {
+			t.Fatalf("Expected delivery to be queued, but got [%v]", err)
+		}
+	}
+	//partition b doesn't wait for the stuck partition a
+	select {
+	case actual := <-received:
+		if actual != `{"customer":"b","n":1}` {
+			t.Fatalf("Expected partition [b] to be delivered first, but got [%s]", actual)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected partition [b] to be delivered")
+	}
+	close(release)
+	for _, e := range []string{`{"customer":"a","n":1}`, `{"customer":"a","n":2}`} {
+		select {
+		case actual := <-received:
+			if actual != e {
+				t.Fatalf("Expected message [%s], but got [%s]", e, actual)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Expected message [%s] to be delivered", e)
+		}
+	}
+}
+
+func TestOrderedQueueFull(t *testing.T) {
+	const queueSize, partitions = 10, 5
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer fake.Close()
+	retry := models.RetryPolicy{MaxAttempts: 1000, InitialInterval: models.Duration(time.Hour)}
+	d := New(logger, Config{Workers: 2, QueueSize: queueSize, Retry: retry})
+	defer d.Stop()
+
+	//heads of the lanes wait for their retry, the rest waits in lanes and takes room in the queue
+	accepted := 0
+	for i := 0; i < 100; i++ {
+		body := `{"customer":"` + strconv.Itoa(i%partitions) + `"}`
+		l := models.Listener{Name: "billing", Address: fake.URL, Ordered: true, PartitionKey: "body.customer"}
+		if err := d.Enqueue(Delivery{Listener: l, Event: "event", Body: []byte(body)}); err == nil {
+			accepted++
+		}
+	}
+	if accepted > queueSize+partitions {
+		t.Logf("Expected at most [%d] deliveries to be accepted, but got [%d]", queueSize+partitions, accepted)
+		t.Fail()
+	}
+}
+
+func TestOrderedAfterDeadLetter(t *testing.T) {
+	received := make(chan string, 10)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		if string(bs) == "poison" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- string(bs)
+	}))
+	defer fake.Close()
+	dead := make(deadLetters, 1)
+	d := New(logger, Config{Workers: 2, DeadLetters: dead, Retry: models.RetryPolicy{MaxAttempts: 1}})
+	defer d.Stop()
+
+	for _, body := range []string{"poison", "next"} {
+		if err := d.Enqueue(Delivery{Listener: models.Listener{Name: "billing", Address: fake.URL, Ordered: true}, Event: "event", Body: []byte(body)}); err != nil {
+			t.Fatalf("Expected delivery to be queued, but got [%v]", err)
+		}
+	}
+	select {
+	case actual := <-received:
+		if actual != "next" || len(dead) != 1 {
+			t.Logf("Expected [next] after dead letter, but got [%s] with [%d] dead letters", actual, len(dead))
+			t.Fail()
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected next message to be delivered after dead letter")
+	}
+}
+
+func TestBreakerParksDeliveries(t *testing.T) {
+	const deliveries = 5
+	var calls, down int32 = 0, 1
+	delivered := make(chan struct{}, deliveries)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered <- struct{}{}
+	}))
+	defer fake.Close()
+	cb := breaker.New(breaker.Config{Threshold: 2, Cooldown: time.Millisecond * 100})
+	retry := models.RetryPolicy{MaxAttempts: 1000, InitialInterval: models.Duration(time.Millisecond), MaxInterval: models.Duration(time.Millisecond)}
+	d := New(logger, Config{Workers: 1, Retry: retry, Breakers: cb})
+	defer d.Stop()
+
+	for i := 0; i < deliveries; i++ {
+		if err := d.Enqueue(Delivery{Listener: models.Listener{Name: "down", Address: fake.URL}, Event: "event", Body: []byte("{}")}); err != nil {
+			t.Fatalf("Expected delivery to be queued, but got [%v]", err)
+		}
+	}
+	time.Sleep(time.Millisecond * 350)
+	//2 failures open the breaker, then a single probe is made every cooldown
+	if actual := atomic.LoadInt32(&calls); actual > 6 {
+		t.Logf("Expected open breaker to fail deliveries fast, but listener got [%d] requests", actual)
+		t.Fail()
+	}
+	if state := cb.State(fake.URL); state == breaker.StateClosed {
+		t.Logf("Expected breaker not to be closed, but got [%s]", state)
+		t.Fail()
+	}
+
+	atomic.StoreInt32(&down, 0)
+	for i := 0; i < deliveries; i++ {
+		select {
+		case <-delivered:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Expected [%d] deliveries once listener is up, but got [%d]", deliveries, i)
+		}
+	}
+	if state := cb.State(fake.URL); state != breaker.StateClosed {
+		t.Logf("Expected breaker to be closed after the probe, but got [%s]", state)
+		t.Fail()
+	}
+}
+
+func TestDeliveryRequest(t *testing.T) {
+	received := make(chan string, 2)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Method
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer fake.Close()
+	obs := make(observer, 2)
+	d := New(logger, Config{Workers: 1, Observer: obs})
+	defer d.Stop()
+
+	tests := []struct {
+		name     string
+		l        models.Listener
+		method   string
+		accepted bool
+	}{
+		{name: "DEFAULT", l: models.Listener{Name: "default", Address: fake.URL, Retry: &models.RetryPolicy{MaxAttempts: 1}}, method: http.MethodPost},
+		{name: "PUT_2XX", l: models.Listener{Name: "put", Address: fake.URL, Method: http.MethodPut, SuccessCodes: []string{"2xx"}, Timeout: models.Duration(time.Second)},
+			method: http.MethodPut, accepted: true},
+	}
+	for _, test := range tests {
+		if err := d.Enqueue(NewDelivery("msg-1", "event", test.l, []byte("{}"), nil)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-received:
+			if m != test.method {
+				t.Logf("%s: expected method [%s], but got [%s]", test.name, test.method, m)
+				t.Fail()
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: message wasn't delivered", test.name)
+		}
+		select {
+		case o := <-obs:
+			if accepted := o.dl.LastError() == ""; accepted != test.accepted || !o.final {
+				t.Logf("%s: expected accepted [%t], but got [%+v]", test.name, test.accepted, o.dl.Attempts)
+				t.Fail()
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: attempt wasn't observed", test.name)
+		}
+	}
+}
+
+//TestMaxConcurrencyBackpressure fills the queue with deliveries parked behind the slow limited listener
+func TestMaxConcurrencyBackpressure(t *testing.T) {
+	blocked, release := make(chan struct{}, 10), make(chan struct{})
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blocked <- struct{}{}
+		<-release
+	}))
+	defer fake.Close()
+	d := New(logger, Config{Workers: 2, QueueSize: 2})
+	defer d.Stop()
+	defer close(release)
+	dl := Delivery{Listener: models.Listener{Name: "slow", Address: fake.URL, MaxConcurrency: 1}, Event: "event", Body: []byte("{}")}
+	if err := d.Enqueue(dl); err != nil {
+		t.Fatal(err)
+	}
+	<-blocked
+
+	accepted := 0
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		if err = d.Enqueue(dl); err == nil {
+			accepted++
+		}
+		//the free worker parks the delivery before the next one comes
+		time.Sleep(time.Millisecond * 5)
+	}
+	if err != ErrQueueFull || accepted > 2 {
+		t.Logf("Expected parked deliveries to fill the queue of [2], but got [%v] after [%d] of them", err, accepted)
+		t.Fail()
+	}
+}
+
+func TestResponseDrained(t *testing.T) {
+	received := make(chan struct{}, 3)
+	fake := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		w.Write([]byte(strings.Repeat("x", SnippetSize*4)))
+	}))
+	var conns int32
+	fake.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	fake.Start()
+	defer fake.Close()
+	d := New(logger, Config{Workers: 1})
+	defer d.Stop()
+
+	for i := 0; i < 3; i++ {
+		if err := d.Enqueue(Delivery{Listener: models.Listener{Name: "long", Address: fake.URL}, Event: "event", Body: []byte("{}")}); err != nil {
+			t.Fatalf("Expected delivery to be queued, but got [%v]", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Expected [3] deliveries, but got [%d]", i)
+		}
+	}
+	//response longer than the snippet is read to the end, so the next delivery reuses the connection
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Logf("Expected [1] connection, but got [%d]", n)
+		t.Fail()
+	}
+}
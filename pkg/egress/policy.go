@@ -0,0 +1,182 @@
+//Package egress decides which listener addresses the publisher is allowed to call
+//
+//Addresses are checked twice: their URL when listener is registered and every resolved IP
+//when delivery connects, so a hostname which later resolves to an internal address (DNS rebinding)
+//is still refused.
+package egress
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+//ErrDenied is returned for addresses which the policy doesn't allow
+var ErrDenied = errors.New("egress: address isn't allowed")
+
+//Blocked are the ranges denied unless they're allowed explicitly:
+//loopback, private, link-local (including cloud metadata 169.254.169.254), carrier-grade NAT,
+//multicast, unspecified and their IPv6 counterparts
+var Blocked = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+//Policy is a set of allow and deny rules for listener addresses, it's created by New
+//Deny rules always win. IP is allowed when it's in allowed CIDRs or isn't in Blocked.
+//Host is allowed when it isn't in denied hosts and either allowed hosts are empty or host is in them.
+//Host rule "example.com" matches the host itself, "*.example.com" any of its subdomains
+type Policy struct {
+	allowCIDRs []*net.IPNet
+	denyCIDRs  []*net.IPNet
+	allowHosts []string
+	denyHosts  []string
+	blocked    []*net.IPNet
+}
+
+//New creates Policy from the textual CIDRs and hosts, every list can be empty
+func New(allowCIDRs, denyCIDRs, allowHosts, denyHosts []string) (*Policy, error) {
+	p := &Policy{allowHosts: lower(allowHosts), denyHosts: lower(denyHosts)}
+	var err error
+	if p.allowCIDRs, err = parseCIDRs(allowCIDRs); err != nil {
+		return nil, err
+	}
+	if p.denyCIDRs, err = parseCIDRs(denyCIDRs); err != nil {
+		return nil, err
+	}
+	if p.blocked, err = parseCIDRs(Blocked); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//ValidateURL checks that address is an absolute http(s) URL whose host is allowed
+//Hostnames aren't resolved here, resolved IPs are checked by Control when delivery connects
+//IP address passes host rules too, when allowed hosts are set it should be one of them or be in allowed CIDRs
+func (p *Policy) ValidateURL(address string) error {
+	u, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("egress: invalid address [%s] [%v]", address, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("egress: address [%s] should be http or https", address)
+	}
+	if u.User != nil {
+		return fmt.Errorf("egress: address [%s] shouldn't contain credentials", address)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("egress: address [%s] has no host", address)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if err := p.CheckIP(ip); err != nil {
+			return err
+		}
+		if contains(p.allowCIDRs, ip) {
+			return nil
+		}
+	}
+	return p.CheckHost(host)
+}
+
+//CheckHost applies host rules
+func (p *Policy) CheckHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range p.denyHosts {
+		if matchHost(rule, host) {
+			return ErrDenied
+		}
+	}
+	if len(p.allowHosts) == 0 {
+		return nil
+	}
+	for _, rule := range p.allowHosts {
+		if matchHost(rule, host) {
+			return nil
+		}
+	}
+	return ErrDenied
+}
+
+//CheckIP applies CIDR rules
+func (p *Policy) CheckIP(ip net.IP) error {
+	if contains(p.denyCIDRs, ip) {
+		return ErrDenied
+	}
+	if contains(p.allowCIDRs, ip) {
+		return nil
+	}
+	if contains(p.blocked, ip) {
+		return ErrDenied
+	}
+	return nil
+}
+
+//Control checks IP the connection is about to be made to, it's meant for net.Dialer.Control
+func (p *Policy) Control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("egress: dialing unresolved address [%s]", address)
+	}
+	if err := p.CheckIP(ip); err != nil {
+		return fmt.Errorf("egress: connection to [%s] refused [%v]", address, err)
+	}
+	return nil
+}
+
+func matchHost(rule, host string) bool {
+	if strings.HasPrefix(rule, "*.") {
+		return strings.HasSuffix(host, rule[1:])
+	}
+	return rule == host
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(c))
+		if err != nil {
+			return nil, fmt.Errorf("egress: invalid CIDR [%s] [%v]", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func lower(hosts []string) []string {
+	lowered := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		lowered = append(lowered, strings.ToLower(strings.TrimSpace(h)))
+	}
+	return lowered
+}
@@ -0,0 +1,237 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+//Expr is a compiled filter expression
+//
+//Expression is a CEL-like predicate over the published message, e.g.
+//	body.region == "eu" && (body.total >= 100 || header["X-Priority"] == "high")
+//
+//Operands are string, number, true, false and null literals, and paths into the message:
+//body.a.b or body["a"][0] into the json body and header["Name"] or header.Name into the request headers.
+//Operators are == != < <= > >= && || ! and parentheses, has(path) checks that path exists.
+//Path used on its own is true when it exists and isn't false or null.
+type Expr struct {
+	source string
+	root   node
+}
+
+const (
+	//MaxLength is the longest source of an expression or a path
+	MaxLength = 4096
+	//MaxDepth limits nesting of parentheses and negations, so the parser can't exhaust the stack
+	MaxDepth = 32
+)
+
+//Compile parses expression
+func Compile(source string) (*Expr, error) {
+	if len(source) > MaxLength {
+		return nil, fmt.Errorf("filter: expression is longer than [%d]", MaxLength)
+	}
+	p := &parser{lex: &lexer{src: source}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, fmt.Errorf("filter: unexpected [%s] at position [%d]", p.tok.text, p.tok.pos)
+	}
+	return &Expr{source: source, root: root}, nil
+}
+
+//String returns source of the expression
+func (e *Expr) String() string {
+	return e.source
+}
+
+//Match evaluates expression against the message
+//Body which isn't a valid json is treated as null
+func (e *Expr) Match(body []byte, header http.Header) bool {
+	return truthy(e.root.eval(&message{body: decode(body), header: header}))
+}
+
+//decode parses json body, body which isn't a valid json is nil
+func decode(body []byte) interface{} {
+	var doc interface{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return nil
+		}
+	}
+	return doc
+}
+
+type message struct {
+	body   interface{}
+	header http.Header
+}
+
+//missing is the value of a path which doesn't exist in the message
+type missing struct{}
+
+type node interface {
+	eval(m *message) interface{}
+}
+
+type literal struct {
+	v interface{}
+}
+
+func (l literal) eval(*message) interface{} { return l.v }
+
+//path is a chain of keys into body or header, keys are strings or float64 indexes
+type path struct {
+	header bool
+	keys   []interface{}
+}
+
+func (p path) eval(m *message) interface{} {
+	if p.header {
+		if len(p.keys) != 1 {
+			return missing{}
+		}
+		name, ok := p.keys[0].(string)
+		if !ok {
+			return missing{}
+		}
+		values, ok := m.header[http.CanonicalHeaderKey(name)]
+		if !ok || len(values) == 0 {
+			return missing{}
+		}
+		return values[0]
+	}
+	var v interface{} = m.body
+	for _, k := range p.keys {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			s, ok := k.(string)
+			if !ok {
+				return missing{}
+			}
+			if v, ok = c[s]; !ok {
+				return missing{}
+			}
+		case []interface{}:
+			i, ok := k.(float64)
+			if !ok || i < 0 || int(i) >= len(c) || float64(int(i)) != i {
+				return missing{}
+			}
+			v = c[int(i)]
+		default:
+			return missing{}
+		}
+	}
+	return v
+}
+
+type has struct {
+	p path
+}
+
+func (h has) eval(m *message) interface{} {
+	_, ok := h.p.eval(m).(missing)
+	return !ok
+}
+
+type not struct {
+	x node
+}
+
+func (n not) eval(m *message) interface{} {
+	return !truthy(n.x.eval(m))
+}
+
+type binary struct {
+	op   string
+	l, r node
+}
+
+func (b binary) eval(m *message) interface{} {
+	switch b.op {
+	case "&&":
+		return truthy(b.l.eval(m)) && truthy(b.r.eval(m))
+	case "||":
+		return truthy(b.l.eval(m)) || truthy(b.r.eval(m))
+	}
+	l, r := b.l.eval(m), b.r.eval(m)
+	if _, ok := l.(missing); ok {
+		return false
+	}
+	if _, ok := r.(missing); ok {
+		return false
+	}
+	switch b.op {
+	case "==":
+		return equal(l, r)
+	case "!=":
+		return !equal(l, r)
+	}
+	c, ok := compare(l, r)
+	if !ok {
+		return false
+	}
+	switch b.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func truthy(v interface{}) bool {
+	switch c := v.(type) {
+	case missing, nil:
+		return false
+	case bool:
+		return c
+	}
+	return true
+}
+
+func equal(l, r interface{}) bool {
+	return reflect.DeepEqual(l, r)
+}
+
+//compare orders two numbers or two strings
+func compare(l, r interface{}) (int, bool) {
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case lv < rv:
+			return -1, true
+		case lv > rv:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case lv < rv:
+			return -1, true
+		case lv > rv:
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,97 @@
+package filter
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExpr_Match(t *testing.T) {
+	body := []byte(`{"region":"eu","total":150,"paid":true,"customer":{"tier":"gold"},"items":[{"sku":"a1"}],"note":null}`)
+	header := http.Header{"X-Priority": []string{"high"}, "Tenant": []string{"acme"}}
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{expr: `body.region == "eu"`, expected: true},
+		{expr: `body.region != "eu"`, expected: false},
+		{expr: `body.total > 100 && body.total <= 150`, expected: true},
+		{expr: `body.total < 100 || header["x-priority"] == "high"`, expected: true},
+		{expr: `body.customer.tier == "gold"`, expected: true},
+		{expr: `body["customer"]["tier"] == "gold"`, expected: true},
+		{expr: `body.items[0].sku == "a1"`, expected: true},
+		{expr: `body.items[1].sku == "a1"`, expected: false},
+		{expr: `body.paid`, expected: true},
+		{expr: `!body.paid`, expected: false},
+		{expr: `body.note == null`, expected: true},
+		{expr: `has(body.note)`, expected: true},
+		{expr: `has(body.missing)`, expected: false},
+		//missing values never compare, even to null
+		{expr: `body.missing == null`, expected: false},
+		{expr: `body.missing != "eu"`, expected: false},
+		{expr: `body.region > 1`, expected: false},
+		{expr: `!(body.region == "us" || header["Tenant"] == "globex")`, expected: true},
+		{expr: `header["X-Priority"] >= "high"`, expected: true},
+		{expr: `header.tenant == "acme"`, expected: true},
+	}
+	for _, test := range tests {
+		e, err := Compile(test.expr)
+		if err != nil {
+			t.Logf("[%s] Unexpected error [%v]", test.expr, err)
+			t.Fail()
+			continue
+		}
+		if actual := e.Match(body, header); actual != test.expected {
+			t.Logf("[%s] Expected [%v], but got [%v]", test.expr, test.expected, actual)
+			t.Fail()
+		}
+	}
+}
+
+func TestExpr_MatchInvalidBody(t *testing.T) {
+	e, err := Compile(`body.region == "eu" || header["X-Region"] == "eu"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Match([]byte("not a json"), http.Header{"X-Region": []string{"eu"}}) {
+		t.Logf("Expected header to match when body isn't a json")
+		t.Fail()
+	}
+	if e.Match([]byte("not a json"), nil) {
+		t.Logf("Expected body which isn't a json not to match")
+		t.Fail()
+	}
+}
+
+func TestCompile_Invalid(t *testing.T) {
+	tests := []string{
+		``,
+		`body.region ==`,
+		`body.region = "eu"`,
+		`(body.total > 1`,
+		`region == "eu"`,
+		`body.region == "eu`,
+		`header["a"]["b"] == "high"`,
+		`has(1)`,
+		`body.total > 1 body.total < 2`,
+		`body.items[true]`,
+		strings.Repeat("(", MaxDepth+1) + "body.a" + strings.Repeat(")", MaxDepth+1),
+		strings.Repeat("!", MaxDepth+1) + "body.a",
+		strings.Repeat("(", 1000000),
+		`body.a == "` + strings.Repeat("a", MaxLength) + `"`,
+	}
+	for _, test := range tests {
+		if _, err := Compile(test); err == nil {
+			t.Logf("[%s] Expected error, but got nil", test)
+			t.Fail()
+		}
+	}
+}
+
+func TestCompile_MaxDepth(t *testing.T) {
+	nested := strings.Repeat("(", MaxDepth/2) + strings.Repeat("!", MaxDepth/2) + "body.a" + strings.Repeat(")", MaxDepth/2)
+	if _, err := Compile(nested); err != nil {
+		t.Logf("Expected expression nested [%d] levels to compile, but got [%v]", MaxDepth, err)
+		t.Fail()
+	}
+}
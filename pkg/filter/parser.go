@@ -0,0 +1,307 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", "."}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && unicode.IsSpace(rune(l.src[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case c == '"':
+		//find closing quote, honouring escapes, and let strconv deal with them
+		i := l.pos + 1
+		for ; i < len(l.src) && l.src[i] != '"'; i++ {
+			if l.src[i] == '\\' {
+				i++
+			}
+		}
+		if i >= len(l.src) {
+			return token{}, fmt.Errorf("filter: unterminated string at position [%d]", start)
+		}
+		s, err := strconv.Unquote(l.src[start : i+1])
+		if err != nil {
+			return token{}, fmt.Errorf("filter: invalid string at position [%d]", start)
+		}
+		l.pos = i + 1
+		return token{kind: tokString, text: s, pos: start}, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		i := l.pos + 1
+		for i < len(l.src) && strings.IndexByte("0123456789.eE+-", l.src[i]) >= 0 {
+			i++
+		}
+		l.pos = i
+		return token{kind: tokNumber, text: l.src[start:i], pos: start}, nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		i := l.pos + 1
+		for i < len(l.src) && (l.src[i] == '_' || unicode.IsLetter(rune(l.src[i])) || unicode.IsDigit(rune(l.src[i]))) {
+			i++
+		}
+		l.pos = i
+		return token{kind: tokIdent, text: l.src[start:i], pos: start}, nil
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, pos: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("filter: unexpected character [%c] at position [%d]", c, start)
+}
+
+//parser is a recursive descent parser, each method parses one precedence level
+//depth is the nesting of parentheses and negations being parsed
+type parser struct {
+	lex   *lexer
+	tok   token
+	depth int
+}
+
+//enter goes one level deeper, the caller should leave it once the level is parsed
+func (p *parser) enter() error {
+	if p.depth++; p.depth > MaxDepth {
+		return fmt.Errorf("filter: expression is nested deeper than [%d] at position [%d]", MaxDepth, p.tok.pos)
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) next() error {
+	t, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = t
+	return nil
+}
+
+func (p *parser) is(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+func (p *parser) expect(op string) error {
+	if !p.is(op) {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+func (p *parser) unexpected() error {
+	if p.tok.kind == tokEOF {
+		return fmt.Errorf("filter: unexpected end of expression")
+	}
+	return fmt.Errorf("filter: unexpected [%s] at position [%d]", p.tok.text, p.tok.pos)
+}
+
+func (p *parser) or() (node, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.is("||") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op: "||", l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) and() (node, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.is("&&") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op: "&&", l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) unary() (node, error) {
+	if p.is("!") {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return not{x: x}, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (node, error) {
+	l, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.is(op) {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			r, err := p.operand()
+			if err != nil {
+				return nil, err
+			}
+			return binary{op: op, l: l, r: r}, nil
+		}
+	}
+	return l, nil
+}
+
+func (p *parser) operand() (node, error) {
+	t := p.tok
+	switch t.kind {
+	case tokString:
+		return literal{v: t.text}, p.next()
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("filter: invalid number [%s] at position [%d]", t.text, t.pos)
+		}
+		return literal{v: f}, p.next()
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literal{v: true}, p.next()
+		case "false":
+			return literal{v: false}, p.next()
+		case "null":
+			return literal{v: nil}, p.next()
+		case "has":
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if err := p.expect("("); err != nil {
+				return nil, err
+			}
+			pth, err := p.path()
+			if err != nil {
+				return nil, err
+			}
+			return has{p: pth}, p.expect(")")
+		case "body", "header":
+			return p.path()
+		}
+	case tokOp:
+		if t.text == "(" {
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			defer p.leave()
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			x, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+	}
+	return nil, p.unexpected()
+}
+
+//path parses body.a["b"][0] or header["Name"]
+func (p *parser) path() (path, error) {
+	if p.tok.kind != tokIdent || (p.tok.text != "body" && p.tok.text != "header") {
+		return path{}, p.unexpected()
+	}
+	pth := path{header: p.tok.text == "header"}
+	if err := p.next(); err != nil {
+		return path{}, err
+	}
+	for {
+		switch {
+		case p.is("."):
+			if err := p.next(); err != nil {
+				return path{}, err
+			}
+			if p.tok.kind != tokIdent {
+				return path{}, p.unexpected()
+			}
+			pth.keys = append(pth.keys, p.tok.text)
+			if err := p.next(); err != nil {
+				return path{}, err
+			}
+		case p.is("["):
+			if err := p.next(); err != nil {
+				return path{}, err
+			}
+			switch p.tok.kind {
+			case tokString:
+				pth.keys = append(pth.keys, p.tok.text)
+			case tokNumber:
+				f, err := strconv.ParseFloat(p.tok.text, 64)
+				if err != nil {
+					return path{}, p.unexpected()
+				}
+				pth.keys = append(pth.keys, f)
+			default:
+				return path{}, p.unexpected()
+			}
+			if err := p.next(); err != nil {
+				return path{}, err
+			}
+			if err := p.expect("]"); err != nil {
+				return path{}, err
+			}
+		default:
+			if pth.header && len(pth.keys) != 1 {
+				return path{}, fmt.Errorf("filter: header should be used as header[\"Name\"]")
+			}
+			return pth, nil
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+//Path is a compiled path into the message, the same as paths of the filter expression,
+//e.g. body.customer.id, body["items"][0] or header["X-Tenant"]
+type Path struct {
+	source string
+	p      path
+}
+
+//CompilePath parses path
+func CompilePath(source string) (*Path, error) {
+	if len(source) > MaxLength {
+		return nil, fmt.Errorf("filter: path is longer than [%d]", MaxLength)
+	}
+	p := &parser{lex: &lexer{src: source}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	pth, err := p.path()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, fmt.Errorf("filter: unexpected [%s] at position [%d]", p.tok.text, p.tok.pos)
+	}
+	return &Path{source: source, p: pth}, nil
+}
+
+//String returns source of the path
+func (p *Path) String() string {
+	return p.source
+}
+
+//Value returns what the path points to in the message, strings as they are and everything else as json
+//It returns false when the path doesn't exist
+func (p *Path) Value(body []byte, header http.Header) (string, bool) {
+	v := p.p.eval(&message{body: decode(body), header: header})
+	switch c := v.(type) {
+	case missing:
+		return "", false
+	case string:
+		return c, true
+	}
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+	return string(bs), true
+}
@@ -0,0 +1,49 @@
+package filter
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPath(t *testing.T) {
+	body := []byte(`{"customer":{"id":"c1","tier":2},"items":[{"sku":"a"}],"vip":true}`)
+	header := http.Header{"X-Tenant": []string{"acme"}}
+	tests := []struct {
+		source   string
+		expected string
+		ok       bool
+	}{
+		{source: `body.customer.id`, expected: "c1", ok: true},
+		{source: `body["customer"]["tier"]`, expected: "2", ok: true},
+		{source: `body.items[0].sku`, expected: "a", ok: true},
+		{source: `body.vip`, expected: "true", ok: true},
+		{source: `body.customer`, expected: `{"id":"c1","tier":2}`, ok: true},
+		{source: `header["x-tenant"]`, expected: "acme", ok: true},
+		{source: `header.X-Tenant`},
+		{source: `body.missing`},
+		{source: `header["Missing"]`},
+	}
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			p, err := CompilePath(test.source)
+			if err != nil {
+				if test.ok {
+					t.Fatalf("Unexpected error [%v]", err)
+				}
+				return
+			}
+			actual, ok := p.Value(body, header)
+			if actual != test.expected || ok != test.ok {
+				t.Logf("Expected [%s] [%t], but got [%s] [%t]", test.expected, test.ok, actual, ok)
+				t.Fail()
+			}
+		})
+	}
+	for _, source := range []string{``, `body.a == 1`, `has(body.a)`, `"body"`, `header`, "body" + strings.Repeat(".a", MaxLength)} {
+		if _, err := CompilePath(source); err == nil {
+			t.Logf("Expected [%s] not to compile", source)
+			t.Fail()
+		}
+	}
+}
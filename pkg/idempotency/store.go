@@ -0,0 +1,123 @@
+//Package idempotency remembers Idempotency-Key of publish requests, so retried request isn't published twice
+package idempotency
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+//Header is the request header carrying the key
+const Header = "Idempotency-Key"
+
+var (
+	//ErrDuplicate is returned when request with the key has already been published
+	ErrDuplicate = errors.New("idempotency: duplicate request")
+	//ErrInProgress is returned when request with the key is being published right now
+	ErrInProgress = errors.New("idempotency: request in progress")
+)
+
+const (
+	pending = iota
+	done
+	failed
+)
+
+type entry struct {
+	id      string
+	state   int
+	expires time.Time
+	//queued are the listeners the message has been queued for before the publish failed
+	queued map[string]bool
+}
+
+//Store keeps keys for the window since they were first seen
+//It is safe for concurrent use
+type Store struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]*entry
+	swept   time.Time
+	now     func() time.Time
+}
+
+//New creates Store remembering keys for the window
+func New(window time.Duration) *Store {
+	return &Store{window: window, entries: make(map[string]*entry), now: time.Now}
+}
+
+//Begin starts publishing of the request with the key
+//It returns id the message should be published with: the given one for a new key
+//and the remembered one otherwise, so retry after a failure keeps the message id
+//ErrDuplicate and ErrInProgress mean the message mustn't be published again
+func (s *Store) Begin(key, id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.sweep(now)
+	e, ok := s.entries[key]
+	if !ok || now.After(e.expires) {
+		s.entries[key] = &entry{id: id, state: pending, expires: now.Add(s.window)}
+		return id, nil
+	}
+	switch e.state {
+	case done:
+		return e.id, ErrDuplicate
+	case pending:
+		return e.id, ErrInProgress
+	}
+	e.state = pending
+	return e.id, nil
+}
+
+//Done marks request with the key as published
+func (s *Store) Done(key string) {
+	s.set(key, done)
+}
+
+//Fail marks request with the key as not published, so it can be retried
+//queued are the listeners the message has been queued for anyway, retry shouldn't queue it for them again
+func (s *Store) Fail(key string, queued []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	e.state = failed
+	if len(queued) > 0 && e.queued == nil {
+		e.queued = make(map[string]bool, len(queued))
+	}
+	for _, name := range queued {
+		e.queued[name] = true
+	}
+}
+
+//Queued reports whether the message with the key has already been queued for the listener by a failed attempt
+func (s *Store) Queued(key, listener string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	return ok && e.queued[listener]
+}
+
+func (s *Store) set(key string, state int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		e.state = state
+	}
+}
+
+//sweep drops expired keys at most once a minute
+func (s *Store) sweep(now time.Time) {
+	if now.Sub(s.swept) < time.Minute {
+		return
+	}
+	s.swept = now
+	for k, e := range s.entries {
+		if now.After(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+}
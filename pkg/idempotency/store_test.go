@@ -0,0 +1,50 @@
+package idempotency
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := New(time.Hour)
+	s.now = func() time.Time { return now }
+
+	if id, err := s.Begin("key", "first"); id != "first" || err != nil {
+		t.Logf("Expected [first] [<nil>], but got [%s] [%v]", id, err)
+		t.Fail()
+	}
+	if id, err := s.Begin("key", "second"); id != "first" || err != ErrInProgress {
+		t.Logf("Expected [first] [%v], but got [%s] [%v]", ErrInProgress, id, err)
+		t.Fail()
+	}
+	//failed request is retried with the same message id
+	s.Fail("key", []string{"billing"})
+	if id, err := s.Begin("key", "third"); id != "first" || err != nil {
+		t.Logf("Expected [first] [<nil>], but got [%s] [%v]", id, err)
+		t.Fail()
+	}
+	if !s.Queued("key", "billing") || s.Queued("key", "audit") {
+		t.Logf("Expected only [billing] to be queued by the failed request")
+		t.Fail()
+	}
+	s.Done("key")
+	if id, err := s.Begin("key", "fourth"); id != "first" || err != ErrDuplicate {
+		t.Logf("Expected [first] [%v], but got [%s] [%v]", ErrDuplicate, id, err)
+		t.Fail()
+	}
+	if id, err := s.Begin("other", "fifth"); id != "fifth" || err != nil {
+		t.Logf("Expected [fifth] [<nil>], but got [%s] [%v]", id, err)
+		t.Fail()
+	}
+
+	now = now.Add(time.Hour + time.Second)
+	if id, err := s.Begin("key", "sixth"); id != "sixth" || err != nil {
+		t.Logf("Expected expired key to be forgotten, but got [%s] [%v]", id, err)
+		t.Fail()
+	}
+	if _, ok := s.entries["other"]; ok {
+		t.Logf("Expected expired keys to be swept")
+		t.Fail()
+	}
+}
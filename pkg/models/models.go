@@ -1,41 +1,445 @@
 package models
 
-import "fmt"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/volodimyr/publisher/pkg/client"
+	"github.com/volodimyr/publisher/pkg/filter"
+	"github.com/volodimyr/publisher/pkg/signature"
+	"github.com/volodimyr/publisher/pkg/topic"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
 
 //Events represents entity of named events
-//Value of the first map is Listener in format name: address
+//Value of the first map is Listener in format name: listener
 //One event obviously can contain multiple listeners
-type Events map[string]map[string]string
+type Events map[string]map[string]Listener
 
 //Listener represents entity of servers who are looking for new messages
 //None of these fields can be empty
-//Address should be in the format http://domain.com/endpoint, but it isn't restricted
+//Address should be in the format http://domain.com/endpoint, it's checked against egress.Policy on registration
+//Event is a dotted topic which may contain wildcards: "*" matches one segment, "#" any number of them
+//Retry overrides the global retry policy field by field, it's optional
+//Filter is an optional expression, only messages matching it are delivered, see filter.Compile
+//Secrets are optional, every delivery is signed with each of them, see package signature
+//There are two of them only while the old secret is rotated out
+//MaxConcurrency limits deliveries to the listener in flight at once, 0 means only the global limit applies
+//Ordered delivers messages in publish order, the next one waits until the previous is delivered or dead lettered
+//PartitionKey is an optional path into the message, see filter.CompilePath, messages are ordered only within
+//the same value of it, so different partitions don't wait for each other
+//Suspended listener keeps its registration, but messages aren't delivered to it until it's resumed,
+//it's set by the service only, registration ignores it
+//Timeout limits a single attempt, 0 means client.DefaultTimeout
+//Method is either POST (default) or PUT
+//SuccessCodes are the statuses meaning the message is accepted, either exact like "202" or a class like "2xx",
+//empty means 200 only
 type Listener struct {
-	Event   string `json:"event"`
-	Name    string `json:"name"`
-	Address string `json:"address"`
+	Event          string       `json:"event"`
+	Name           string       `json:"name"`
+	Address        string       `json:"address"`
+	Retry          *RetryPolicy `json:"retry,omitempty"`
+	Filter         string       `json:"filter,omitempty"`
+	Secrets        []string     `json:"secrets,omitempty"`
+	MaxConcurrency int          `json:"max_concurrency,omitempty"`
+	Ordered        bool         `json:"ordered,omitempty"`
+	PartitionKey   string       `json:"partition_key,omitempty"`
+	Suspended      bool         `json:"suspended,omitempty"`
+	Timeout        Duration     `json:"timeout,omitempty"`
+	Method         string       `json:"method,omitempty"`
+	SuccessCodes   []string     `json:"success_codes,omitempty"`
 }
 
 //IsEmpty checks whether fields are not nil
 func (l *Listener) IsEmpty() error {
 	if l.Name == "" {
-		return fmt.Errorf("empty 'Name' field. Validation error [%v]", l)
+		return fmt.Errorf("empty 'Name' field. Validation error [%v]", l.Redacted())
 	}
 	if l.Event == "" {
-		return fmt.Errorf("empty 'Event' field. Validation error [%v]", l)
+		return fmt.Errorf("empty 'Event' field. Validation error [%v]", l.Redacted())
 	}
 	if l.Address == "" {
-		return fmt.Errorf("empty 'Address' field. Validation error [%v]", l)
+		return fmt.Errorf("empty 'Address' field. Validation error [%v]", l.Redacted())
 	}
 	return nil
 }
 
+//Redacted returns copy of the listener which is safe to respond with or log, secrets are dropped
+func (l Listener) Redacted() Listener {
+	l.Secrets = nil
+	return l
+}
+
+//ValidateConcurrency checks whether concurrency limit of the listener is valid
+func ValidateConcurrency(max int) error {
+	if max < 0 {
+		return fmt.Errorf("negative 'MaxConcurrency' field [%d]", max)
+	}
+	return nil
+}
+
+//ValidateOrdering checks whether partition key is a valid path and it's set for ordered listener only
+func ValidateOrdering(ordered bool, partitionKey string) error {
+	if partitionKey == "" {
+		return nil
+	}
+	if !ordered {
+		return fmt.Errorf("'PartitionKey' field is set for listener which isn't ordered")
+	}
+	_, err := filter.CompilePath(partitionKey)
+	return err
+}
+
+//ValidateRequest checks timeout, method and success codes of the delivery request
+func ValidateRequest(timeout Duration, method string, codes []string) error {
+	if timeout < 0 || time.Duration(timeout) > client.MaxTimeout {
+		return fmt.Errorf("'Timeout' field must be in range [0, %s], got [%s]", client.MaxTimeout, time.Duration(timeout))
+	}
+	if method != "" && method != http.MethodPost && method != http.MethodPut {
+		return fmt.Errorf("'Method' field must be either POST or PUT, got [%s]", method)
+	}
+	for _, code := range codes {
+		if !validCode(code) {
+			return fmt.Errorf("invalid status [%s] in 'SuccessCodes' field, expected e.g. 202 or 2xx", code)
+		}
+	}
+	return nil
+}
+
+func validCode(code string) bool {
+	if len(code) != 3 || code[0] < '1' || code[0] > '5' {
+		return false
+	}
+	if code[1:] == "xx" {
+		return true
+	}
+	return code[1] >= '0' && code[1] <= '9' && code[2] >= '0' && code[2] <= '9'
+}
+
+//Accepted reports whether status means the message is accepted by the listener with the success codes
+func Accepted(codes []string, status int) bool {
+	if len(codes) == 0 {
+		return status == http.StatusOK
+	}
+	s := strconv.Itoa(status)
+	for _, code := range codes {
+		if code == s || (code[1:] == "xx" && code[0] == s[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+//ValidateSecrets checks whether secrets can be used for signing
+func ValidateSecrets(secrets []string) error {
+	if len(secrets) > signature.MaxSecrets {
+		return fmt.Errorf("at most [%d] secrets can be active at once, got [%d]", signature.MaxSecrets, len(secrets))
+	}
+	for _, secret := range secrets {
+		if secret == "" {
+			return fmt.Errorf("empty secret in 'Secrets' field")
+		}
+	}
+	return nil
+}
+
+//EventInfo is a short description of a registered event
+type EventInfo struct {
+	Name      string `json:"name"`
+	Listeners int    `json:"listeners"`
+}
+
+//States of a subscription
+const (
+	//StatePending marks subscription which waits for the listener to confirm it
+	StatePending = "pending"
+	//StateSuspended marks subscription of the listener which has been suspended after its deliveries kept failing
+	StateSuspended = "suspended"
+)
+
+//Subscription describes how a listener is subscribed to a single event
+//State is empty for active subscription, Breaker is the state of the circuit breaker of its address when breakers are enabled
+type Subscription struct {
+	Event          string       `json:"event"`
+	Address        string       `json:"address"`
+	Retry          *RetryPolicy `json:"retry,omitempty"`
+	Filter         string       `json:"filter,omitempty"`
+	Signed         bool         `json:"signed,omitempty"`
+	MaxConcurrency int          `json:"max_concurrency,omitempty"`
+	Ordered        bool         `json:"ordered,omitempty"`
+	PartitionKey   string       `json:"partition_key,omitempty"`
+	Timeout        Duration     `json:"timeout,omitempty"`
+	Method         string       `json:"method,omitempty"`
+	SuccessCodes   []string     `json:"success_codes,omitempty"`
+	State          string       `json:"state,omitempty"`
+	Breaker        string       `json:"breaker,omitempty"`
+}
+
+//ListenerInfo describes every subscription of the listener with the name
+type ListenerInfo struct {
+	Name          string         `json:"name"`
+	Subscriptions []Subscription `json:"subscriptions"`
+}
+
+//NewListenerInfo describes subscriptions of the listener with the name, sorted by event
+//listeners are expected to share the name, pending are the subscriptions which aren't confirmed yet
+func NewListenerInfo(name string, listeners, pending []Listener) ListenerInfo {
+	info := ListenerInfo{Name: name, Subscriptions: make([]Subscription, 0, len(listeners)+len(pending))}
+	for _, l := range listeners {
+		info.Subscriptions = append(info.Subscriptions, newSubscription(l, ""))
+	}
+	for _, l := range pending {
+		info.Subscriptions = append(info.Subscriptions, newSubscription(l, StatePending))
+	}
+	sort.SliceStable(info.Subscriptions, func(i, j int) bool { return info.Subscriptions[i].Event < info.Subscriptions[j].Event })
+	return info
+}
+
+func newSubscription(l Listener, state string) Subscription {
+	if state == "" && l.Suspended {
+		state = StateSuspended
+	}
+	return Subscription{Event: l.Event, Address: l.Address, Retry: l.Retry, Filter: l.Filter, Signed: len(l.Secrets) > 0, MaxConcurrency: l.MaxConcurrency,
+		Ordered: l.Ordered, PartitionKey: l.PartitionKey, Timeout: l.Timeout, Method: l.Method, SuccessCodes: l.SuccessCodes, State: state}
+}
+
+//ListenerUpdate changes every subscription of a listener at once
+//With Replace (PUT) Address and Events are required, the rest of the fields are replaced even when they're nil,
+//otherwise (PATCH) only non-nil fields are changed
+//Secrets are replaced as a whole, so rotation is PATCH with [new, old] followed by PATCH with [new],
+//empty Secrets disable signing
+//Events is the full list of events the listener will be subscribed to
+type ListenerUpdate struct {
+	Address *string      `json:"address"`
+	Events  []string     `json:"events"`
+	Retry   *RetryPolicy `json:"retry"`
+	Filter  *string      `json:"filter"`
+	Secrets []string     `json:"secrets"`
+	//MaxConcurrency is a pointer to tell 0 (no limit) from the missing field
+	MaxConcurrency *int    `json:"max_concurrency"`
+	Ordered        *bool   `json:"ordered"`
+	PartitionKey   *string `json:"partition_key"`
+	//Timeout is a pointer to tell 0 (default timeout) from the missing field, SuccessCodes are replaced as a whole
+	Timeout      *Duration `json:"timeout"`
+	Method       *string   `json:"method"`
+	SuccessCodes []string  `json:"success_codes"`
+	//Suspended can't be changed through the api body, it's kept by PUT as well
+	Suspended *bool `json:"-"`
+	Replace   bool  `json:"-"`
+	//Pending are events whose subscriptions wait for the listener to confirm them, see Apply
+	Pending []string `json:"-"`
+}
+
+//Validate checks whether update can be applied
+func (u *ListenerUpdate) Validate() error {
+	if u.Replace && (u.Address == nil || u.Events == nil) {
+		return fmt.Errorf("'Address' and 'Events' fields are required. Validation error [%v]", u.redacted())
+	}
+	if u.Address != nil && *u.Address == "" {
+		return fmt.Errorf("empty 'Address' field. Validation error [%v]", u.redacted())
+	}
+	if u.Events != nil && len(u.Events) == 0 {
+		return fmt.Errorf("empty 'Events' field, unregister listener instead. Validation error [%v]", u.redacted())
+	}
+	for _, e := range u.Events {
+		if e == "" {
+			return fmt.Errorf("empty event in 'Events' field. Validation error [%v]", u.redacted())
+		}
+		if err := topic.Validate(e); err != nil {
+			return err
+		}
+	}
+	if u.Filter != nil && *u.Filter != "" {
+		if _, err := filter.Compile(*u.Filter); err != nil {
+			return err
+		}
+	}
+	if err := ValidateSecrets(u.Secrets); err != nil {
+		return err
+	}
+	if u.MaxConcurrency != nil {
+		if err := ValidateConcurrency(*u.MaxConcurrency); err != nil {
+			return err
+		}
+	}
+	var timeout Duration
+	if u.Timeout != nil {
+		timeout = *u.Timeout
+	}
+	method := ""
+	if u.Method != nil {
+		method = *u.Method
+	}
+	if err := ValidateRequest(timeout, method, u.SuccessCodes); err != nil {
+		return err
+	}
+	if u.PartitionKey != nil {
+		//PATCH without Ordered keeps the current value, ValidateFor checks it
+		ordered := (u.Ordered == nil && !u.Replace) || (u.Ordered != nil && *u.Ordered)
+		if err := ValidateOrdering(ordered, *u.PartitionKey); err != nil {
+			return err
+		}
+	}
+	if u.Retry != nil {
+		return u.Retry.Validate()
+	}
+	return nil
+}
+
+//ValidateFor checks whether update can be applied to the current subscriptions of the listener, see Apply
+//Partition key set by PATCH without Ordered needs every subscription to be ordered already
+func (u *ListenerUpdate) ValidateFor(current []Listener) error {
+	if u.PartitionKey == nil || *u.PartitionKey == "" || u.Ordered != nil || u.Replace {
+		return nil
+	}
+	for _, l := range current {
+		if !l.Ordered {
+			return fmt.Errorf("'PartitionKey' field is set, but subscription to [%s] isn't ordered", l.Event)
+		}
+	}
+	return nil
+}
+
+func (u ListenerUpdate) redacted() ListenerUpdate {
+	u.Secrets = nil
+	return u
+}
+
+//Apply returns subscriptions of the listener with the name after the update
+//current are the existing subscriptions and must not be empty
+//Newly subscribed events inherit settings of the first current subscription ordered by event
+//Subscriptions to Pending events are kept as they are and new ones aren't created until they're confirmed
+func (u *ListenerUpdate) Apply(name string, current []Listener) []Listener {
+	pending := make(map[string]bool, len(u.Pending))
+	for _, e := range u.Pending {
+		pending[e] = true
+	}
+	byEvent := make(map[string]Listener, len(current))
+	base := current[0]
+	for _, l := range current {
+		byEvent[l.Event] = l
+		if l.Event < base.Event {
+			base = l
+		}
+	}
+	events := u.Events
+	if events == nil {
+		for e := range byEvent {
+			events = append(events, e)
+		}
+		sort.Strings(events)
+	}
+	updated := make([]Listener, 0, len(events))
+	seen := make(map[string]bool, len(events))
+	for _, e := range events {
+		if seen[e] {
+			continue
+		}
+		seen[e] = true
+		l, ok := byEvent[e]
+		if pending[e] {
+			if ok {
+				updated = append(updated, l)
+			}
+			continue
+		}
+		if !ok {
+			l = base
+			l.Event = e
+		}
+		l.Name = name
+		if u.Address != nil {
+			l.Address = *u.Address
+		}
+		if u.Replace || u.Retry != nil {
+			l.Retry = u.Retry
+		}
+		if u.Filter != nil {
+			l.Filter = *u.Filter
+		} else if u.Replace {
+			l.Filter = ""
+		}
+		if u.Replace || u.Secrets != nil {
+			l.Secrets = u.Secrets
+		}
+		if u.MaxConcurrency != nil {
+			l.MaxConcurrency = *u.MaxConcurrency
+		} else if u.Replace {
+			l.MaxConcurrency = 0
+		}
+		if u.Ordered != nil {
+			l.Ordered = *u.Ordered
+		} else if u.Replace {
+			l.Ordered = false
+		}
+		if u.PartitionKey != nil {
+			l.PartitionKey = *u.PartitionKey
+		} else if u.Replace {
+			l.PartitionKey = ""
+		}
+		if u.Timeout != nil {
+			l.Timeout = *u.Timeout
+		} else if u.Replace {
+			l.Timeout = 0
+		}
+		if u.Method != nil {
+			l.Method = *u.Method
+		} else if u.Replace {
+			l.Method = ""
+		}
+		if u.Replace || u.SuccessCodes != nil {
+			l.SuccessCodes = u.SuccessCodes
+		}
+		if u.Suspended != nil {
+			l.Suspended = *u.Suspended
+		}
+		//listener which isn't ordered has nothing to partition
+		if !l.Ordered {
+			l.PartitionKey = ""
+		}
+		updated = append(updated, l)
+	}
+	return updated
+}
+
+//NewMessageID returns random id of a published message, it's shared by every delivery of the message
+func NewMessageID() string {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		//crypto/rand doesn't fail on supported platforms, fall back to time just in case
+		return fmt.Sprintf("%032x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(bs)
+}
+
 //PublishMessage defines event and therefore listeners where messsage should be published
+//ID is shared by every delivery of the message, see NewMessageID
 type PublishMessage struct {
+	ID    string
 	Event string
 	Body  []byte
 }
 
+//ReplayResult is the response of the replay endpoint
+//Filtered is the amount of retained messages the listener's filter doesn't match
+type ReplayResult struct {
+	Listener string `json:"listener"`
+	Replayed int    `json:"replayed"`
+	Filtered int    `json:"filtered"`
+}
+
+//PublishResult is the response of the publish endpoint
+//Duplicate is set when the message has already been published with the same Idempotency-Key
+type PublishResult struct {
+	ID        string `json:"id"`
+	Event     string `json:"event"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
 //IsEmpty checks whether fields are not nil
 func (e *PublishMessage) IsEmpty() error {
 	if e.Event == "" {
@@ -47,3 +451,100 @@ func (e *PublishMessage) IsEmpty() error {
 
 	return nil
 }
+
+//Duration is time.Duration which is represented in json as a string, e.g. "1.5s"
+type Duration time.Duration
+
+//MarshalJSON encodes duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+//UnmarshalJSON decodes duration from a string like "300ms" or "2m"
+func (d *Duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"1s\" [%s]", string(bs))
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+//RetryPolicy defines how failed deliveries are retried
+//Delay before attempt n+1 is InitialInterval * Multiplier^(n-1), capped by MaxInterval
+//and randomly shifted by up to Jitter (fraction of the delay) in both directions
+//Delivery is given up after MaxAttempts attempts or once it's older than MaxAge
+//Zero fields mean "not set", see Merge
+type RetryPolicy struct {
+	MaxAttempts     int      `json:"max_attempts,omitempty"`
+	InitialInterval Duration `json:"initial_interval,omitempty"`
+	MaxInterval     Duration `json:"max_interval,omitempty"`
+	Multiplier      float64  `json:"multiplier,omitempty"`
+	Jitter          float64  `json:"jitter,omitempty"`
+	MaxAge          Duration `json:"max_age,omitempty"`
+}
+
+//Validate checks whether policy values are in the allowed ranges
+func (p *RetryPolicy) Validate() error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("negative 'MaxAttempts' field. Validation error [%v]", p)
+	}
+	if p.InitialInterval < 0 || p.MaxInterval < 0 || p.MaxAge < 0 {
+		return fmt.Errorf("negative interval. Validation error [%v]", p)
+	}
+	if p.Multiplier != 0 && p.Multiplier < 1 {
+		return fmt.Errorf("'Multiplier' field should be >= 1. Validation error [%v]", p)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("'Jitter' field should be in range [0, 1]. Validation error [%v]", p)
+	}
+	return nil
+}
+
+//Merge returns copy of the policy with non-zero fields of o applied on top of it
+//o can be nil
+func (p RetryPolicy) Merge(o *RetryPolicy) RetryPolicy {
+	if o == nil {
+		return p
+	}
+	if o.MaxAttempts != 0 {
+		p.MaxAttempts = o.MaxAttempts
+	}
+	if o.InitialInterval != 0 {
+		p.InitialInterval = o.InitialInterval
+	}
+	if o.MaxInterval != 0 {
+		p.MaxInterval = o.MaxInterval
+	}
+	if o.Multiplier != 0 {
+		p.Multiplier = o.Multiplier
+	}
+	if o.Jitter != 0 {
+		p.Jitter = o.Jitter
+	}
+	if o.MaxAge != 0 {
+		p.MaxAge = o.MaxAge
+	}
+	return p
+}
+
+//Backoff returns the delay before the next attempt when attempt attempts have already failed
+//rnd is a random value in range [0, 1) used for the jitter
+func (p RetryPolicy) Backoff(attempt int, rnd float64) time.Duration {
+	delay := float64(p.InitialInterval)
+	for i := 1; i < attempt; i++ {
+		delay *= p.Multiplier
+		if p.MaxInterval > 0 && delay >= float64(p.MaxInterval) {
+			break
+		}
+	}
+	if p.MaxInterval > 0 && delay > float64(p.MaxInterval) {
+		delay = float64(p.MaxInterval)
+	}
+	delay += delay * p.Jitter * (2*rnd - 1)
+	return time.Duration(delay)
+}
@@ -1,6 +1,11 @@
 package models
 
-import "testing"
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestListener_IsEmpty(t *testing.T) {
 	tests := []struct {
@@ -41,3 +46,230 @@ func TestPublishMessage_IsEmpty(t *testing.T) {
 		})
 	}
 }
+
+func TestRetryPolicy_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		p     RetryPolicy
+		valid bool
+	}{
+		{name: "Empty", p: RetryPolicy{}, valid: true},
+		{name: "Valid", p: RetryPolicy{MaxAttempts: 3, InitialInterval: Duration(time.Second), Multiplier: 1.5, Jitter: 0.5}, valid: true},
+		{name: "Negative attempts", p: RetryPolicy{MaxAttempts: -1}},
+		{name: "Negative interval", p: RetryPolicy{InitialInterval: Duration(-time.Second)}},
+		{name: "Small multiplier", p: RetryPolicy{Multiplier: 0.5}},
+		{name: "Big jitter", p: RetryPolicy{Jitter: 1.5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.p.Validate(); (err == nil) != test.valid {
+				t.Logf("[%s] - Test failure. Expected valid [%t], but got [%v]", test.name, test.valid, err)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout Duration
+		method  string
+		codes   []string
+		valid   bool
+	}{
+		{name: "Empty", valid: true},
+		{name: "Valid", timeout: Duration(time.Second * 10), method: "PUT", codes: []string{"2xx", "302"}, valid: true},
+		{name: "Negative timeout", timeout: Duration(-time.Second)},
+		{name: "Long timeout", timeout: Duration(time.Hour)},
+		{name: "Unknown method", method: "GET"},
+		{name: "Lowercase method", method: "post"},
+		{name: "Unknown class", codes: []string{"6xx"}},
+		{name: "Short code", codes: []string{"20"}},
+		{name: "Partial class", codes: []string{"20x"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := ValidateRequest(test.timeout, test.method, test.codes); (err == nil) != test.valid {
+				t.Logf("[%s] - Test failure. Expected valid [%t], but got [%v]", test.name, test.valid, err)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestAccepted(t *testing.T) {
+	tests := []struct {
+		name     string
+		codes    []string
+		status   int
+		expected bool
+	}{
+		{name: "Default", status: 200, expected: true},
+		{name: "Default created", status: 201},
+		{name: "Class", codes: []string{"2xx"}, status: 204, expected: true},
+		{name: "Class mismatch", codes: []string{"2xx"}, status: 302},
+		{name: "Exact", codes: []string{"202"}, status: 202, expected: true},
+		{name: "Exact mismatch", codes: []string{"202"}, status: 200},
+		{name: "Several", codes: []string{"202", "3xx"}, status: 301, expected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := Accepted(test.codes, test.status); actual != test.expected {
+				t.Logf("[%s] - Test failure. Expected [%t], but got [%t]", test.name, test.expected, actual)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_Merge(t *testing.T) {
+	base := RetryPolicy{MaxAttempts: 5, InitialInterval: Duration(time.Second), Multiplier: 2}
+
+	merged := base.Merge(&RetryPolicy{MaxAttempts: 2})
+
+	expected := RetryPolicy{MaxAttempts: 2, InitialInterval: Duration(time.Second), Multiplier: 2}
+	if merged != expected {
+		t.Logf("Expected [%v], but got [%v]", expected, merged)
+		t.Fail()
+	}
+	if base.Merge(nil) != base {
+		t.Logf("Expected [%v], but got [%v]", base, base.Merge(nil))
+		t.Fail()
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{InitialInterval: Duration(time.Second), MaxInterval: Duration(5 * time.Second), Multiplier: 2, Jitter: 0.5}
+	tests := []struct {
+		attempt  int
+		rnd      float64
+		expected time.Duration
+	}{
+		{attempt: 1, rnd: 0.5, expected: time.Second},
+		{attempt: 2, rnd: 0.5, expected: 2 * time.Second},
+		{attempt: 3, rnd: 0.5, expected: 4 * time.Second},
+		{attempt: 10, rnd: 0.5, expected: 5 * time.Second},
+		{attempt: 1, rnd: 0, expected: 500 * time.Millisecond},
+		{attempt: 1, rnd: 1, expected: 1500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if actual := p.Backoff(test.attempt, test.rnd); actual != test.expected {
+			t.Logf("Attempt [%d] rnd [%v]: expected [%s], but got [%s]", test.attempt, test.rnd, test.expected, actual)
+			t.Fail()
+		}
+	}
+}
+
+func TestDuration_JSON(t *testing.T) {
+	var p RetryPolicy
+	if err := json.Unmarshal([]byte(`{"initial_interval":"1.5s"}`), &p); err != nil {
+		t.Fatalf("Unexpected error [%v]", err)
+	}
+	if time.Duration(p.InitialInterval) != 1500*time.Millisecond {
+		t.Logf("Expected [1.5s], but got [%s]", time.Duration(p.InitialInterval))
+		t.Fail()
+	}
+	bs, _ := json.Marshal(p)
+	if string(bs) != `{"initial_interval":"1.5s"}` {
+		t.Logf("Expected [%s], but got [%s]", `{"initial_interval":"1.5s"}`, string(bs))
+		t.Fail()
+	}
+	if err := json.Unmarshal([]byte(`{"initial_interval":15}`), &p); err == nil {
+		t.Log("Expected error for non-string duration")
+		t.Fail()
+	}
+}
+
+func TestListenerUpdate_Apply(t *testing.T) {
+	addr := "http://localhost:8091"
+	retry := &RetryPolicy{MaxAttempts: 1}
+	filter := `body.region == "eu"`
+	concurrency := 2
+	ordered, unordered, partition := true, false, "body.customer"
+	timeout, method := Duration(time.Second*10), "PUT"
+	current := []Listener{
+		{Event: "b", Name: "l", Address: "http://localhost:8090/b", Retry: retry, MaxConcurrency: 1},
+		{Event: "a", Name: "l", Address: "http://localhost:8090/a"},
+	}
+	tests := []struct {
+		name     string
+		u        ListenerUpdate
+		expected []Listener
+	}{
+		{name: "Address", u: ListenerUpdate{Address: &addr}, expected: []Listener{
+			{Event: "a", Name: "l", Address: addr},
+			{Event: "b", Name: "l", Address: addr, Retry: retry, MaxConcurrency: 1},
+		}},
+		{name: "Events", u: ListenerUpdate{Events: []string{"b", "c", "c"}}, expected: []Listener{
+			{Event: "b", Name: "l", Address: "http://localhost:8090/b", Retry: retry, MaxConcurrency: 1},
+			{Event: "c", Name: "l", Address: "http://localhost:8090/a"},
+		}},
+		{name: "Replace", u: ListenerUpdate{Address: &addr, Events: []string{"b"}, Replace: true}, expected: []Listener{
+			{Event: "b", Name: "l", Address: addr},
+		}},
+		{name: "Filter", u: ListenerUpdate{Filter: &filter}, expected: []Listener{
+			{Event: "a", Name: "l", Address: "http://localhost:8090/a", Filter: filter},
+			{Event: "b", Name: "l", Address: "http://localhost:8090/b", Retry: retry, Filter: filter, MaxConcurrency: 1},
+		}},
+		{name: "Ordered", u: ListenerUpdate{Ordered: &ordered, PartitionKey: &partition}, expected: []Listener{
+			{Event: "a", Name: "l", Address: "http://localhost:8090/a", Ordered: true, PartitionKey: partition},
+			{Event: "b", Name: "l", Address: "http://localhost:8090/b", Retry: retry, MaxConcurrency: 1, Ordered: true, PartitionKey: partition},
+		}},
+		{name: "PartitionNotOrdered", u: ListenerUpdate{Ordered: &unordered, PartitionKey: &partition}, expected: []Listener{
+			{Event: "a", Name: "l", Address: "http://localhost:8090/a"},
+			{Event: "b", Name: "l", Address: "http://localhost:8090/b", Retry: retry, MaxConcurrency: 1},
+		}},
+		{name: "Request", u: ListenerUpdate{Timeout: &timeout, Method: &method, SuccessCodes: []string{"2xx"}}, expected: []Listener{
+			{Event: "a", Name: "l", Address: "http://localhost:8090/a", Timeout: timeout, Method: method, SuccessCodes: []string{"2xx"}},
+			{Event: "b", Name: "l", Address: "http://localhost:8090/b", Retry: retry, MaxConcurrency: 1, Timeout: timeout, Method: method, SuccessCodes: []string{"2xx"}},
+		}},
+		{name: "Suspended", u: ListenerUpdate{Suspended: &ordered}, expected: []Listener{
+			{Event: "a", Name: "l", Address: "http://localhost:8090/a", Suspended: true},
+			{Event: "b", Name: "l", Address: "http://localhost:8090/b", Retry: retry, MaxConcurrency: 1, Suspended: true},
+		}},
+		{name: "Pending", u: ListenerUpdate{Address: &addr, Events: []string{"a", "b", "c"}, Pending: []string{"b", "c"}}, expected: []Listener{
+			{Event: "a", Name: "l", Address: addr},
+			{Event: "b", Name: "l", Address: "http://localhost:8090/b", Retry: retry, MaxConcurrency: 1},
+		}},
+		{name: "MaxConcurrency", u: ListenerUpdate{MaxConcurrency: &concurrency}, expected: []Listener{
+			{Event: "a", Name: "l", Address: "http://localhost:8090/a", MaxConcurrency: 2},
+			{Event: "b", Name: "l", Address: "http://localhost:8090/b", Retry: retry, MaxConcurrency: 2},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := test.u.Apply("l", current); !reflect.DeepEqual(actual, test.expected) {
+				t.Logf("Expected [%v], but got [%v]", test.expected, actual)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestListenerUpdate_ValidateFor(t *testing.T) {
+	ordered, partition := true, "body.customer"
+	mixed := []Listener{
+		{Event: "a", Name: "l", Address: "http://localhost:8090/a", Ordered: true},
+		{Event: "b", Name: "l", Address: "http://localhost:8090/b"},
+	}
+	tests := []struct {
+		name    string
+		u       ListenerUpdate
+		current []Listener
+		fails   bool
+	}{
+		{name: "PartitionOrdered", u: ListenerUpdate{PartitionKey: &partition}, current: mixed[:1]},
+		{name: "PartitionNotOrdered", u: ListenerUpdate{PartitionKey: &partition}, current: mixed, fails: true},
+		{name: "PartitionAndOrdered", u: ListenerUpdate{Ordered: &ordered, PartitionKey: &partition}, current: mixed},
+		{name: "NoPartition", u: ListenerUpdate{}, current: mixed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.u.ValidateFor(test.current); (err != nil) != test.fails {
+				t.Logf("Expected failure [%t], but got [%v]", test.fails, err)
+				t.Fail()
+			}
+		})
+	}
+}
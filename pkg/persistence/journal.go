@@ -0,0 +1,203 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/volodimyr/publisher/pkg/models"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	journalFile  = "journal.log"
+
+	opAdd     = "add"
+	opDiscard = "discard"
+	opUpdate  = "update"
+)
+
+//entry is a single line of the append-only journal
+//Listener is set for opAdd, Name and optional Event for opDiscard, Name and Listeners for opUpdate
+type entry struct {
+	Op        string            `json:"op"`
+	Listener  *models.Listener  `json:"listener,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	Event     string            `json:"event,omitempty"`
+	Listeners []models.Listener `json:"listeners,omitempty"`
+}
+
+//matches reports whether opDiscard entry removes anything from events
+func (e *entry) matches(events models.Events) bool {
+	for event, listeners := range events {
+		if e.Event != "" && e.Event != event {
+			continue
+		}
+		if _, ok := listeners[e.Name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+//apply replays entry on top of events and returns events which have been left without listeners
+//Such events are deleted, so they don't pile up as listeners come and go
+func (e *entry) apply(events models.Events) []string {
+	var emptied []string
+	switch e.Op {
+	case opAdd:
+		put(events, *e.Listener)
+	case opDiscard:
+		for event, listeners := range events {
+			if e.Event == "" || e.Event == event {
+				delete(listeners, e.Name)
+			}
+		}
+	case opUpdate:
+		for _, listeners := range events {
+			delete(listeners, e.Name)
+		}
+		for _, l := range e.Listeners {
+			put(events, l)
+		}
+	}
+	for event, listeners := range events {
+		if len(listeners) == 0 {
+			delete(events, event)
+			emptied = append(emptied, event)
+		}
+	}
+	return emptied
+}
+
+func put(events models.Events, l models.Listener) {
+	if reg, ok := events[l.Event]; ok {
+		reg[l.Name] = l
+		return
+	}
+	events[l.Event] = map[string]models.Listener{l.Name: l}
+}
+
+//journal keeps registry on disk as a snapshot plus an append-only log of changes made after it
+//Replaying the log is idempotent, so crash between writing snapshot and truncating log is harmless
+type journal struct {
+	dir    string
+	file   *os.File
+	logger *log.Logger
+}
+
+//openJournal restores events from dir and opens the log for appending
+//dir is created if it doesn't exist, files are readable by the owner only since listeners keep their secrets there
+func openJournal(dir string, logger *log.Logger) (*journal, models.Events, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+	events := make(models.Events, 10)
+	bs, err := ioutil.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(bs, &events); err != nil {
+			return nil, nil, fmt.Errorf("corrupted snapshot [%v]", err)
+		}
+	}
+	replayed, err := replay(filepath.Join(dir, journalFile), events, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	//journal may have been created by the version which didn't restrict it
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	logger.Printf("Restored [%d] events from [%s], replayed [%d] journal entries\n", len(events), dir, replayed)
+	return &journal{dir: dir, file: f, logger: logger}, events, nil
+}
+
+//replay applies every complete entry of the log at path to events
+//A torn last line, left by a crash in the middle of a write, is skipped
+func replay(path string, events models.Events, logger *log.Logger) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var e entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			logger.Printf("Skipped unreadable journal entry [%s] [%v]\n", sc.Text(), err)
+			continue
+		}
+		if e.Op == opAdd && e.Listener == nil {
+			continue
+		}
+		e.apply(events)
+		n++
+	}
+	return n, sc.Err()
+}
+
+//append writes entry to the log and syncs it to disk
+func (j *journal) append(e entry) error {
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(bs, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+//snapshot atomically replaces snapshot with events and truncates the log
+func (j *journal) snapshot(events models.Events) error {
+	bs, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(j.dir, snapshotFile+".tmp")
+	if err := writeSync(tmp, bs); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(j.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+func writeSync(path string, bs []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,47 @@
+package persistence
+
+import (
+	"errors"
+	"github.com/volodimyr/publisher/pkg/models"
+)
+
+var (
+	//ErrNotFound is returned when requested event or listener isn't registered
+	ErrNotFound = errors.New("persistence: not found")
+	//ErrClosed is returned when registry has been stopped
+	ErrClosed = errors.New("persistence: registry is closed")
+)
+
+const (
+	//OpRegister is a Change made by Registry.Register
+	OpRegister = "register"
+	//OpUnregister is a Change made by Registry.Unregister, only Listener.Name and Listener.Event are set
+	OpUnregister = "unregister"
+	//OpUpdate is a Change made by Registry.Update, only Listener.Name is set
+	OpUpdate = "update"
+)
+
+//Change describes a single modification of the registry
+type Change struct {
+	Op       string
+	Listener models.Listener
+}
+
+//Registry keeps listeners subscribed to the events
+//Storage is the in-memory and file-backed implementation, other backends only need to satisfy this interface
+type Registry interface {
+	//Register adds listener into its event, listener with the same name in this event is replaced
+	Register(l models.Listener) error
+	//Unregister removes listener with the name from the event, empty event means from every event
+	//returns ErrNotFound if the listener isn't subscribed to it
+	Unregister(name, event string) error
+	//Update atomically applies u to every subscription of the listener with the name
+	//returns subscriptions after the update or ErrNotFound if the listener isn't registered
+	Update(name string, u models.ListenerUpdate) ([]models.Listener, error)
+	//Lookup returns listeners of the event, ErrNotFound if the event isn't registered
+	Lookup(event string) ([]models.Listener, error)
+	//List returns all events with their listeners, the result is a copy and can be modified
+	List() (models.Events, error)
+	//Subscribe returns channel of the registry changes and a function to cancel the subscription
+	Subscribe() (<-chan Change, func())
+}
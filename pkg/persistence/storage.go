@@ -1,88 +1,360 @@
 package persistence
 
 import (
-	"github.com/volodimyr/publisher/pkg/client"
 	"github.com/volodimyr/publisher/pkg/models"
+	"github.com/volodimyr/publisher/pkg/topic"
 	"log"
+	"sort"
+	"sync"
+	"time"
 )
 
+//Storage is the goroutine backed Registry
+//Every change and read is a type of work handled by the single service goroutine,
+//events are never touched outside of it, so the only way in is the Registry methods
 type Storage struct {
-	models.Events
-	New       chan Add
-	Discard   chan Discard
-	Broadcast chan Publish
-	Stop      chan struct{}
+	events   models.Events
+	topics   *topic.Trie
+	adds     chan add
+	discards chan discard
+	updates  chan update
+	queries  chan query
+	stop     chan struct{}
+
+	journal  *journal
+	snapshot time.Duration
+	stopped  chan struct{}
+
+	mu          sync.Mutex
+	subscribers map[chan Change]struct{}
 }
 
+//New creates in-memory Storage and starts its service goroutine
 func New(l *log.Logger) *Storage {
-	s := &Storage{
-		Events:    make(map[string]map[string]string, 10),
-		New:       make(chan Add, 10),
-		Discard:   make(chan Discard, 10),
-		Broadcast: make(chan Publish, 10),
-		Stop:      make(chan struct{}),
-	}
+	s := newStorage(make(models.Events, 10))
 	go s.service(l)
 	return s
 }
 
-//Publish is a type of work for broadcasting message between whole event: []listeners
-//PublishMessage defines event and therefore listeners where messsage should be published
-//Done uses for notifying caller everything is done
-type Publish struct {
-	Done chan struct{}
-	models.PublishMessage
+//Open creates file-backed Storage in dir and starts its service goroutine
+//Registrations are restored from the latest snapshot and the journal written after it,
+//every change is appended to the journal and the snapshot is rewritten every snapshotEvery
+func Open(l *log.Logger, dir string, snapshotEvery time.Duration) (*Storage, error) {
+	j, events, err := openJournal(dir, l)
+	if err != nil {
+		return nil, err
+	}
+	s := newStorage(events)
+	s.journal = j
+	s.snapshot = snapshotEvery
+	go s.service(l)
+	return s, nil
+}
+
+func newStorage(events models.Events) *Storage {
+	topics := topic.NewTrie()
+	for event := range events {
+		topics.Add(event)
+	}
+	return &Storage{
+		events:   events,
+		topics:   topics,
+		adds:     make(chan add, 10),
+		discards: make(chan discard, 10),
+		updates:  make(chan update, 10),
+		queries:  make(chan query, 10),
+		stop:     make(chan struct{}),
+
+		stopped:     make(chan struct{}),
+		subscribers: make(map[chan Change]struct{}),
+	}
 }
 
-//Add is a type of work using to add new event: listeners{}
-//Done uses for notifying caller everything is done
-type Add struct {
-	Done chan struct{}
+//Close stops the service and waits until the journal is flushed
+func (s *Storage) Close() {
+	s.stop <- struct{}{}
+	<-s.stopped
+}
+
+//add is a type of work using to add new event: listeners{}
+//done uses for notifying caller everything is done
+type add struct {
+	done chan struct{}
 	models.Listener
 }
 
-//Discard is a type of work to remove a specific listener
-//Name is the listener name
-//Done uses for notifying caller everything is done
-type Discard struct {
-	Name string
-	Done chan struct{}
+//discard is a type of work to remove a specific listener
+//name is the listener name, event limits removal to a single event, empty event means all of them
+//done receives whether anything has been removed
+type discard struct {
+	name  string
+	event string
+	done  chan bool
+}
+
+//update is a type of work to change every subscription of a specific listener at once
+//done receives subscriptions after the update, nil if there is no such listener
+type update struct {
+	name string
+	models.ListenerUpdate
+	done chan []models.Listener
+}
+
+//query is a type of work to read registered listeners
+//event limits result to the events whose pattern matches it, empty event means all of them
+//done receives copy of the matched events, so it can be used outside the service goroutine
+type query struct {
+	event string
+	done  chan models.Events
+}
+
+//Register adds listener into its event, it implements Registry
+func (s *Storage) Register(l models.Listener) error {
+	done := make(chan struct{}, 1)
+	select {
+	case s.adds <- add{Listener: l, done: done}:
+	case <-s.stopped:
+		return ErrClosed
+	}
+	select {
+	case <-done:
+	case <-s.stopped:
+		return ErrClosed
+	}
+	s.notify(Change{Op: OpRegister, Listener: l})
+	return nil
+}
+
+//Unregister removes listener from the event or from every event, it implements Registry
+func (s *Storage) Unregister(name, event string) error {
+	done := make(chan bool, 1)
+	select {
+	case s.discards <- discard{name: name, event: event, done: done}:
+	case <-s.stopped:
+		return ErrClosed
+	}
+	select {
+	case removed := <-done:
+		if !removed {
+			return ErrNotFound
+		}
+	case <-s.stopped:
+		return ErrClosed
+	}
+	s.notify(Change{Op: OpUnregister, Listener: models.Listener{Name: name, Event: event}})
+	return nil
+}
+
+//Update changes every subscription of the listener, it implements Registry
+func (s *Storage) Update(name string, u models.ListenerUpdate) ([]models.Listener, error) {
+	done := make(chan []models.Listener, 1)
+	select {
+	case s.updates <- update{name: name, ListenerUpdate: u, done: done}:
+	case <-s.stopped:
+		return nil, ErrClosed
+	}
+	select {
+	case listeners := <-done:
+		if listeners == nil {
+			return nil, ErrNotFound
+		}
+		s.notify(Change{Op: OpUpdate, Listener: models.Listener{Name: name}})
+		return listeners, nil
+	case <-s.stopped:
+		return nil, ErrClosed
+	}
+}
+
+//Lookup returns listeners of the event, it implements Registry
+//Listener subscribed to several matching patterns is returned once, the exact subscription wins
+func (s *Storage) Lookup(event string) ([]models.Listener, error) {
+	events, err := s.read(event)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, ErrNotFound
+	}
+	byName := make(map[string]models.Listener)
+	for _, l := range events[event] {
+		byName[l.Name] = l
+	}
+	patterns := make([]string, 0, len(events))
+	for pattern := range events {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		for name, l := range events[pattern] {
+			if _, ok := byName[name]; !ok {
+				byName[name] = l
+			}
+		}
+	}
+	listeners := make([]models.Listener, 0, len(byName))
+	for _, l := range byName {
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+//List returns copy of all events with their listeners, it implements Registry
+func (s *Storage) List() (models.Events, error) {
+	return s.read("")
+}
+
+//Subscribe returns channel of the registry changes, it implements Registry
+//Slow subscriber misses changes instead of blocking the registry
+func (s *Storage) Subscribe() (<-chan Change, func()) {
+	ch := make(chan Change, 100)
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.subscribers, ch)
+			s.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (s *Storage) read(event string) (models.Events, error) {
+	done := make(chan models.Events, 1)
+	select {
+	case s.queries <- query{event: event, done: done}:
+	case <-s.stopped:
+		return nil, ErrClosed
+	}
+	select {
+	case events := <-done:
+		return events, nil
+	case <-s.stopped:
+		return nil, ErrClosed
+	}
+}
+
+func (s *Storage) notify(c Change) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- c:
+		default:
+		}
+	}
 }
 
 func (s *Storage) service(logger *log.Logger) {
+	defer close(s.stopped)
 	logger.Println("Publisher service is online")
+	var tick <-chan time.Time
+	if s.journal != nil && s.snapshot > 0 {
+		t := time.NewTicker(s.snapshot)
+		defer t.Stop()
+		tick = t.C
+	}
 	for {
 		select {
-		case n := <-s.New:
+		case n := <-s.adds:
+			s.persist(logger, entry{Op: opAdd, Listener: &n.Listener})
+			s.topics.Add(n.Listener.Event)
 			//register new listener into existing event
-			if reg, ok := s.Events[n.Listener.Event]; ok {
-				reg[n.Listener.Name] = n.Listener.Address
-				n.Done <- struct{}{}
-				logger.Printf("Registered new listener [%v] into existing event [%s]\n", n.Listener, s.Events[n.Listener.Event])
+			if reg, ok := s.events[n.Listener.Event]; ok {
+				reg[n.Listener.Name] = n.Listener
+				n.done <- struct{}{}
+				logger.Printf("Registered new listener [%v] into existing event [%s]\n", n.Listener.Redacted(), n.Listener.Event)
 				continue
 			}
 			//create new event and add new listener
-			s.Events[n.Listener.Event] = map[string]string{n.Listener.Name: n.Listener.Address}
+			s.events[n.Listener.Event] = map[string]models.Listener{n.Listener.Name: n.Listener}
 			logger.Printf("Created new event [%s] and registered new listener [%s]\n", n.Listener.Event, n.Listener.Name)
-			n.Done <- struct{}{}
-		case d := <-s.Discard:
-			for _, Listeners := range s.Events {
-				if _, ok := Listeners[d.Name]; ok {
-					delete(Listeners, d.Name)
+			n.done <- struct{}{}
+		case d := <-s.discards:
+			e := entry{Op: opDiscard, Name: d.name, Event: d.event}
+			if !e.matches(s.events) {
+				d.done <- false
+				continue
+			}
+			s.persist(logger, e)
+			s.forget(e.apply(s.events))
+			logger.Printf("Discard executed for the next listeners [%s] event [%s]\n", d.name, d.event)
+			d.done <- true
+		case u := <-s.updates:
+			var current []models.Listener
+			for _, listeners := range s.events {
+				if l, ok := listeners[u.name]; ok {
+					current = append(current, l)
 				}
 			}
-			logger.Printf("Discard executed for the next listeners [%s]\n", d.Name)
-			d.Done <- struct{}{}
-		case b := <-s.Broadcast:
-			for name, url := range s.Events[b.PublishMessage.Event] {
-				logger.Printf("Sending event to the next listener: [%s] at [%s]\n", name, url)
-				client.DoPOST(url, b.PublishMessage.Body, logger)
+			if len(current) == 0 {
+				u.done <- nil
+				continue
+			}
+			e := entry{Op: opUpdate, Name: u.name, Listeners: u.Apply(u.name, current)}
+			s.persist(logger, e)
+			s.forget(e.apply(s.events))
+			for _, l := range e.Listeners {
+				s.topics.Add(l.Event)
+			}
+			logger.Printf("Updated listener [%s], subscribed to [%d] events\n", u.name, len(e.Listeners))
+			u.done <- e.Listeners
+		case q := <-s.queries:
+			q.done <- s.copy(q.event)
+		case <-tick:
+			if err := s.journal.snapshot(s.events); err != nil {
+				logger.Printf("Couldn't write snapshot [%v]\n", err)
+			}
+		case <-s.stop:
+			if s.journal != nil {
+				if err := s.journal.snapshot(s.events); err != nil {
+					logger.Printf("Couldn't write snapshot [%v]\n", err)
+				}
+				s.journal.close()
 			}
-			logger.Printf("Broadcasted message for the event [%s]\n", b.PublishMessage.Event)
-			b.Done <- struct{}{}
-		case <-s.Stop:
 			logger.Println("Publisher service is offline")
 			return
 		}
 	}
 }
+
+//forget removes patterns of the events which have been left without listeners
+func (s *Storage) forget(events []string) {
+	for _, event := range events {
+		s.topics.Remove(event)
+	}
+}
+
+//copy returns deep copy of the events matching event or of all events when event is empty
+func (s *Storage) copy(event string) models.Events {
+	events := make(models.Events)
+	var names []string
+	if event == "" {
+		for name := range s.events {
+			names = append(names, name)
+		}
+	} else {
+		names = s.topics.Match(event)
+	}
+	for _, name := range names {
+		reg := s.events[name]
+		listeners := make(map[string]models.Listener, len(reg))
+		for k, v := range reg {
+			listeners[k] = v
+		}
+		events[name] = listeners
+	}
+	return events
+}
+
+//persist appends change to the journal before it's applied, in-memory storage skips it
+func (s *Storage) persist(logger *log.Logger, e entry) {
+	if s.journal == nil {
+		return
+	}
+	if err := s.journal.append(e); err != nil {
+		logger.Printf("Couldn't write [%s] into the journal, change won't survive restart [%v]\n", e.Op, err)
+	}
+}
@@ -0,0 +1,253 @@
+package persistence
+
+import (
+	"github.com/volodimyr/publisher/pkg/models"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var logger = log.New(os.Stdout, "test: ", log.LstdFlags|log.Lshortfile)
+
+func list(t *testing.T, s *Storage) models.Events {
+	events, err := s.List()
+	if err != nil {
+		t.Fatalf("Couldn't list events [%v]", err)
+	}
+	return events
+}
+
+func TestOpenReplaysRegistrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "publisher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	retry := &models.RetryPolicy{MaxAttempts: 3}
+
+	//snapshot interval is long enough for the changes to stay in the journal only
+	s, err := Open(logger, dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Register(models.Listener{Event: "e1", Name: "l1", Address: "http://localhost:8090/l1", Retry: retry})
+	s.Register(models.Listener{Event: "e1", Name: "l2", Address: "http://localhost:8090/l2"})
+	s.Register(models.Listener{Event: "e2", Name: "l2", Address: "http://localhost:8090/l2"})
+	s.Unregister("l2", "")
+	//simulate crash: s is abandoned without Close, so nothing is compacted into the snapshot
+
+	restored, err := Open(logger, dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := models.Events{
+		"e1": {"l1": {Event: "e1", Name: "l1", Address: "http://localhost:8090/l1", Retry: retry}},
+	}
+	if actual := list(t, restored); !reflect.DeepEqual(actual, expected) {
+		t.Logf("Expected [%v], but got [%v]", expected, actual)
+		t.Fail()
+	}
+
+	restored.Register(models.Listener{Event: "e3", Name: "l3", Address: "http://localhost:8090/l3"})
+	restored.Register(models.Listener{Event: "e4", Name: "l4", Address: "http://localhost:8090/l4"})
+	addr := "http://localhost:8091/l4"
+	if _, err := restored.Update("l4", models.ListenerUpdate{Address: &addr}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.Update("unknown", models.ListenerUpdate{Address: &addr}); err != ErrNotFound {
+		t.Logf("Expected [%v], but got [%v]", ErrNotFound, err)
+		t.Fail()
+	}
+	restored.Close()
+	if info, err := os.Stat(filepath.Join(dir, journalFile)); err != nil || info.Size() != 0 {
+		t.Logf("Expected journal to be compacted on close [%v]", err)
+		t.Fail()
+	}
+
+	reopened, err := Open(logger, dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	expected["e3"] = map[string]models.Listener{"l3": {Event: "e3", Name: "l3", Address: "http://localhost:8090/l3"}}
+	expected["e4"] = map[string]models.Listener{"l4": {Event: "e4", Name: "l4", Address: addr}}
+	if actual := list(t, reopened); !reflect.DeepEqual(actual, expected) {
+		t.Logf("Expected [%v], but got [%v]", expected, actual)
+		t.Fail()
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "publisher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "data")
+	s, err := Open(logger, dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Register(models.Listener{Event: "e1", Name: "l1", Address: "http://localhost:8090/l1", Secrets: []string{"secret"}})
+	s.Close()
+	//secrets are kept in plaintext, so nobody but the owner can read them
+	for path, expected := range map[string]os.FileMode{dir: 0700, filepath.Join(dir, journalFile): 0600, filepath.Join(dir, snapshotFile): 0600} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != expected {
+			t.Logf("[%s] Expected [%v], but got [%v]", path, expected, info.Mode().Perm())
+			t.Fail()
+		}
+	}
+}
+
+func TestReplaySkipsTornEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "publisher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := `{"op":"add","listener":{"event":"e1","name":"l1","address":"http://localhost:8090/l1"}}
+{"op":"add","listener":{"event":"e1","na`
+	if err := ioutil.WriteFile(filepath.Join(dir, journalFile), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j, events, err := openJournal(dir, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	if len(events["e1"]) != 1 {
+		t.Logf("Expected single listener to be replayed, but got [%v]", events)
+		t.Fail()
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	var r Registry = New(logger)
+	changes, cancel := r.Subscribe()
+	defer cancel()
+	l := models.Listener{Event: "e1", Name: "l1", Address: "http://localhost:8090/l1"}
+
+	if err := r.Register(l); err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := r.Lookup("e1")
+	if err != nil || len(listeners) != 1 || !reflect.DeepEqual(listeners[0], l) {
+		t.Logf("Expected [%v], but got [%v] [%v]", l, listeners, err)
+		t.Fail()
+	}
+	if _, err := r.Lookup("unknown"); err != ErrNotFound {
+		t.Logf("Expected [%v], but got [%v]", ErrNotFound, err)
+		t.Fail()
+	}
+	if err := r.Unregister("l1", "unknown"); err != ErrNotFound {
+		t.Logf("Expected [%v], but got [%v]", ErrNotFound, err)
+		t.Fail()
+	}
+	if err := r.Unregister("l1", ""); err != nil {
+		t.Fatal(err)
+	}
+	//event is gone along with its last listener
+	events, err := r.List()
+	if err != nil || len(events) != 0 {
+		t.Logf("Expected no events, but got [%v] [%v]", events, err)
+		t.Fail()
+	}
+	if _, err := r.Lookup("e1"); err != ErrNotFound {
+		t.Logf("Expected [%v], but got [%v]", ErrNotFound, err)
+		t.Fail()
+	}
+
+	expected := []Change{{Op: OpRegister, Listener: l}, {Op: OpUnregister, Listener: models.Listener{Name: "l1"}}}
+	for _, e := range expected {
+		if c := <-changes; !reflect.DeepEqual(c, e) {
+			t.Logf("Expected change [%v], but got [%v]", e, c)
+			t.Fail()
+		}
+	}
+
+	r.(*Storage).Close()
+	if err := r.Register(l); err != ErrClosed {
+		t.Logf("Expected [%v], but got [%v]", ErrClosed, err)
+		t.Fail()
+	}
+}
+
+func TestLookupWildcards(t *testing.T) {
+	s := New(logger)
+	defer s.Close()
+	for _, l := range []models.Listener{
+		{Event: "orders.created", Name: "billing", Address: "http://localhost:8090/exact"},
+		{Event: "orders.*", Name: "billing", Address: "http://localhost:8090/star"},
+		{Event: "orders.#", Name: "audit", Address: "http://localhost:8090/audit"},
+		{Event: "users.*", Name: "crm", Address: "http://localhost:8090/crm"},
+	} {
+		if err := s.Register(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		event    string
+		expected map[string]string
+	}{
+		{event: "orders.created", expected: map[string]string{"billing": "http://localhost:8090/exact", "audit": "http://localhost:8090/audit"}},
+		{event: "orders.paid", expected: map[string]string{"billing": "http://localhost:8090/star", "audit": "http://localhost:8090/audit"}},
+		{event: "orders.eu.paid", expected: map[string]string{"audit": "http://localhost:8090/audit"}},
+		{event: "users.created", expected: map[string]string{"crm": "http://localhost:8090/crm"}},
+	}
+	for _, test := range tests {
+		listeners, err := s.Lookup(test.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := make(map[string]string)
+		for _, l := range listeners {
+			actual[l.Name] = l.Address
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Logf("[%s] Expected [%v], but got [%v]", test.event, test.expected, actual)
+			t.Fail()
+		}
+	}
+	if _, err := s.Lookup("users"); err != ErrNotFound {
+		t.Logf("Expected [%v], but got [%v]", ErrNotFound, err)
+		t.Fail()
+	}
+}
+
+func TestPatternsForgotten(t *testing.T) {
+	s := New(logger)
+	for _, l := range []models.Listener{
+		{Event: "orders.*", Name: "billing", Address: "http://localhost:8090/billing"},
+		{Event: "orders.#", Name: "audit", Address: "http://localhost:8090/audit"},
+	} {
+		if err := s.Register(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Unregister("audit", ""); err != nil {
+		t.Fatal(err)
+	}
+	//billing moves away from its pattern, so orders.* has no listeners left either
+	if _, err := s.Update("billing", models.ListenerUpdate{Events: []string{"users.created"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Lookup("orders.created"); err != ErrNotFound {
+		t.Logf("Expected [%v], but got [%v]", ErrNotFound, err)
+		t.Fail()
+	}
+	//trie belongs to the service, it can be read once the service is stopped
+	s.Close()
+	if patterns := s.topics.Match("orders.created"); len(patterns) != 0 {
+		t.Logf("Expected patterns without listeners to be removed, but got [%v]", patterns)
+		t.Fail()
+	}
+}
@@ -1,6 +1,9 @@
 package resp
 
-import "net/http"
+import (
+	"encoding/json"
+	"net/http"
+)
 
 //OK uses to stablish OK response
 func OK(w http.ResponseWriter, msg string) {
@@ -15,3 +18,22 @@ func Created(w http.ResponseWriter, msg string) {
 	w.Header().Set("Content-type", "text/plain; charset=utf-8")
 	w.Write([]byte(msg))
 }
+
+//Accepted uses to notify client 'request has been accepted, but it isn't completed yet'
+func Accepted(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(msg))
+}
+
+//JSON encodes v as a response body with the given status code
+func JSON(w http.ResponseWriter, status int, v interface{}) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Couldn't encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(bs)
+}
@@ -5,13 +5,17 @@ import (
 	"time"
 )
 
+//WriteTimeout limits handling of a single request
+//It's longer than publisher.MaxWait, so publish waiting for the listeners still has time to respond
+const WriteTimeout = time.Second * 75
+
 //New makes custom server configuration
-func New(sm *http.ServeMux, addr string) *http.Server {
+func New(h http.Handler, addr string) *http.Server {
 	return &http.Server{
 		Addr:         addr,
 		ReadTimeout:  time.Second * 5,
-		WriteTimeout: time.Second * 10,
+		WriteTimeout: WriteTimeout,
 		IdleTimeout:  time.Second * 120,
-		Handler:      sm,
+		Handler:      h,
 	}
 }
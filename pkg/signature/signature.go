@@ -0,0 +1,123 @@
+//Package signature signs deliveries of the publisher and verifies them on the listener side
+//
+//Signature header looks like
+//	Publisher-Signature: t=1700000000,v1=5257a869e7ecebeda32affa62cdca3fa51cad7e77a0e56ff536d0ce8e108d8bd
+//where t is the unix time of the attempt and v1 is hex encoded HMAC-SHA256 of "{t}.{body}" with the listener's secret.
+//While secrets are rotated the header carries v1 for every active secret,
+//listener accepts the delivery when any of them matches any of its own secrets.
+//
+//Listener written in Go verifies delivery with
+//	body, _ := ioutil.ReadAll(r.Body)
+//	if err := signature.Verify(r.Header.Get(signature.Header), body, []string{secret}, signature.DefaultTolerance); err != nil {
+//		http.Error(w, err.Error(), http.StatusUnauthorized)
+//		return
+//	}
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//Header is the name of the http header carrying signature
+	Header = "Publisher-Signature"
+	//DefaultTolerance is the maximum age of a signature accepted by Verify, it limits replay attacks
+	DefaultTolerance = 5 * time.Minute
+	//MaxSecrets is the amount of simultaneously active secrets, the new one and the one being rotated out
+	MaxSecrets = 2
+
+	scheme = "v1"
+)
+
+var (
+	//ErrNoSignature is returned when header is empty or has no signatures of the known scheme
+	ErrNoSignature = errors.New("signature: no signature found")
+	//ErrInvalidHeader is returned when header can't be parsed
+	ErrInvalidHeader = errors.New("signature: invalid header")
+	//ErrExpired is returned when signature timestamp is outside of the tolerance
+	ErrExpired = errors.New("signature: timestamp outside of the tolerance")
+	//ErrMismatch is returned when none of the signatures matches any of the secrets
+	ErrMismatch = errors.New("signature: no signature matches")
+)
+
+//Sign returns hex encoded HMAC-SHA256 of the body signed at t with the secret
+func Sign(secret string, t time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(t.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Generate returns value of the signature header for the body signed at t with every secret
+func Generate(secrets []string, t time.Time, body []byte) string {
+	parts := make([]string, 0, len(secrets)+1)
+	parts = append(parts, "t="+strconv.FormatInt(t.Unix(), 10))
+	for _, secret := range secrets {
+		parts = append(parts, scheme+"="+Sign(secret, t, body))
+	}
+	return strings.Join(parts, ",")
+}
+
+//Verify checks signature header of the body against the secrets
+//tolerance <= 0 disables the timestamp check
+func Verify(header string, body []byte, secrets []string, tolerance time.Duration) error {
+	return verify(header, body, secrets, tolerance, time.Now())
+}
+
+func verify(header string, body []byte, secrets []string, tolerance time.Duration, now time.Time) error {
+	if header == "" {
+		return ErrNoSignature
+	}
+	var (
+		t          time.Time
+		timestamp  bool
+		signatures [][]byte
+	)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return ErrInvalidHeader
+		}
+		switch kv[0] {
+		case "t":
+			sec, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return ErrInvalidHeader
+			}
+			t = time.Unix(sec, 0)
+			timestamp = true
+		case scheme:
+			sig, err := hex.DecodeString(kv[1])
+			if err != nil {
+				//unknown encoding can't match anyway
+				continue
+			}
+			signatures = append(signatures, sig)
+		}
+	}
+	if !timestamp {
+		return ErrInvalidHeader
+	}
+	if len(signatures) == 0 {
+		return ErrNoSignature
+	}
+	if tolerance > 0 && (now.Sub(t) > tolerance || t.Sub(now) > tolerance) {
+		return ErrExpired
+	}
+	for _, secret := range secrets {
+		expected, _ := hex.DecodeString(Sign(secret, t, body))
+		for _, sig := range signatures {
+			if hmac.Equal(expected, sig) {
+				return nil
+			}
+		}
+	}
+	return ErrMismatch
+}
@@ -0,0 +1,51 @@
+package signature
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	now := time.Unix(1700000000, 0)
+	rotating := Generate([]string{"new", "old"}, now, body)
+	tests := []struct {
+		name     string
+		header   string
+		body     []byte
+		secrets  []string
+		now      time.Time
+		expected error
+	}{
+		{name: "Valid", header: Generate([]string{"secret"}, now, body), body: body, secrets: []string{"secret"}, now: now},
+		{name: "RotatingNew", header: rotating, body: body, secrets: []string{"new"}, now: now},
+		{name: "RotatingOld", header: rotating, body: body, secrets: []string{"old"}, now: now},
+		{name: "ListenerRotating", header: Generate([]string{"new"}, now, body), body: body, secrets: []string{"old", "new"}, now: now},
+		{name: "WrongSecret", header: rotating, body: body, secrets: []string{"other"}, now: now, expected: ErrMismatch},
+		{name: "TamperedBody", header: rotating, body: []byte(`{"id":2}`), secrets: []string{"new"}, now: now, expected: ErrMismatch},
+		{name: "Expired", header: rotating, body: body, secrets: []string{"new"}, now: now.Add(DefaultTolerance + time.Second), expected: ErrExpired},
+		{name: "FromFuture", header: rotating, body: body, secrets: []string{"new"}, now: now.Add(-DefaultTolerance - time.Second), expected: ErrExpired},
+		{name: "Empty", header: "", body: body, secrets: []string{"new"}, now: now, expected: ErrNoSignature},
+		{name: "NoSignature", header: "t=1700000000", body: body, secrets: []string{"new"}, now: now, expected: ErrNoSignature},
+		{name: "NoTimestamp", header: "v1=abcd", body: body, secrets: []string{"new"}, now: now, expected: ErrInvalidHeader},
+		{name: "Malformed", header: "t=now,v1=abcd", body: body, secrets: []string{"new"}, now: now, expected: ErrInvalidHeader},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := verify(test.header, test.body, test.secrets, DefaultTolerance, test.now); err != test.expected {
+				t.Logf("Expected [%v], but got [%v]", test.expected, err)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	header := Generate([]string{"new", "old"}, time.Unix(1700000000, 0), []byte("{}"))
+	parts := strings.Split(header, ",")
+	if len(parts) != 3 || parts[0] != "t=1700000000" || !strings.HasPrefix(parts[1], "v1=") || !strings.HasPrefix(parts[2], "v1=") {
+		t.Logf("Expected timestamp and two signatures, but got [%s]", header)
+		t.Fail()
+	}
+}
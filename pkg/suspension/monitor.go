@@ -0,0 +1,139 @@
+//Package suspension suspends listeners whose deliveries keep failing, so they don't waste deliveries forever
+package suspension
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/volodimyr/publisher/pkg/client"
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/models"
+	"github.com/volodimyr/publisher/pkg/persistence"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//Config defines when listener is suspended, zero value of a rule disables it
+//MaxFailures is the amount of failed attempts in a row
+//MaxFailing is how long attempts keep failing without a single success
+//Webhook is an optional address notified about every suspension with Notice, it isn't checked against egress policy
+type Config struct {
+	MaxFailures int
+	MaxFailing  time.Duration
+	Webhook     string
+}
+
+//Notice is sent to Config.Webhook when listener is suspended
+type Notice struct {
+	Listener  string    `json:"listener"`
+	Reason    string    `json:"reason"`
+	Suspended time.Time `json:"suspended"`
+}
+
+type failing struct {
+	failures int
+	since    time.Time
+}
+
+//Monitor counts failed attempts per listener and suspends it in the registry once a rule is broken
+//It implements dispatcher.Observer and is safe for concurrent use
+type Monitor struct {
+	logger  *log.Logger
+	r       persistence.Registry
+	cfg     Config
+	mu      sync.Mutex
+	failing map[string]*failing
+	//down are listeners suspended by the monitor, their attempts aren't counted until Reset
+	down    map[string]bool
+	now     func() time.Time
+	suspend func(name, reason string)
+}
+
+//New creates Monitor of the listeners in the registry
+//if logger == nil, default will be taken
+func New(logger *log.Logger, registry persistence.Registry, cfg Config) *Monitor {
+	if logger == nil {
+		logger = log.New(os.Stdout, "suspension: ", log.LstdFlags|log.Lshortfile)
+	}
+	m := &Monitor{logger: logger, r: registry, cfg: cfg, failing: make(map[string]*failing), down: make(map[string]bool), now: time.Now}
+	m.suspend = m.suspended
+	return m
+}
+
+//Attempted records outcome of the delivery attempt, it implements dispatcher.Observer
+//Listener is suspended in the background, so the worker isn't held up by the registry or the webhook
+func (m *Monitor) Attempted(dl dispatcher.Delivery, final bool) {
+	if len(dl.Attempts) == 0 {
+		return
+	}
+	a := dl.Attempts[len(dl.Attempts)-1]
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	//deliveries queued before the suspension keep failing, they'd count against the resumed listener
+	if m.down[dl.Name] {
+		return
+	}
+	if a.Error == "" {
+		delete(m.failing, dl.Name)
+		return
+	}
+	f, ok := m.failing[dl.Name]
+	if !ok {
+		f = &failing{since: a.Time}
+		m.failing[dl.Name] = f
+	}
+	f.failures++
+	reason := ""
+	switch {
+	case m.cfg.MaxFailures > 0 && f.failures >= m.cfg.MaxFailures:
+		reason = fmt.Sprintf("%d failed attempts in a row, the last one [%s]", f.failures, a.Error)
+	case m.cfg.MaxFailing > 0 && m.now().Sub(f.since) >= m.cfg.MaxFailing:
+		reason = fmt.Sprintf("attempts have been failing since [%s], the last one [%s]", f.since.Format(time.RFC3339), a.Error)
+	default:
+		return
+	}
+	delete(m.failing, dl.Name)
+	m.down[dl.Name] = true
+	go m.suspend(dl.Name, reason)
+}
+
+//Reset forgets failures of the listener, it should be called once the listener is resumed
+func (m *Monitor) Reset(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failing, name)
+	delete(m.down, name)
+}
+
+//suspended marks every subscription of the listener as suspended and notifies the webhook
+//Deliveries queued before the suspension keep failing, listener which is suspended already is left as it is
+func (m *Monitor) suspended(name, reason string) {
+	events, err := m.r.List()
+	if err != nil {
+		m.logger.Printf("Couldn't read listener [%s] [%v]\n", name, err)
+		return
+	}
+	for _, listeners := range events {
+		if l, ok := listeners[name]; ok && l.Suspended {
+			return
+		}
+	}
+	suspended := true
+	if _, err := m.r.Update(name, models.ListenerUpdate{Suspended: &suspended}); err != nil {
+		m.logger.Printf("Couldn't suspend listener [%s] [%v]\n", name, err)
+		m.Reset(name)
+		return
+	}
+	m.logger.Printf("Suspended listener [%s], %s\n", name, reason)
+	if m.cfg.Webhook == "" {
+		return
+	}
+	bs, _ := json.Marshal(Notice{Listener: name, Reason: reason, Suspended: m.now()})
+	resp, err := client.Notify(m.cfg.Webhook, bs, m.logger)
+	if err != nil {
+		m.logger.Printf("Couldn't notify [%s] about suspended listener [%s] [%v]\n", m.cfg.Webhook, name, err)
+		return
+	}
+	resp.Body.Close()
+}
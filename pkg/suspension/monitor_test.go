@@ -0,0 +1,152 @@
+package suspension
+
+import (
+	"encoding/json"
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/models"
+	"github.com/volodimyr/publisher/pkg/persistence"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+var logger = log.New(os.Stdout, "test: ", log.LstdFlags|log.Lshortfile)
+
+func attempt(name string, t time.Time, failed bool) dispatcher.Delivery {
+	a := dispatcher.Attempt{Time: t, Status: http.StatusOK}
+	if failed {
+		a = dispatcher.Attempt{Time: t, Status: http.StatusNotFound, Error: "unexpected status code [404]"}
+	}
+	return dispatcher.Delivery{Listener: models.Listener{Name: name}, Attempts: []dispatcher.Attempt{a}}
+}
+
+func TestRules(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name     string
+		cfg      Config
+		attempts []bool
+		every    time.Duration
+		expected bool
+	}{
+		{name: "MAX_FAILURES", cfg: Config{MaxFailures: 3}, attempts: []bool{true, true, true}, expected: true},
+		{name: "BELOW_MAX_FAILURES", cfg: Config{MaxFailures: 3}, attempts: []bool{true, true}, expected: false},
+		{name: "SUCCESS_RESETS", cfg: Config{MaxFailures: 3}, attempts: []bool{true, true, false, true, true}, expected: false},
+		{name: "MAX_FAILING", cfg: Config{MaxFailing: time.Hour}, attempts: []bool{true, true, true}, every: time.Minute * 30, expected: true},
+		{name: "BELOW_MAX_FAILING", cfg: Config{MaxFailing: time.Hour}, attempts: []bool{true, true}, every: time.Minute * 30, expected: false},
+		{name: "DISABLED", attempts: []bool{true, true, true, true, true}, every: time.Hour, expected: false},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			now := start
+			suspended := make(chan string, 1)
+			m := New(logger, nil, test.cfg)
+			m.now = func() time.Time { return now }
+			m.suspend = func(name, reason string) { suspended <- name }
+			for i, failed := range test.attempts {
+				now = start.Add(test.every * time.Duration(i))
+				m.Attempted(attempt("hook", now, failed), false)
+			}
+			select {
+			case name := <-suspended:
+				if !test.expected || name != "hook" {
+					t.Logf("Expected [%t], but listener [%s] has been suspended", test.expected, name)
+					t.Fail()
+				}
+			case <-time.After(time.Millisecond * 100):
+				if test.expected {
+					t.Logf("Expected listener to be suspended")
+					t.Fail()
+				}
+			}
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	now := start
+	suspended := make(chan string, 2)
+	m := New(logger, nil, Config{MaxFailing: time.Hour})
+	m.now = func() time.Time { return now }
+	m.suspend = func(name, reason string) { suspended <- name }
+
+	m.Attempted(attempt("hook", now, true), false)
+	now = start.Add(time.Hour)
+	m.Attempted(attempt("hook", now, true), false)
+	//retries queued before the suspension keep failing
+	now = start.Add(time.Hour * 2)
+	m.Attempted(attempt("hook", now, true), false)
+	now = start.Add(time.Hour * 4)
+	m.Attempted(attempt("hook", now, true), false)
+	m.Reset("hook")
+	//resumed listener gets MaxFailing from its first failure
+	now = start.Add(time.Hour * 5)
+	m.Attempted(attempt("hook", now, true), false)
+
+	select {
+	case <-suspended:
+	case <-time.After(time.Millisecond * 100):
+		t.Fatal("Expected listener to be suspended")
+	}
+	select {
+	case <-suspended:
+		t.Log("Expected listener to be suspended once")
+		t.Fail()
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestSuspended(t *testing.T) {
+	notices := make(chan Notice, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notice
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("Couldn't decode notice [%v]", err)
+		}
+		notices <- n
+	}))
+	defer webhook.Close()
+	s := persistence.New(logger)
+	defer s.Close()
+	for _, event := range []string{"orders", "users"} {
+		if err := s.Register(models.Listener{Event: event, Name: "hook", Address: "http://localhost:8090/hook"}); err != nil {
+			t.Fatalf("Couldn't register listener [%v]", err)
+		}
+	}
+	m := New(logger, s, Config{MaxFailures: 1, Webhook: webhook.URL})
+
+	m.suspended("hook", "1 failed attempts in a row")
+	events, err := s.List()
+	if err != nil {
+		t.Fatalf("Couldn't list events [%v]", err)
+	}
+	for event, listeners := range events {
+		if !listeners["hook"].Suspended {
+			t.Logf("Expected listener to be suspended for the event [%s]", event)
+			t.Fail()
+		}
+	}
+	select {
+	case n := <-notices:
+		if n.Listener != "hook" || n.Reason != "1 failed attempts in a row" {
+			t.Logf("Unexpected notice [%v]", n)
+			t.Fail()
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected webhook to be notified")
+	}
+
+	//suspended listener isn't suspended and announced again
+	m.suspended("hook", "2 failed attempts in a row")
+	select {
+	case n := <-notices:
+		t.Logf("Expected a single notice, but got another one [%v]", n)
+		t.Fail()
+	case <-time.After(time.Millisecond * 100):
+	}
+}
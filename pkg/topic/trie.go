@@ -0,0 +1,181 @@
+package topic
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	//Separator splits topic into segments, e.g. orders.eu.created
+	Separator = "."
+	//Star matches exactly one segment
+	Star = "*"
+	//Hash matches zero or more segments
+	Hash = "#"
+)
+
+//IsPattern reports whether topic contains wildcards
+func IsPattern(topic string) bool {
+	return strings.Contains(topic, Star) || strings.Contains(topic, Hash)
+}
+
+//Validate checks that wildcards occupy whole segments, e.g. "orders.*" but not "orders.cr*"
+//Consecutive # are rejected as well, "#.#" matches the same topics as "#"
+func Validate(pattern string) error {
+	segs := strings.Split(pattern, Separator)
+	for i, seg := range segs {
+		if seg != Star && seg != Hash && IsPattern(seg) {
+			return fmt.Errorf("wildcard should be a whole segment [%s]", pattern)
+		}
+		if seg == Hash && i > 0 && segs[i-1] == Hash {
+			return fmt.Errorf("consecutive # should be a single one [%s]", pattern)
+		}
+	}
+	return nil
+}
+
+//Matches reports whether a single pattern matches topic, use Trie to match against many patterns
+func Matches(pattern, topic string) bool {
+	m := matcher{pattern: strings.Split(pattern, Separator), segs: strings.Split(topic, Separator), failed: make(map[[2]int]bool)}
+	return m.matches(0, 0)
+}
+
+//matcher remembers (pattern, topic) positions which don't match,
+//otherwise every # would try every split again and a few of them take forever
+type matcher struct {
+	pattern []string
+	segs    []string
+	failed  map[[2]int]bool
+}
+
+func (m *matcher) matches(p, s int) bool {
+	if p == len(m.pattern) {
+		return s == len(m.segs)
+	}
+	if m.failed[[2]int{p, s}] {
+		return false
+	}
+	ok := false
+	switch m.pattern[p] {
+	case Hash:
+		for i := s; i <= len(m.segs) && !ok; i++ {
+			ok = m.matches(p+1, i)
+		}
+	case Star:
+		ok = s < len(m.segs) && m.matches(p+1, s+1)
+	default:
+		ok = s < len(m.segs) && m.pattern[p] == m.segs[s] && m.matches(p+1, s+1)
+	}
+	if !ok {
+		m.failed[[2]int{p, s}] = true
+	}
+	return ok
+}
+
+//Trie indexes topic patterns by their segments, so matching a topic
+//costs the depth of the topic rather than the amount of registered patterns
+//It isn't safe for concurrent use
+type Trie struct {
+	root *node
+}
+
+type node struct {
+	children map[string]*node
+	//pattern is set when a registered pattern ends at this node
+	pattern string
+}
+
+func newNode() *node {
+	return &node{children: make(map[string]*node)}
+}
+
+//NewTrie creates empty Trie
+func NewTrie() *Trie {
+	return &Trie{root: newNode()}
+}
+
+//Add registers pattern, adding the same pattern twice has no effect
+func (t *Trie) Add(pattern string) {
+	n := t.root
+	for _, seg := range strings.Split(pattern, Separator) {
+		child, ok := n.children[seg]
+		if !ok {
+			child = newNode()
+			n.children[seg] = child
+		}
+		n = child
+	}
+	n.pattern = pattern
+}
+
+//Remove unregisters pattern and prunes branches left without patterns
+func (t *Trie) Remove(pattern string) {
+	remove(t.root, strings.Split(pattern, Separator), pattern)
+}
+
+//remove returns true when n has become useless and can be pruned by its parent
+func remove(n *node, segs []string, pattern string) bool {
+	if len(segs) == 0 {
+		n.pattern = ""
+	} else if child, ok := n.children[segs[0]]; ok && remove(child, segs[1:], pattern) {
+		delete(n.children, segs[0])
+	}
+	return n.pattern == "" && len(n.children) == 0
+}
+
+//Match returns every registered pattern matching topic, topic itself included when it's registered
+func (t *Trie) Match(topic string) []string {
+	var patterns []string
+	seen := make(map[string]bool)
+	m := trieMatcher{segs: strings.Split(topic, Separator), visited: make(map[visit]bool), found: func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			patterns = append(patterns, p)
+		}
+	}}
+	m.match(t.root, 0)
+	return patterns
+}
+
+//visit is a node reached with the topic consumed up to the segment
+type visit struct {
+	n *node
+	s int
+}
+
+//trieMatcher walks every node at most once per topic segment,
+//reaching it again can't find anything new
+type trieMatcher struct {
+	segs    []string
+	visited map[visit]bool
+	found   func(string)
+}
+
+func (m *trieMatcher) match(n *node, s int) {
+	if m.visited[visit{n, s}] {
+		return
+	}
+	m.visited[visit{n, s}] = true
+	if s == len(m.segs) {
+		if n.pattern != "" {
+			m.found(n.pattern)
+		}
+		//trailing # matches zero segments
+		if h, ok := n.children[Hash]; ok {
+			m.match(h, s)
+		}
+		return
+	}
+	if child, ok := n.children[m.segs[s]]; ok {
+		m.match(child, s+1)
+	}
+	if child, ok := n.children[Star]; ok {
+		m.match(child, s+1)
+	}
+	if child, ok := n.children[Hash]; ok {
+		//# swallows zero or more segments
+		for i := s; i <= len(m.segs); i++ {
+			m.match(child, i)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package topic
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrie_Match(t *testing.T) {
+	trie := NewTrie()
+	for _, p := range []string{"orders.created", "orders.*", "orders.#", "#", "*.created", "orders.*.paid", "users"} {
+		trie.Add(p)
+	}
+	tests := []struct {
+		topic    string
+		expected []string
+	}{
+		{topic: "orders.created", expected: []string{"#", "*.created", "orders.#", "orders.*", "orders.created"}},
+		{topic: "orders", expected: []string{"#", "orders.#"}},
+		{topic: "orders.eu.paid", expected: []string{"#", "orders.#", "orders.*.paid"}},
+		{topic: "users", expected: []string{"#", "users"}},
+		{topic: "users.created", expected: []string{"#", "*.created"}},
+	}
+	for _, test := range tests {
+		actual := trie.Match(test.topic)
+		sort.Strings(actual)
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Logf("[%s] Expected [%v], but got [%v]", test.topic, test.expected, actual)
+			t.Fail()
+		}
+	}
+}
+
+func TestTrie_Remove(t *testing.T) {
+	trie := NewTrie()
+	trie.Add("orders.*")
+	trie.Add("orders.*.paid")
+
+	trie.Remove("orders.*")
+
+	if actual := trie.Match("orders.created"); len(actual) != 0 {
+		t.Logf("Expected no patterns, but got [%v]", actual)
+		t.Fail()
+	}
+	if actual := trie.Match("orders.eu.paid"); !reflect.DeepEqual(actual, []string{"orders.*.paid"}) {
+		t.Logf("Expected [orders.*.paid], but got [%v]", actual)
+		t.Fail()
+	}
+	trie.Remove("orders.*.paid")
+	if len(trie.root.children) != 0 {
+		t.Log("Expected empty branches to be pruned")
+		t.Fail()
+	}
+}
+
+func TestPathologicalPattern(t *testing.T) {
+	//consecutive # are rejected by Validate, but the journal or a scope could still bring them in
+	pattern := strings.Repeat("#.", 12) + "z"
+	topic := strings.Repeat("a.", 40) + "b"
+	trie := NewTrie()
+	trie.Add(pattern)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if actual := trie.Match(topic); len(actual) != 0 {
+			t.Logf("Expected no patterns, but got [%v]", actual)
+			t.Fail()
+		}
+		if Matches(pattern, topic) {
+			t.Log("Expected pattern not to match")
+			t.Fail()
+		}
+		if !Matches(pattern, topic+".z") {
+			t.Log("Expected pattern to match")
+			t.Fail()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Matching pathological pattern takes too long")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{pattern: "orders.created", valid: true},
+		{pattern: "orders.*", valid: true},
+		{pattern: "#", valid: true},
+		{pattern: "orders.cr*", valid: false},
+		{pattern: "orders#", valid: false},
+		{pattern: "#.*.#", valid: true},
+		{pattern: "orders.#.#", valid: false},
+	}
+	for _, test := range tests {
+		if err := Validate(test.pattern); (err == nil) != test.valid {
+			t.Logf("[%s] Expected valid [%t], but got [%v]", test.pattern, test.valid, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		topic    string
+		expected bool
+	}{
+		{pattern: "orders.created", topic: "orders.created", expected: true},
+		{pattern: "orders.created", topic: "orders.paid", expected: false},
+		{pattern: "orders.*", topic: "orders.created", expected: true},
+		{pattern: "orders.*", topic: "orders", expected: false},
+		{pattern: "orders.*", topic: "orders.eu.created", expected: false},
+		{pattern: "orders.#", topic: "orders", expected: true},
+		{pattern: "orders.#", topic: "orders.eu.created", expected: true},
+		{pattern: "#", topic: "users", expected: true},
+		{pattern: "*.created", topic: "users.created", expected: true},
+		{pattern: "orders.#.paid", topic: "orders.eu.de.paid", expected: true},
+		{pattern: "orders.#.paid", topic: "orders.eu.created", expected: false},
+	}
+	for _, test := range tests {
+		if actual := Matches(test.pattern, test.topic); actual != test.expected {
+			t.Logf("[%s] [%s] Expected [%v], but got [%v]", test.pattern, test.topic, test.expected, actual)
+			t.Fail()
+		}
+	}
+}
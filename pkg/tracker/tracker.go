@@ -0,0 +1,300 @@
+//Package tracker follows published messages and keeps the delivery log of every listener
+package tracker
+
+import (
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/models"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//DefaultCapacity is the amount of messages followed when capacity isn't set
+const DefaultCapacity = 10000
+
+//DefaultLimit is the amount of deliveries listed when limit isn't set
+const DefaultLimit = 100
+
+//Delivery states of a listener
+const (
+	//StatePending means listener hasn't been attempted yet
+	StatePending = "pending"
+	//StateDelivered means listener has accepted the message
+	StateDelivered = "delivered"
+	//StateRetrying means attempt has failed and another one is scheduled
+	StateRetrying = "retrying"
+	//StateFailed means delivery has been given up or couldn't be queued
+	StateFailed = "failed"
+	//StateFiltered means listener's filter doesn't match the message
+	StateFiltered = "filtered"
+	//StateSuspended means listener has been suspended, so the message isn't delivered to it
+	StateSuspended = "suspended"
+)
+
+//Status is the delivery status of the message for a single listener
+//Status, Latency and Error describe the latest attempt, History lists all of them
+type Status struct {
+	Listener string               `json:"listener"`
+	Address  string               `json:"address"`
+	State    string               `json:"state"`
+	Status   int                  `json:"status,omitempty"`
+	Latency  models.Duration      `json:"latency,omitempty"`
+	Error    string               `json:"error,omitempty"`
+	Attempts int                  `json:"attempts"`
+	History  []dispatcher.Attempt `json:"history,omitempty"`
+}
+
+//Message is the delivery report of a published message
+type Message struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	Published time.Time `json:"published"`
+	Listeners []Status  `json:"listeners"`
+}
+
+//Delivery is the delivery status of a message for a single listener
+type Delivery struct {
+	MessageID string    `json:"message_id"`
+	Event     string    `json:"event"`
+	Published time.Time `json:"published"`
+	Status
+}
+
+type message struct {
+	Message
+	index map[string]int
+	//unsettled is the amount of listeners still in StatePending, settled is closed once it reaches 0
+	unsettled int
+	settled   chan struct{}
+}
+
+//Tracker keeps reports of the latest messages in memory
+//Message is forgotten once it's older than retention or capacity is reached
+//It is safe for concurrent use
+type Tracker struct {
+	mu        sync.Mutex
+	logger    *log.Logger
+	capacity  int
+	retention time.Duration
+	messages  map[string]*message
+	order     []string
+	now       func() time.Time
+}
+
+//New creates empty Tracker, capacity <= 0 means DefaultCapacity
+//retention <= 0 means messages are kept until capacity is reached
+//if logger == nil, default will be taken
+func New(logger *log.Logger, capacity int, retention time.Duration) *Tracker {
+	if logger == nil {
+		logger = log.New(os.Stdout, "tracker: ", log.LstdFlags|log.Lshortfile)
+	}
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Tracker{logger: logger, capacity: capacity, retention: retention, messages: make(map[string]*message), now: time.Now}
+}
+
+//Track starts following the message with the id, every listener is pending
+//It should be called before deliveries are queued, otherwise their outcome may be missed
+//Message published again with the same id after a failure keeps statuses of the listeners it has been queued for
+func (t *Tracker) Track(id, event string, listeners []models.Listener) {
+	m := &message{
+		Message: Message{ID: id, Event: event, Published: t.now(), Listeners: make([]Status, 0, len(listeners))},
+		index:   make(map[string]int, len(listeners)),
+		settled: make(chan struct{}),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire()
+	previous, republished := t.messages[id]
+	for i, l := range listeners {
+		m.index[l.Name] = i
+		s := Status{Listener: l.Name, Address: l.Address, State: StatePending}
+		if republished {
+			//listener which has been queued is either still pending or has been attempted,
+			//the rest has been skipped and is going to be queued again
+			if j, ok := previous.index[l.Name]; ok && (previous.Listeners[j].State == StatePending || previous.Listeners[j].Attempts > 0) {
+				s = previous.Listeners[j]
+			}
+		}
+		if s.State == StatePending {
+			m.unsettled++
+		}
+		m.Listeners = append(m.Listeners, s)
+	}
+	if m.unsettled == 0 {
+		close(m.settled)
+	}
+	if republished {
+		t.forget(id)
+	}
+	for len(t.order) >= t.capacity {
+		delete(t.messages, t.order[0])
+		t.order = t.order[1:]
+	}
+	t.messages[id] = m
+	t.order = append(t.order, id)
+}
+
+//Replayed follows the message replayed to the listener, it's pending again even if the message has been delivered to it
+//Listener which didn't match the message when it was published is added to its report
+//Message which isn't followed anymore is tracked from scratch
+//It should be called before the delivery is queued, like Track
+func (t *Tracker) Replayed(id, event string, l models.Listener) {
+	t.mu.Lock()
+	m, ok := t.messages[id]
+	if !ok {
+		t.mu.Unlock()
+		t.Track(id, event, []models.Listener{l})
+		return
+	}
+	defer t.mu.Unlock()
+	i, ok := m.index[l.Name]
+	if ok && m.Listeners[i].State == StatePending {
+		return
+	}
+	if !ok {
+		i = len(m.Listeners)
+		m.index[l.Name] = i
+		m.Listeners = append(m.Listeners, Status{})
+	}
+	m.Listeners[i] = Status{Listener: l.Name, Address: l.Address, State: StatePending}
+	//once the message has settled, Wait is over for it and replays aren't waited for
+	if m.unsettled > 0 {
+		m.unsettled++
+	}
+}
+
+//Skip marks listener which won't be attempted, e.g. filtered out or not queued
+func (t *Tracker) Skip(id, listener, state, reason string) {
+	t.update(id, listener, func(s *Status) {
+		s.State = state
+		s.Error = reason
+	})
+}
+
+//Attempted records outcome of the delivery attempt, it implements dispatcher.Observer
+func (t *Tracker) Attempted(dl dispatcher.Delivery, final bool) {
+	if len(dl.Attempts) == 0 {
+		return
+	}
+	a := dl.Attempts[len(dl.Attempts)-1]
+	t.update(dl.MessageID, dl.Name, func(s *Status) {
+		s.Status = a.Status
+		s.Latency = a.Latency
+		s.Error = a.Error
+		s.Attempts = len(dl.Attempts)
+		s.History = append([]dispatcher.Attempt(nil), dl.Attempts...)
+		switch {
+		case a.Error == "":
+			s.State = StateDelivered
+		case final:
+			s.State = StateFailed
+		default:
+			s.State = StateRetrying
+		}
+	})
+}
+
+func (t *Tracker) update(id, listener string, apply func(s *Status)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.messages[id]
+	if !ok {
+		return
+	}
+	i, ok := m.index[listener]
+	if !ok {
+		return
+	}
+	pending := m.Listeners[i].State == StatePending
+	apply(&m.Listeners[i])
+	if pending && m.Listeners[i].State != StatePending && m.unsettled > 0 {
+		m.unsettled--
+		if m.unsettled == 0 {
+			close(m.settled)
+		}
+	}
+}
+
+//Get returns report of the message by its id
+func (t *Tracker) Get(id string) (Message, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire()
+	m, ok := t.messages[id]
+	if !ok {
+		return Message{}, false
+	}
+	return m.copy(), true
+}
+
+//Wait blocks until every listener of the message has been attempted at least once or timeout passes
+//It returns the report at that moment, listeners which haven't been attempted yet are pending
+func (t *Tracker) Wait(id string, timeout time.Duration) (Message, bool) {
+	t.mu.Lock()
+	m, ok := t.messages[id]
+	t.mu.Unlock()
+	if !ok {
+		return Message{}, false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-m.settled:
+	case <-timer.C:
+		t.logger.Printf("Message [%s] hasn't been attempted to every listener within [%s]\n", id, timeout)
+	}
+	return t.Get(id)
+}
+
+//Deliveries lists deliveries to the listener, the latest first
+//event limits them to a single event unless it's empty, limit <= 0 means DefaultLimit
+func (t *Tracker) Deliveries(listener, event string, limit int) []Delivery {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire()
+	deliveries := []Delivery{}
+	for i := len(t.order) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		m := t.messages[t.order[i]]
+		if event != "" && m.Event != event {
+			continue
+		}
+		if j, ok := m.index[listener]; ok {
+			deliveries = append(deliveries, Delivery{MessageID: m.ID, Event: m.Event, Published: m.Published, Status: m.Listeners[j]})
+		}
+	}
+	return deliveries
+}
+
+func (t *Tracker) forget(id string) {
+	delete(t.messages, id)
+	for i, v := range t.order {
+		if v == id {
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			break
+		}
+	}
+}
+
+//expire forgets messages older than retention, messages are ordered by the time they were tracked
+func (t *Tracker) expire() {
+	if t.retention <= 0 {
+		return
+	}
+	deadline := t.now().Add(-t.retention)
+	for len(t.order) > 0 && t.messages[t.order[0]].Published.Before(deadline) {
+		delete(t.messages, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+func (m *message) copy() Message {
+	c := m.Message
+	c.Listeners = append([]Status(nil), m.Listeners...)
+	return c
+}
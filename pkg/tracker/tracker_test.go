@@ -0,0 +1,207 @@
+package tracker
+
+import (
+	"github.com/volodimyr/publisher/pkg/dispatcher"
+	"github.com/volodimyr/publisher/pkg/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var listeners = []models.Listener{
+	{Event: "event", Name: "first", Address: "http://first"},
+	{Event: "event", Name: "second", Address: "http://second"},
+	{Event: "event", Name: "third", Address: "http://third"},
+}
+
+func TestTracker(t *testing.T) {
+	tr := New(nil, 0, 0)
+	tr.Track("id", "event", listeners)
+
+	delivered := dispatcher.Attempt{Status: 200, Latency: models.Duration(time.Millisecond), Response: "ok"}
+	failed := dispatcher.Attempt{Status: 500, Error: "unexpected status code [500]"}
+	tr.Attempted(dispatcher.Delivery{Listener: models.Listener{Name: "first"}, MessageID: "id", Attempts: []dispatcher.Attempt{delivered}}, true)
+	tr.Attempted(dispatcher.Delivery{Listener: models.Listener{Name: "second"}, MessageID: "id", Attempts: []dispatcher.Attempt{failed}}, false)
+	tr.Skip("id", "third", StateFiltered, "")
+	//unknown message and listener are ignored
+	tr.Attempted(dispatcher.Delivery{Listener: models.Listener{Name: "first"}, MessageID: "unknown", Attempts: []dispatcher.Attempt{{Status: 200}}}, true)
+	tr.Skip("id", "unknown", StateFailed, "")
+
+	m, ok := tr.Wait("id", time.Second)
+	if !ok {
+		t.Fatal("Expected message to be tracked")
+	}
+	expected := []Status{
+		{Listener: "first", Address: "http://first", State: StateDelivered, Status: 200, Latency: models.Duration(time.Millisecond), Attempts: 1,
+			History: []dispatcher.Attempt{delivered}},
+		{Listener: "second", Address: "http://second", State: StateRetrying, Status: 500, Error: "unexpected status code [500]", Attempts: 1,
+			History: []dispatcher.Attempt{failed}},
+		{Listener: "third", Address: "http://third", State: StateFiltered},
+	}
+	if m.ID != "id" || m.Event != "event" || len(m.Listeners) != len(expected) {
+		t.Fatalf("Unexpected report [%+v]", m)
+	}
+	for i, s := range expected {
+		if !reflect.DeepEqual(m.Listeners[i], s) {
+			t.Logf("Expected [%+v], but got [%+v]", s, m.Listeners[i])
+			t.Fail()
+		}
+	}
+
+	tr.Attempted(dispatcher.Delivery{Listener: models.Listener{Name: "second"}, MessageID: "id",
+		Attempts: []dispatcher.Attempt{{Status: 500, Error: "first"}, {Error: "second"}}}, true)
+	if m, _ := tr.Get("id"); m.Listeners[1].State != StateFailed || m.Listeners[1].Attempts != 2 || m.Listeners[1].Error != "second" {
+		t.Logf("Expected given up delivery to be failed, but got [%+v]", m.Listeners[1])
+		t.Fail()
+	}
+}
+
+func TestTrackRepublished(t *testing.T) {
+	tr := New(nil, 0, 0)
+	tr.Track("id", "event", listeners)
+	//first has been queued and delivered, second is still queued, third couldn't be queued
+	tr.Attempted(dispatcher.Delivery{Listener: models.Listener{Name: "first"}, MessageID: "id", Attempts: []dispatcher.Attempt{{Status: 200}}}, true)
+	tr.Skip("id", "third", StateFailed, "queue is full")
+
+	tr.Track("id", "event", listeners)
+
+	m, _ := tr.Get("id")
+	expected := []string{StateDelivered, StatePending, StatePending}
+	for i, s := range m.Listeners {
+		if s.State != expected[i] {
+			t.Logf("[%s] Expected [%s], but got [%s]", s.Listener, expected[i], s.State)
+			t.Fail()
+		}
+	}
+	tr.Skip("id", "second", StateFiltered, "")
+	tr.Skip("id", "third", StateFiltered, "")
+	if _, settled := tr.Wait("id", time.Second); !settled {
+		t.Log("Expected message to settle")
+		t.Fail()
+	}
+}
+
+func TestReplayed(t *testing.T) {
+	tr := New(nil, 0, 0)
+	tr.Track("id", "event", listeners[:1])
+	delivered := []dispatcher.Attempt{{Status: 200}}
+	tr.Attempted(dispatcher.Delivery{Listener: models.Listener{Name: "first"}, MessageID: "id", Attempts: delivered}, true)
+
+	tr.Replayed("id", "event", listeners[0])
+	tr.Replayed("id", "event", listeners[1])
+	tr.Replayed("unknown", "event", listeners[2])
+
+	//message settled before the replay, so it isn't waited for again
+	m, _ := tr.Wait("id", time.Second)
+	expected := []Status{
+		{Listener: "first", Address: "http://first", State: StatePending},
+		{Listener: "second", Address: "http://second", State: StatePending},
+	}
+	if !reflect.DeepEqual(m.Listeners, expected) {
+		t.Logf("Expected [%+v], but got [%+v]", expected, m.Listeners)
+		t.Fail()
+	}
+	tr.Attempted(dispatcher.Delivery{Listener: models.Listener{Name: "second"}, MessageID: "id", Attempts: delivered}, true)
+	if d := tr.Deliveries("second", "", 0); len(d) != 1 || d[0].MessageID != "id" || d[0].State != StateDelivered {
+		t.Logf("Expected replayed delivery to be logged, but got [%+v]", d)
+		t.Fail()
+	}
+	//forgotten message is followed from scratch
+	if m, ok := tr.Get("unknown"); !ok || len(m.Listeners) != 1 || m.Listeners[0].Listener != "third" {
+		t.Logf("Expected replayed message to be tracked, but got [%+v] [%t]", m, ok)
+		t.Fail()
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	tr := New(nil, 0, 0)
+	tr.Track("id", "event", listeners)
+	tr.Skip("id", "first", StateFiltered, "")
+
+	start := time.Now()
+	m, ok := tr.Wait("id", time.Millisecond*50)
+	if !ok || time.Since(start) < time.Millisecond*50 {
+		t.Fatalf("Expected Wait to time out, but it returned after [%s]", time.Since(start))
+	}
+	if m.Listeners[1].State != StatePending || m.Listeners[2].State != StatePending {
+		t.Logf("Expected not attempted listeners to be pending, but got [%+v]", m.Listeners)
+		t.Fail()
+	}
+	if _, ok := tr.Wait("unknown", time.Second); ok {
+		t.Log("Expected unknown message not to be found")
+		t.Fail()
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	tr := New(nil, 2, 0)
+	for _, id := range []string{"1", "2", "3"} {
+		tr.Track(id, "event", nil)
+	}
+	if _, ok := tr.Get("1"); ok {
+		t.Log("Expected the oldest message to be forgotten")
+		t.Fail()
+	}
+	if _, ok := tr.Get("3"); !ok {
+		t.Log("Expected the latest message to be tracked")
+		t.Fail()
+	}
+}
+
+func TestRetention(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tr := New(nil, 0, time.Hour)
+	tr.now = func() time.Time { return now }
+	tr.Track("old", "event", listeners)
+	now = now.Add(time.Minute * 30)
+	tr.Track("new", "event", listeners)
+	now = now.Add(time.Minute * 31)
+
+	if _, ok := tr.Get("old"); ok {
+		t.Log("Expected message older than retention to be forgotten")
+		t.Fail()
+	}
+	if _, ok := tr.Get("new"); !ok {
+		t.Log("Expected message within retention to be kept")
+		t.Fail()
+	}
+}
+
+func TestDeliveries(t *testing.T) {
+	tr := New(nil, 0, 0)
+	tr.Track("1", "orders", listeners[:1])
+	tr.Track("2", "users", listeners)
+	tr.Track("3", "orders", listeners[1:])
+	tr.Track("4", "orders", listeners)
+	tr.Attempted(dispatcher.Delivery{Listener: models.Listener{Name: "first"}, MessageID: "4", Attempts: []dispatcher.Attempt{{Status: 200}}}, true)
+
+	tests := []struct {
+		name     string
+		listener string
+		event    string
+		limit    int
+		expected []string
+	}{
+		{name: "All", listener: "first", expected: []string{"4", "2", "1"}},
+		{name: "Event", listener: "first", event: "orders", expected: []string{"4", "1"}},
+		{name: "Limit", listener: "first", limit: 1, expected: []string{"4"}},
+		{name: "Unknown", listener: "unknown", expected: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deliveries := tr.Deliveries(test.listener, test.event, test.limit)
+			ids := []string{}
+			for _, d := range deliveries {
+				ids = append(ids, d.MessageID)
+			}
+			if !reflect.DeepEqual(ids, test.expected) {
+				t.Logf("Expected [%v], but got [%v]", test.expected, ids)
+				t.Fail()
+			}
+		})
+	}
+	if d := tr.Deliveries("first", "", 1)[0]; d.State != StateDelivered || d.Event != "orders" || d.Listener != "first" {
+		t.Logf("Unexpected delivery [%+v]", d)
+		t.Fail()
+	}
+}
@@ -0,0 +1,252 @@
+//Package verification confirms that listener wants to receive messages before it's registered
+//
+//It follows WebSub intent verification: publisher sends
+//	GET {address}?hub.mode=subscribe&hub.topic={event}&hub.challenge={random}
+//and listener confirms the subscription by responding 2xx with the challenge as body.
+package verification
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/volodimyr/publisher/pkg/client"
+	"github.com/volodimyr/publisher/pkg/models"
+	"github.com/volodimyr/publisher/pkg/persistence"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//DefaultExpiry is how long registration stays pending when Config.Expiry isn't set
+	DefaultExpiry = 10 * time.Minute
+	//DefaultInterval is the delay between verification attempts when Config.Interval isn't set
+	DefaultInterval = 30 * time.Second
+)
+
+var (
+	//ErrNotConfirmed is returned when listener didn't echo the challenge
+	ErrNotConfirmed = errors.New("verification: challenge wasn't echoed")
+	//ErrStopped is returned when registration is submitted into stopped verifier
+	ErrStopped = errors.New("verification: stopped")
+)
+
+//Pending is a registration waiting for the listener to confirm it
+type Pending struct {
+	Listener  models.Listener `json:"listener"`
+	Created   time.Time       `json:"created"`
+	Expires   time.Time       `json:"expires"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+
+	cancel chan struct{}
+}
+
+//Config defines how long registration can be pending and how often it's verified
+//Zero values are replaced with defaults
+type Config struct {
+	Expiry   time.Duration
+	Interval time.Duration
+}
+
+//Verifier keeps pending registrations and verifies them in background
+//Confirmed listener is registered into the registry, pending registrations are lost on restart
+type Verifier struct {
+	logger   *log.Logger
+	r        persistence.Registry
+	expiry   time.Duration
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*Pending
+	quit    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+//New creates Verifier registering confirmed listeners into the registry
+//if logger == nil, default will be taken
+func New(logger *log.Logger, registry persistence.Registry, cfg Config) *Verifier {
+	if logger == nil {
+		logger = log.New(os.Stdout, "verification: ", log.LstdFlags|log.Lshortfile)
+	}
+	if cfg.Expiry <= 0 {
+		cfg.Expiry = DefaultExpiry
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	return &Verifier{
+		logger:   logger,
+		r:        registry,
+		expiry:   cfg.Expiry,
+		interval: cfg.Interval,
+		pending:  make(map[string]*Pending),
+		quit:     make(chan struct{}),
+	}
+}
+
+//Submit puts registration into the pending state and starts verifying it
+//Registration of the same listener into the same event replaces the pending one
+func (v *Verifier) Submit(l models.Listener) (Pending, error) {
+	select {
+	case <-v.quit:
+		return Pending{}, ErrStopped
+	default:
+	}
+	now := time.Now()
+	p := &Pending{Listener: l, Created: now, Expires: now.Add(v.expiry), cancel: make(chan struct{})}
+	k := key(l.Name, l.Event)
+	v.mu.Lock()
+	if old, ok := v.pending[k]; ok {
+		close(old.cancel)
+	}
+	v.pending[k] = p
+	c := p.copy()
+	v.mu.Unlock()
+	v.wg.Add(1)
+	go v.verify(k, p)
+	return c, nil
+}
+
+//Pending returns pending registrations of the listener with the name ordered by event
+func (v *Verifier) Pending(name string) []Pending {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var pending []Pending
+	for _, p := range v.pending {
+		if p.Listener.Name == name {
+			pending = append(pending, p.copy())
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Listener.Event < pending[j].Listener.Event })
+	return pending
+}
+
+//Cancel drops pending registrations of the listener from the event or from every event when event is empty
+//returns whether anything has been dropped
+func (v *Verifier) Cancel(name, event string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	cancelled := false
+	for k, p := range v.pending {
+		if p.Listener.Name == name && (event == "" || p.Listener.Event == event) {
+			close(p.cancel)
+			delete(v.pending, k)
+			cancelled = true
+		}
+	}
+	return cancelled
+}
+
+//Stop stops verification of every pending registration and waits until attempts in flight are finished
+func (v *Verifier) Stop() {
+	v.once.Do(func() {
+		close(v.quit)
+	})
+	v.wg.Wait()
+}
+
+func (v *Verifier) verify(k string, p *Pending) {
+	defer v.wg.Done()
+	expired := time.NewTimer(time.Until(p.Expires))
+	defer expired.Stop()
+	for {
+		err := v.challenge(p.Listener)
+		v.mu.Lock()
+		if v.pending[k] != p {
+			//replaced or cancelled while the attempt was in flight
+			v.mu.Unlock()
+			return
+		}
+		p.Attempts++
+		if err == nil {
+			delete(v.pending, k)
+			v.mu.Unlock()
+			if err := v.r.Register(p.Listener); err != nil {
+				v.logger.Printf("Couldn't register verified listener [%s] into [%s] [%v]\n", p.Listener.Name, p.Listener.Event, err)
+				return
+			}
+			v.logger.Printf("Listener [%s] confirmed subscription to [%s]\n", p.Listener.Name, p.Listener.Event)
+			return
+		}
+		p.LastError = err.Error()
+		v.mu.Unlock()
+		v.logger.Printf("Listener [%s] didn't confirm subscription to [%s], attempt [%d] [%v]\n", p.Listener.Name, p.Listener.Event, p.Attempts, err)
+		select {
+		case <-time.After(v.interval):
+		case <-expired.C:
+			v.mu.Lock()
+			if v.pending[k] == p {
+				delete(v.pending, k)
+			}
+			v.mu.Unlock()
+			v.logger.Printf("Subscription of listener [%s] to [%s] expired unconfirmed\n", p.Listener.Name, p.Listener.Event)
+			return
+		case <-p.cancel:
+			return
+		case <-v.quit:
+			return
+		}
+	}
+}
+
+//challenge sends random challenge to the listener and checks it's echoed back
+func (v *Verifier) challenge(l models.Listener) error {
+	u, err := url.Parse(l.Address)
+	if err != nil {
+		return err
+	}
+	challenge, err := newChallenge()
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("hub.mode", "subscribe")
+	q.Set("hub.topic", l.Event)
+	q.Set("hub.challenge", challenge)
+	u.RawQuery = q.Encode()
+	resp, err := client.DoGET(u.String(), v.logger)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("verification: unexpected status code [%d]", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(len(challenge))+64))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != challenge {
+		return ErrNotConfirmed
+	}
+	return nil
+}
+
+//copy returns snapshot of the pending registration which is safe to respond with
+func (p *Pending) copy() Pending {
+	c := *p
+	c.Listener = p.Listener.Redacted()
+	c.cancel = nil
+	return c
+}
+
+func key(name, event string) string {
+	return name + "\x00" + event
+}
+
+func newChallenge() (string, error) {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bs), nil
+}
@@ -0,0 +1,123 @@
+package verification
+
+import (
+	"github.com/volodimyr/publisher/pkg/models"
+	"github.com/volodimyr/publisher/pkg/persistence"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var logger = log.New(os.Stdout, "test: ", log.LstdFlags|log.Lshortfile)
+
+//echo confirms subscriptions once confirm is set
+func echo(confirm *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Query().Get("hub.mode") != "subscribe" || r.URL.Query().Get("hub.topic") == "" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		if atomic.LoadInt32(confirm) == 0 {
+			http.Error(w, "not yet", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+	}))
+}
+
+func waitRegistered(t *testing.T, s *persistence.Storage, event string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := s.Lookup(event); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Listener wasn't registered into [%s]", event)
+}
+
+func TestVerifierConfirms(t *testing.T) {
+	confirm := int32(0)
+	fake := echo(&confirm)
+	defer fake.Close()
+	s := persistence.New(logger)
+	defer s.Close()
+	v := New(logger, s, Config{Expiry: time.Minute, Interval: 20 * time.Millisecond})
+	defer v.Stop()
+
+	if _, err := v.Submit(models.Listener{Event: "orders", Name: "audit", Address: fake.URL + "/hook?token=1", Secrets: []string{"secret"}}); err != nil {
+		t.Fatal(err)
+	}
+	pending := v.Pending("audit")
+	if len(pending) != 1 || pending[0].Listener.Secrets != nil {
+		t.Logf("Expected single redacted pending registration, but got [%v]", pending)
+		t.Fail()
+	}
+	if _, err := s.Lookup("orders"); err != persistence.ErrNotFound {
+		t.Logf("Expected pending listener not to be registered, but got [%v]", err)
+		t.Fail()
+	}
+
+	atomic.StoreInt32(&confirm, 1)
+	waitRegistered(t, s, "orders")
+	if pending := v.Pending("audit"); len(pending) != 0 {
+		t.Logf("Expected no pending registrations, but got [%v]", pending)
+		t.Fail()
+	}
+}
+
+func TestVerifierExpires(t *testing.T) {
+	confirm := int32(0)
+	fake := echo(&confirm)
+	defer fake.Close()
+	s := persistence.New(logger)
+	defer s.Close()
+	v := New(logger, s, Config{Expiry: 100 * time.Millisecond, Interval: 20 * time.Millisecond})
+	defer v.Stop()
+
+	if _, err := v.Submit(models.Listener{Event: "orders", Name: "audit", Address: fake.URL}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	if pending := v.Pending("audit"); len(pending) != 0 {
+		t.Logf("Expected pending registration to expire, but got [%v]", pending)
+		t.Fail()
+	}
+	if _, err := s.Lookup("orders"); err != persistence.ErrNotFound {
+		t.Logf("Expected expired listener not to be registered, but got [%v]", err)
+		t.Fail()
+	}
+}
+
+func TestVerifierCancel(t *testing.T) {
+	confirm := int32(0)
+	fake := echo(&confirm)
+	defer fake.Close()
+	s := persistence.New(logger)
+	defer s.Close()
+	v := New(logger, s, Config{Expiry: time.Minute, Interval: 20 * time.Millisecond})
+	defer v.Stop()
+
+	for _, event := range []string{"orders", "users"} {
+		if _, err := v.Submit(models.Listener{Event: event, Name: "audit", Address: fake.URL}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !v.Cancel("audit", "orders") {
+		t.Logf("Expected pending registration to be cancelled")
+		t.Fail()
+	}
+	if pending := v.Pending("audit"); len(pending) != 1 || pending[0].Listener.Event != "users" {
+		t.Logf("Expected only users to be pending, but got [%v]", pending)
+		t.Fail()
+	}
+	if v.Cancel("audit", "orders") {
+		t.Logf("Expected nothing to be cancelled twice")
+		t.Fail()
+	}
+}